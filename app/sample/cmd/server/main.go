@@ -1,72 +1,150 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"kratos_example/config"
 	"kratos_example/handler"
 	"kratos_example/kratos"
+	"kratos_example/ratelimit"
+	"kratos_example/server"
+	"kratos_example/store"
+	"kratos_example/telemetry"
 	"log/slog"
 	"net/http"
 	"os"
-)
+	"os/signal"
+	"syscall"
+	"time"
 
-var (
-	kratosProvider  *kratos.Provider
-	handlerProvider *handler.Provider
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 )
 
-func init() {
+const serviceVersion = "0.1.0"
+
+func main() {
+	configPath := flag.String("config", "", "設定ファイルのパス (YAML もしくは TOML)")
+	printConfig := flag.Bool("print-config", false, "読み込んだ設定を出力して終了する (secret は伏せて出力する)")
+	flag.Parse()
+
+	// os.Exit は defer を実行しないため、run の終了処理(トレースの送信等)を実行した後に終了コードを設定する
+	if err := run(*configPath, *printConfig); err != nil {
+		slog.Error("server exited with error", "Error", err)
+		os.Exit(1)
+	}
+}
+
+func run(configPath string, printConfig bool) error {
+	// 設定の読み込み (デフォルト値 < 設定ファイル < 環境変数)
+	loadOutput, err := config.Load(config.LoadInput{Path: configPath})
+	if err != nil {
+		return err
+	}
+	cfg := loadOutput.Config
+
+	if printConfig {
+		return cfg.Print(os.Stdout)
+	}
+
 	// Set up logger
-	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
-		AddSource: true,
-		Level:     slog.LevelDebug,
-	})))
-
-	// Init packages
-	kratos.Init(kratos.InitInput{
-		PrivilegedAccessLimitMinutes: 10,
-		KratosPublicEndpoint:         "http://kratos:4433",
-		KratosAdminEndpoint:          "http://kratos:4434",
-		BirthdateFormat:              "2006-01-02",
-	})
-
-	handler.Init(handler.InitInput{
-		CookieParams: handler.CookieParams{
-			SessionCookieName: "kratos_session",
-			Path:              "/",
-			Domain:            "localhost",
-			Secure:            false,
-		},
-		BirthdateFormat: "2006-01-02",
-	})
+	slog.SetDefault(slog.New(cfg.LogHandler(os.Stdout)))
+	slog.Info("config loaded", "path", loadOutput.Path)
+
+	// Set up tracing
+	shutdownTracing, err := telemetry.Init(context.Background(), cfg.TelemetryInitInput(serviceVersion))
+	if err != nil {
+		return err
+	}
+	// 未送信のスパンを送信してから終了する
+	defer shutdownTracing(context.Background())
 
 	// Create package providers with dependencies
-	var err error
+	sessionStore, err := store.New(cfg.StoreNewInput())
+	if err != nil {
+		return err
+	}
+
+	// Redis を使用する場合は、レート制限もプロセス間で共有する
+	var limiter ratelimit.Limiter = ratelimit.NewMemoryLimiter()
+	if redisStore, ok := sessionStore.(*store.RedisStore); ok {
+		limiter = ratelimit.NewRedisLimiter(redisStore)
+	}
 
-	kratosProvider, err = kratos.New(
+	kratosProvider, err := kratos.New(
 		kratos.NewInput{
-			Dependencies: kratos.Dependencies{},
+			Dependencies: kratos.Dependencies{
+				Store: sessionStore,
+			},
+			Config: cfg.KratosProviderConfig(),
 		},
 	)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	handlerProvider, err = handler.New(
+	// メトリクス
+	metricsRegistry := prometheus.NewRegistry()
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	metricsRegistry.MustRegister(kratosProvider.MetricsCollectors()...)
+
+	handlerProvider, err := handler.New(
 		handler.NewInput{
 			Dependencies: handler.Dependencies{
-				Kratos: kratosProvider,
+				Kratos:          kratosProvider,
+				Store:           sessionStore,
+				Limiter:         limiter,
+				MetricsGatherer: metricsRegistry,
 			},
+			Config: cfg.HandlerProviderConfig(),
 		},
 	)
 	if err != nil {
-		panic(err)
+		return err
 	}
-}
+	metricsRegistry.MustRegister(handlerProvider.MetricsCollectors()...)
 
-func main() {
 	mux := http.NewServeMux()
 	mux = handlerProvider.RegisterHandles(mux)
 
-	if err := http.ListenAndServe(":3000", mux); err != nil {
-		panic(err)
+	srv, err := server.New(cfg.ServerNewInput(mux))
+	if err != nil {
+		return err
+	}
+
+	// SIGTERM (デプロイ時等)、SIGINT を受信した場合は、処理中のリクエストの完了を待って終了する
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		slog.Info("listening", "addr", cfg.Server.Addr, "tls", srv.TLSEnabled(), "h2c", cfg.Server.H2C)
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+	stop()
+
+	// ヘルスチェックを失敗させ、ロードバランサが振り分け先から外すまでの間はリクエストを受け付け続ける
+	slog.Info("shutting down", "drainDelay", cfg.Server.DrainDelay)
+	handlerProvider.StartDraining()
+	time.Sleep(cfg.Server.DrainDelay)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Error("failed to shut down gracefully", "Error", err)
+	}
+	if err := <-serveErr; err != nil {
+		return err
 	}
+	slog.Info("server stopped")
+	return nil
 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Kratos の session.whoami.tokenizer で使用する署名鍵の生成
+//
+// 署名鍵(秘密鍵を含むJWKS)を Kratos の設定ディレクトリへ、検証用の公開鍵のJWKSをアプリのディレクトリへ出力する
+// 秘密鍵はリポジトリに含めず(.gitignore)、環境ごとにセットアップ時に生成する
+// 開発環境では app/sample で go run ./cmd/tokenizer-jwks を実行する
+// 本番環境では、秘密鍵をシークレットとして管理し、Kratos のみが読み込めるようにする
+
+// JWK (ES256)
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	D   string `json:"d,omitempty"`
+}
+
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+func main() {
+	privatePath := flag.String("private", "../../kratos/tokenizer/app.jwks.json", "署名鍵のJWKSの出力先 (Kratos の jwks_url)")
+	publicPath := flag.String("public", "jwks/tokenizer.pub.json", "公開鍵のJWKSの出力先 (アプリの kratos.token_jwks_url)")
+	kid := flag.String("kid", "app-tokenizer-1", "鍵のID")
+	force := flag.Bool("force", false, "既にファイルが存在する場合も上書きする")
+	flag.Parse()
+
+	if err := generate(*privatePath, *publicPath, *kid, *force); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Printf("generated %s, %s\n", *privatePath, *publicPath)
+}
+
+func generate(privatePath string, publicPath string, kid string, force bool) error {
+	if !force {
+		for _, path := range []string{privatePath, publicPath} {
+			if _, err := os.Stat(path); err == nil {
+				return fmt.Errorf("%s already exists (use -force to overwrite)", path)
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	privateKey, err := key.ECDH()
+	if err != nil {
+		return err
+	}
+	// 非圧縮形式 (0x04 || X || Y)
+	point := privateKey.PublicKey().Bytes()
+	size := (len(point) - 1) / 2
+
+	public := jwk{
+		Kty: "EC",
+		Kid: kid,
+		Use: "sig",
+		Alg: "ES256",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(point[1 : 1+size]),
+		Y:   base64.RawURLEncoding.EncodeToString(point[1+size:]),
+	}
+	private := public
+	private.D = base64.RawURLEncoding.EncodeToString(privateKey.Bytes())
+
+	if err := writeJWKS(privatePath, jwks{Keys: []jwk{private}}); err != nil {
+		return err
+	}
+	return writeJWKS(publicPath, jwks{Keys: []jwk{public}})
+}
+
+// Kratos のコンテナ(root 以外のユーザで実行)からバインドマウントで読み込めるよう、読み取り権限を付与する
+func writeJWKS(path string, set jwks) error {
+	b, err := json.MarshalIndent(set, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0o644)
+}
@@ -0,0 +1,356 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// アプリの設定
+//
+// 以下の順に読み込み、後から読み込んだ値で上書きする
+//  1. デフォルト値 (Default)
+//  2. 設定ファイル (YAML もしくは TOML。拡張子 .yaml, .yml, .toml で判定する)
+//  3. 環境変数 (APP_ + 設定ファイルのキーのパスを "_" で連結し大文字にしたもの。例: kratos.public_endpoint -> APP_KRATOS_PUBLIC_ENDPOINT)
+//
+// 設定ファイルは --config フラグ、環境変数 APP_CONFIG_FILE、カレントディレクトリの config.yaml の順に探す
+// (--config, APP_CONFIG_FILE で指定したファイルが存在しない場合はエラーとする)
+// 設定ファイル内のファイルのパス(相対パス)は、設定ファイルのディレクトリを基準とする (環境変数で指定した場合はカレントディレクトリを基準とする)
+// 環境変数のリストは "," 区切りで指定する。構造体のリスト(rate_limit.rules)は環境変数では上書きできない
+
+const (
+	ENV_PREFIX      = "APP_"
+	ENV_CONFIG_FILE = "APP_CONFIG_FILE"
+	// 設定ファイルを指定しない場合に読み込むファイル (存在しない場合はデフォルト値と環境変数のみを使用する)
+	DEFAULT_CONFIG_FILE = "config.yaml"
+)
+
+type Config struct {
+	Server          ServerConfig          `yaml:"server" toml:"server"`
+	Log             LogConfig             `yaml:"log" toml:"log"`
+	Kratos          KratosConfig          `yaml:"kratos" toml:"kratos"`
+	Cookie          CookieConfig          `yaml:"cookie" toml:"cookie"`
+	Handler         HandlerConfig         `yaml:"handler" toml:"handler"`
+	SecurityHeaders SecurityHeadersConfig `yaml:"security_headers" toml:"security_headers"`
+	RateLimit       RateLimitConfig       `yaml:"rate_limit" toml:"rate_limit"`
+	Store           StoreConfig           `yaml:"store" toml:"store"`
+	Telemetry       TelemetryConfig       `yaml:"telemetry" toml:"telemetry"`
+	Health          HealthConfig          `yaml:"health" toml:"health"`
+	Webhook         WebhookConfig         `yaml:"webhook" toml:"webhook"`
+}
+
+type ServerConfig struct {
+	// 待ち受けるアドレス (":3000" 等)
+	Addr              string        `yaml:"addr" toml:"addr"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout" toml:"read_header_timeout"`
+	ReadTimeout       time.Duration `yaml:"read_timeout" toml:"read_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout" toml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout" toml:"idle_timeout"`
+	// SIGTERM を受信してから、ヘルスチェックを失敗させた状態でリクエストを受け付け続ける時間
+	// (ロードバランサが振り分け先から外すまでの時間。0 の場合は待たない)
+	DrainDelay time.Duration `yaml:"drain_delay" toml:"drain_delay"`
+	// 処理中のリクエストの完了を待つ最大の時間
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+	TLS             TLSConfig     `yaml:"tls" toml:"tls"`
+	// TLS を使用しない場合に h2c (平文の HTTP/2) を有効にする
+	H2C bool `yaml:"h2c" toml:"h2c"`
+}
+
+type TLSConfig struct {
+	// 空の場合は TLS を使用しない
+	CertFile string `yaml:"cert_file" toml:"cert_file"`
+	KeyFile  string `yaml:"key_file" toml:"key_file"`
+	// 証明書ファイルの更新を確認する間隔 (0 の場合は起動時のみ読み込む)
+	ReloadInterval time.Duration `yaml:"reload_interval" toml:"reload_interval"`
+}
+
+type LogConfig struct {
+	// debug, info, warn, error
+	Level string `yaml:"level" toml:"level"`
+	// text, json
+	Format string `yaml:"format" toml:"format"`
+	// ログにソースコードの位置を出力する
+	AddSource bool `yaml:"add_source" toml:"add_source"`
+}
+
+type KratosConfig struct {
+	PublicEndpoint string `yaml:"public_endpoint" toml:"public_endpoint"`
+	AdminEndpoint  string `yaml:"admin_endpoint" toml:"admin_endpoint"`
+	// 再ログインせずに、プロフィール変更等の操作を行える期間(分) (kratos の privileged_session_max_age と同じ値を設定)
+	PrivilegedAccessLimitMinutes int `yaml:"privileged_access_limit_minutes" toml:"privileged_access_limit_minutes"`
+	// Whoami の結果をキャッシュする期間 (0 の場合はキャッシュしない)
+	WhoamiCacheTTL time.Duration `yaml:"whoami_cache_ttl" toml:"whoami_cache_ttl"`
+	// セッションをJWTとして取得する場合の tokenizer のテンプレート名 (空の場合はトークン化しない)
+	TokenizeTemplate string `yaml:"tokenize_template" toml:"tokenize_template"`
+	// トークン化したセッションを検証する公開鍵のJWKS (http(s):// もしくはファイルのパス)
+	// 開発環境の鍵は go run ./cmd/tokenizer-jwks で生成する
+	TokenJWKSURL string `yaml:"token_jwks_url" toml:"token_jwks_url"`
+}
+
+type CookieConfig struct {
+	// Kratos のセッションCookie名 (kratos の session.cookie.name と同じ値を設定)
+	SessionCookieName string `yaml:"session_cookie_name" toml:"session_cookie_name"`
+	Path              string `yaml:"path" toml:"path"`
+	// 空の場合はホストのみを対象とする
+	Domain string `yaml:"domain" toml:"domain"`
+	// HTTPS で運用する場合は true とする
+	Secure bool `yaml:"secure" toml:"secure"`
+}
+
+type HandlerConfig struct {
+	BirthdateFormat string `yaml:"birthdate_format" toml:"birthdate_format"`
+	// return_to として許可するURL (kratos の selfservice.allowed_return_urls と同じ値を設定)
+	AllowedReturnURLs []string `yaml:"allowed_return_urls" toml:"allowed_return_urls"`
+	// ログインフックの暗号化に使用する secret (32文字以上。ローテーション時は新しい secret を先頭に追加する)
+	AfterLoginHookSecrets []string `yaml:"after_login_hook_secrets" toml:"after_login_hook_secrets"`
+	// 信頼できるリバースプロキシ (IPアドレスもしくはCIDR)
+	TrustedProxies []string `yaml:"trusted_proxies" toml:"trusted_proxies"`
+	// 開発時に、テンプレート、静的ファイルを読み込むディレクトリ (空の場合はバイナリに埋め込んだファイルを使用する)
+	DevAssetsDir string `yaml:"dev_assets_dir" toml:"dev_assets_dir"`
+}
+
+type SecurityHeadersConfig struct {
+	// Content-Security-Policy のディレクティブ ("; " で連結して送信する。"{nonce}" はリクエストごとの nonce に置換する)
+	ContentSecurityPolicy []string      `yaml:"content_security_policy" toml:"content_security_policy"`
+	CSPReportOnly         bool          `yaml:"csp_report_only" toml:"csp_report_only"`
+	CSPReport             bool          `yaml:"csp_report" toml:"csp_report"`
+	HSTSMaxAge            time.Duration `yaml:"hsts_max_age" toml:"hsts_max_age"`
+	FrameOptions          string        `yaml:"frame_options" toml:"frame_options"`
+	ReferrerPolicy        string        `yaml:"referrer_policy" toml:"referrer_policy"`
+	PermissionsPolicy     string        `yaml:"permissions_policy" toml:"permissions_policy"`
+}
+
+type RateLimitConfig struct {
+	Rules []RateLimitRuleConfig `yaml:"rules" toml:"rules"`
+}
+
+type RateLimitRuleConfig struct {
+	Method          string     `yaml:"method" toml:"method"`
+	Path            string     `yaml:"path" toml:"path"`
+	PerIP           RuleConfig `yaml:"per_ip" toml:"per_ip"`
+	IdentifierField string     `yaml:"identifier_field" toml:"identifier_field"`
+	PerIdentifier   RuleConfig `yaml:"per_identifier" toml:"per_identifier"`
+}
+
+type RuleConfig struct {
+	Limit    int           `yaml:"limit" toml:"limit"`
+	Interval time.Duration `yaml:"interval" toml:"interval"`
+	Burst    int           `yaml:"burst" toml:"burst"`
+}
+
+type StoreConfig struct {
+	// memory, file, redis (複数プロセスで運用する場合は redis を使用する)
+	Type    string      `yaml:"type" toml:"type"`
+	FileDir string      `yaml:"file_dir" toml:"file_dir"`
+	Redis   RedisConfig `yaml:"redis" toml:"redis"`
+}
+
+type RedisConfig struct {
+	Addr         string `yaml:"addr" toml:"addr"`
+	Username     string `yaml:"username" toml:"username"`
+	Password     string `yaml:"password" toml:"password"`
+	DB           int    `yaml:"db" toml:"db"`
+	KeyPrefix    string `yaml:"key_prefix" toml:"key_prefix"`
+	MaxIdleConns int    `yaml:"max_idle_conns" toml:"max_idle_conns"`
+}
+
+type TelemetryConfig struct {
+	ServiceName string `yaml:"service_name" toml:"service_name"`
+	// none, stdout, otlp
+	Exporter     string  `yaml:"exporter" toml:"exporter"`
+	OTLPEndpoint string  `yaml:"otlp_endpoint" toml:"otlp_endpoint"`
+	OTLPInsecure bool    `yaml:"otlp_insecure" toml:"otlp_insecure"`
+	SampleRatio  float64 `yaml:"sample_ratio" toml:"sample_ratio"`
+}
+
+type HealthConfig struct {
+	// /readyz の結果をキャッシュする期間
+	CacheTTL time.Duration `yaml:"cache_ttl" toml:"cache_ttl"`
+	// 依存先ごとの確認のタイムアウト
+	Timeout time.Duration `yaml:"timeout" toml:"timeout"`
+}
+
+type WebhookConfig struct {
+	// API キーを送信するヘッダ (kratos の web_hook の auth.config.name と同じ値を設定)
+	APIKeyHeader string `yaml:"api_key_header" toml:"api_key_header"`
+	// kratos の web_hook の auth.config.value と同じ値を設定 (32文字以上。ローテーション時は新旧の API キーを併記する)
+	// 空の場合は、web_hook を受信しない
+	APIKeys []string `yaml:"api_keys" toml:"api_keys"`
+}
+
+// デフォルト値
+// 環境ごとに異なる値(secret、Cookie の Domain 等)は、設定ファイルもしくは環境変数で指定する
+func Default() Config {
+	return Config{
+		Server: ServerConfig{
+			Addr:              ":3000",
+			ReadHeaderTimeout: 5 * time.Second,
+			ReadTimeout:       15 * time.Second,
+			WriteTimeout:      30 * time.Second,
+			IdleTimeout:       60 * time.Second,
+			DrainDelay:        5 * time.Second,
+			ShutdownTimeout:   30 * time.Second,
+			TLS: TLSConfig{
+				ReloadInterval: time.Minute,
+			},
+		},
+		Log: LogConfig{
+			Level:     "info",
+			Format:    "text",
+			AddSource: false,
+		},
+		Kratos: KratosConfig{
+			PublicEndpoint:               "http://kratos:4433",
+			AdminEndpoint:                "http://kratos:4434",
+			PrivilegedAccessLimitMinutes: 10,
+			WhoamiCacheTTL:               5 * time.Second,
+		},
+		Cookie: CookieConfig{
+			SessionCookieName: "kratos_session",
+			Path:              "/",
+			Secure:            true,
+		},
+		Handler: HandlerConfig{
+			BirthdateFormat: "2006-01-02",
+		},
+		SecurityHeaders: SecurityHeadersConfig{
+			FrameOptions:      "DENY",
+			ReferrerPolicy:    "strict-origin-when-cross-origin",
+			PermissionsPolicy: "camera=(), microphone=(), geolocation=(), payment=()",
+		},
+		Store: StoreConfig{
+			Type: "memory",
+		},
+		Telemetry: TelemetryConfig{
+			ServiceName: "kratos_example",
+			Exporter:    "none",
+			SampleRatio: 1,
+		},
+		Health: HealthConfig{
+			CacheTTL: 5 * time.Second,
+			Timeout:  2 * time.Second,
+		},
+		Webhook: WebhookConfig{
+			APIKeyHeader: "X-Webhook-Api-Key",
+		},
+	}
+}
+
+type LoadInput struct {
+	// 設定ファイルのパス (空の場合は APP_CONFIG_FILE、config.yaml の順に探す)
+	Path string
+	// 環境変数を取得する関数 (nil の場合は os.LookupEnv)
+	LookupEnv func(string) (string, bool)
+}
+
+type LoadOutput struct {
+	Config Config
+	// 読み込んだ設定ファイル (読み込んでいない場合は空文字)
+	Path string
+}
+
+// 設定を読み込み、検証する
+func Load(i LoadInput) (LoadOutput, error) {
+	var output LoadOutput
+	lookupEnv := i.LookupEnv
+	if lookupEnv == nil {
+		lookupEnv = os.LookupEnv
+	}
+
+	cfg := Default()
+
+	path, required := i.Path, true
+	if path == "" {
+		path, required = lookupEnv(ENV_CONFIG_FILE)
+	}
+	if path == "" {
+		path, required = DEFAULT_CONFIG_FILE, false
+	}
+	loaded, err := loadFile(path, required, &cfg)
+	if err != nil {
+		return output, err
+	}
+	if loaded {
+		output.Path = path
+		resolvePaths(&cfg, filepath.Dir(path))
+	}
+
+	if err := applyEnv(&cfg, ENV_PREFIX, lookupEnv); err != nil {
+		return output, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return output, err
+	}
+	output.Config = cfg
+	return output, nil
+}
+
+// 設定ファイルを読み込む
+// required が false の場合は、ファイルが存在しなくてもエラーとしない
+func loadFile(path string, required bool, cfg *Config) (bool, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !required {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("config: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		// 誤記に気付けるよう、未定義のキーはエラーとする
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return false, fmt.Errorf("config: %s: %w", path, err)
+		}
+	case ".toml":
+		md, err := toml.Decode(string(b), cfg)
+		if err != nil {
+			return false, fmt.Errorf("config: %s: %w", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return false, fmt.Errorf("config: %s: unknown keys: %v", path, undecoded)
+		}
+	default:
+		return false, fmt.Errorf("config: %s: unsupported file extension (.yaml, .yml, .toml)", path)
+	}
+	return true, nil
+}
+
+// 設定ファイルで指定したファイルのパスを、設定ファイルのディレクトリを基準としたパスにする
+// (実行時のカレントディレクトリによらず、同じファイルを読み込むようにする)
+func resolvePaths(cfg *Config, dir string) {
+	for _, path := range []*string{
+		&cfg.Server.TLS.CertFile,
+		&cfg.Server.TLS.KeyFile,
+		&cfg.Handler.DevAssetsDir,
+		&cfg.Store.FileDir,
+	} {
+		*path = resolvePath(*path, dir)
+	}
+	// JWKS は http(s):// の場合はそのまま使用し、file:// の場合はパスの部分を変換する
+	jwksURL := cfg.Kratos.TokenJWKSURL
+	if !strings.HasPrefix(jwksURL, "http://") && !strings.HasPrefix(jwksURL, "https://") {
+		if after, ok := strings.CutPrefix(jwksURL, "file://"); ok {
+			cfg.Kratos.TokenJWKSURL = "file://" + resolvePath(after, dir)
+		} else {
+			cfg.Kratos.TokenJWKSURL = resolvePath(jwksURL, dir)
+		}
+	}
+}
+
+func resolvePath(path string, dir string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
@@ -0,0 +1,185 @@
+package config
+
+import (
+	"io"
+	"kratos_example/handler"
+	"kratos_example/kratos"
+	"kratos_example/logging"
+	"kratos_example/ratelimit"
+	"kratos_example/server"
+	"kratos_example/store"
+	"kratos_example/telemetry"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// 各パッケージの初期化の入力へ変換する
+// Validate で検証済みの設定であることを前提とする
+
+func (c *Config) ServerNewInput(h http.Handler) server.NewInput {
+	return server.NewInput{
+		Addr:              c.Server.Addr,
+		Handler:           h,
+		ReadHeaderTimeout: c.Server.ReadHeaderTimeout,
+		ReadTimeout:       c.Server.ReadTimeout,
+		WriteTimeout:      c.Server.WriteTimeout,
+		IdleTimeout:       c.Server.IdleTimeout,
+		TLS: server.TLSInput{
+			CertFile:       c.Server.TLS.CertFile,
+			KeyFile:        c.Server.TLS.KeyFile,
+			ReloadInterval: c.Server.TLS.ReloadInterval,
+		},
+		H2C: c.Server.H2C,
+	}
+}
+
+func (c *Config) KratosProviderConfig() kratos.Config {
+	return kratos.Config{
+		KratosPublicEndpoint: c.Kratos.PublicEndpoint,
+		KratosAdminEndpoint:  c.Kratos.AdminEndpoint,
+		BirthdateFormat:      c.Handler.BirthdateFormat,
+		SessionCookieName:    c.Cookie.SessionCookieName,
+		WhoamiCacheTTL:       c.Kratos.WhoamiCacheTTL,
+		TokenizeTemplate:     c.Kratos.TokenizeTemplate,
+		TokenJWKSURL:         c.Kratos.TokenJWKSURL,
+	}
+}
+
+func (c *Config) HandlerProviderConfig() handler.Config {
+	rules := make([]handler.RateLimitRule, 0, len(c.RateLimit.Rules))
+	for _, rule := range c.RateLimit.Rules {
+		rules = append(rules, handler.RateLimitRule{
+			Method:          rule.Method,
+			Path:            rule.Path,
+			PerIP:           rule.PerIP.rule(),
+			IdentifierField: rule.IdentifierField,
+			PerIdentifier:   rule.PerIdentifier.rule(),
+		})
+	}
+
+	return handler.Config{
+		CookieParams: handler.CookieParams{
+			SessionCookieName: c.Cookie.SessionCookieName,
+			Path:              c.Cookie.Path,
+			Domain:            c.Cookie.Domain,
+			Secure:            c.Cookie.Secure,
+		},
+		BirthdateFormat:       c.Handler.BirthdateFormat,
+		PrivilegedAccessLimit: time.Duration(c.Kratos.PrivilegedAccessLimitMinutes) * time.Minute,
+		AllowedReturnURLs:     c.Handler.AllowedReturnURLs,
+		AfterLoginHookSecrets: c.Handler.AfterLoginHookSecrets,
+		SecurityHeaders: handler.SecurityHeadersParams{
+			ContentSecurityPolicy: strings.Join(c.SecurityHeaders.ContentSecurityPolicy, "; "),
+			CSPReportOnly:         c.SecurityHeaders.CSPReportOnly,
+			CSPReport:             c.SecurityHeaders.CSPReport,
+			HSTSMaxAge:            c.SecurityHeaders.HSTSMaxAge,
+			FrameOptions:          c.SecurityHeaders.FrameOptions,
+			ReferrerPolicy:        c.SecurityHeaders.ReferrerPolicy,
+			PermissionsPolicy:     c.SecurityHeaders.PermissionsPolicy,
+		},
+		RateLimitRules: rules,
+		TrustedProxies: c.Handler.TrustedProxies,
+		HealthCheck: handler.HealthCheckParams{
+			CacheTTL: c.Health.CacheTTL,
+			Timeout:  c.Health.Timeout,
+		},
+		Webhook: handler.WebhookParams{
+			APIKeyHeader: c.Webhook.APIKeyHeader,
+			APIKeys:      c.Webhook.APIKeys,
+		},
+		DevAssetsDir: c.Handler.DevAssetsDir,
+	}
+}
+
+func (r RuleConfig) rule() ratelimit.Rule {
+	return ratelimit.Rule{
+		Limit:    r.Limit,
+		Interval: r.Interval,
+		Burst:    r.Burst,
+	}
+}
+
+func (c *Config) StoreNewInput() store.NewInput {
+	i := store.NewInput{
+		FileDir: c.Store.FileDir,
+		Redis: store.RedisInput{
+			Addr:         c.Store.Redis.Addr,
+			Username:     c.Store.Redis.Username,
+			Password:     c.Store.Redis.Password,
+			DB:           c.Store.Redis.DB,
+			KeyPrefix:    c.Store.Redis.KeyPrefix,
+			MaxIdleConns: c.Store.Redis.MaxIdleConns,
+		},
+	}
+	switch c.Store.Type {
+	case "file":
+		i.Type = store.STORE_TYPE_FILE
+	case "redis":
+		i.Type = store.STORE_TYPE_REDIS
+	default:
+		i.Type = store.STORE_TYPE_MEMORY
+	}
+	return i
+}
+
+func (c *Config) TelemetryInitInput(serviceVersion string) telemetry.InitInput {
+	i := telemetry.InitInput{
+		ServiceName:    c.Telemetry.ServiceName,
+		ServiceVersion: serviceVersion,
+		OTLPEndpoint:   c.Telemetry.OTLPEndpoint,
+		OTLPInsecure:   c.Telemetry.OTLPInsecure,
+		SampleRatio:    c.Telemetry.SampleRatio,
+	}
+	switch c.Telemetry.Exporter {
+	case "stdout":
+		i.Exporter = telemetry.EXPORTER_TYPE_STDOUT
+	case "otlp":
+		i.Exporter = telemetry.EXPORTER_TYPE_OTLP
+	default:
+		i.Exporter = telemetry.EXPORTER_TYPE_NONE
+	}
+	return i
+}
+
+// slog のハンドラを生成する
+// リクエストIDの付与、機密情報を伏せるため、logging.Handler でラップする
+func (c *Config) LogHandler(w io.Writer) slog.Handler {
+	var level slog.Level
+	_ = level.UnmarshalText([]byte(c.Log.Level))
+	opts := &slog.HandlerOptions{
+		AddSource: c.Log.AddSource,
+		Level:     level,
+	}
+	if c.Log.Format == "json" {
+		return logging.NewHandler(slog.NewJSONHandler(w, opts))
+	}
+	return logging.NewHandler(slog.NewTextHandler(w, opts))
+}
+
+// 設定を YAML で出力する (--print-config)
+// secret、パスワードは伏せて出力する
+func (c *Config) Print(w io.Writer) error {
+	masked := *c
+	masked.Handler.AfterLoginHookSecrets = make([]string, len(c.Handler.AfterLoginHookSecrets))
+	for i := range masked.Handler.AfterLoginHookSecrets {
+		masked.Handler.AfterLoginHookSecrets[i] = logging.REDACTED
+	}
+	masked.Webhook.APIKeys = make([]string, len(c.Webhook.APIKeys))
+	for i := range masked.Webhook.APIKeys {
+		masked.Webhook.APIKeys[i] = logging.REDACTED
+	}
+	if masked.Store.Redis.Password != "" {
+		masked.Store.Redis.Password = logging.REDACTED
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(masked); err != nil {
+		return err
+	}
+	return enc.Close()
+}
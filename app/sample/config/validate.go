@@ -0,0 +1,197 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// after_login_hook_secrets、webhook.api_keys の最小の長さ
+const minSecretLength = 32
+
+// 設定を検証する
+// 全ての誤りを確認できるよう、最初の誤りで終了せずにまとめて返却する
+func (c *Config) Validate() error {
+	var errs []error
+	add := func(key string, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+	}
+
+	if c.Server.Addr == "" {
+		add("server.addr", "required")
+	}
+	for _, d := range []struct {
+		key   string
+		value time.Duration
+	}{
+		{"server.read_header_timeout", c.Server.ReadHeaderTimeout},
+		{"server.read_timeout", c.Server.ReadTimeout},
+		{"server.write_timeout", c.Server.WriteTimeout},
+		{"server.idle_timeout", c.Server.IdleTimeout},
+		{"server.drain_delay", c.Server.DrainDelay},
+		{"server.shutdown_timeout", c.Server.ShutdownTimeout},
+		{"server.tls.reload_interval", c.Server.TLS.ReloadInterval},
+	} {
+		if d.value < 0 {
+			add(d.key, "must not be negative")
+		}
+	}
+	if (c.Server.TLS.CertFile == "") != (c.Server.TLS.KeyFile == "") {
+		add("server.tls", "cert_file and key_file must be set together")
+	}
+	if c.Server.H2C && c.Server.TLS.CertFile != "" {
+		add("server.h2c", "cannot be used with tls (HTTP/2 is enabled automatically over TLS)")
+	}
+
+	if !oneOf(c.Log.Level, "debug", "info", "warn", "error") {
+		add("log.level", "must be one of debug, info, warn, error: %q", c.Log.Level)
+	}
+	if !oneOf(c.Log.Format, "text", "json") {
+		add("log.format", "must be one of text, json: %q", c.Log.Format)
+	}
+
+	if !validHTTPURL(c.Kratos.PublicEndpoint) {
+		add("kratos.public_endpoint", "must be an absolute http(s) URL: %q", c.Kratos.PublicEndpoint)
+	}
+	if !validHTTPURL(c.Kratos.AdminEndpoint) {
+		add("kratos.admin_endpoint", "must be an absolute http(s) URL: %q", c.Kratos.AdminEndpoint)
+	}
+	if c.Kratos.PrivilegedAccessLimitMinutes <= 0 {
+		add("kratos.privileged_access_limit_minutes", "must be greater than 0")
+	}
+	if c.Kratos.WhoamiCacheTTL < 0 {
+		add("kratos.whoami_cache_ttl", "must not be negative")
+	}
+	if c.Kratos.TokenizeTemplate != "" && c.Kratos.TokenJWKSURL == "" {
+		add("kratos.token_jwks_url", "required when kratos.tokenize_template is set")
+	}
+
+	if c.Cookie.SessionCookieName == "" {
+		add("cookie.session_cookie_name", "required")
+	}
+	if !strings.HasPrefix(c.Cookie.Path, "/") {
+		add("cookie.path", "must start with /: %q", c.Cookie.Path)
+	}
+
+	if c.Handler.BirthdateFormat == "" {
+		add("handler.birthdate_format", "required")
+	}
+	if len(c.Handler.AllowedReturnURLs) == 0 {
+		add("handler.allowed_return_urls", "required")
+	}
+	for _, u := range c.Handler.AllowedReturnURLs {
+		if !validHTTPURL(u) {
+			add("handler.allowed_return_urls", "must be an absolute http(s) URL: %q", u)
+		}
+	}
+	if len(c.Handler.AfterLoginHookSecrets) == 0 {
+		add("handler.after_login_hook_secrets", "required")
+	}
+	for i, secret := range c.Handler.AfterLoginHookSecrets {
+		if len(secret) < minSecretLength {
+			add(fmt.Sprintf("handler.after_login_hook_secrets[%d]", i), "must be at least %d characters", minSecretLength)
+		}
+	}
+	for _, proxy := range c.Handler.TrustedProxies {
+		if !validAddrOrPrefix(proxy) {
+			add("handler.trusted_proxies", "must be an IP address or CIDR: %q", proxy)
+		}
+	}
+	if c.Handler.DevAssetsDir != "" {
+		if info, err := os.Stat(c.Handler.DevAssetsDir); err != nil || !info.IsDir() {
+			add("handler.dev_assets_dir", "must be a directory: %q", c.Handler.DevAssetsDir)
+		}
+	}
+
+	if c.SecurityHeaders.HSTSMaxAge < 0 {
+		add("security_headers.hsts_max_age", "must not be negative")
+	}
+	if c.SecurityHeaders.HSTSMaxAge > 0 && !c.Cookie.Secure {
+		add("security_headers.hsts_max_age", "requires cookie.secure (HSTS is only sent over HTTPS)")
+	}
+
+	for i, rule := range c.RateLimit.Rules {
+		key := fmt.Sprintf("rate_limit.rules[%d]", i)
+		if rule.Method == "" || !strings.HasPrefix(rule.Path, "/") {
+			add(key, "method and path are required")
+		}
+		if rule.PerIP.Limit <= 0 || rule.PerIP.Interval <= 0 {
+			add(key+".per_ip", "limit and interval must be greater than 0")
+		}
+		if rule.IdentifierField != "" && (rule.PerIdentifier.Limit <= 0 || rule.PerIdentifier.Interval <= 0) {
+			add(key+".per_identifier", "limit and interval must be greater than 0 when identifier_field is set")
+		}
+	}
+
+	switch c.Store.Type {
+	case "memory":
+	case "file":
+		if c.Store.FileDir == "" {
+			add("store.file_dir", "required when store.type is file")
+		}
+	case "redis":
+		if c.Store.Redis.Addr == "" {
+			add("store.redis.addr", "required when store.type is redis")
+		}
+	default:
+		add("store.type", "must be one of memory, file, redis: %q", c.Store.Type)
+	}
+
+	if !oneOf(c.Telemetry.Exporter, "none", "stdout", "otlp") {
+		add("telemetry.exporter", "must be one of none, stdout, otlp: %q", c.Telemetry.Exporter)
+	}
+	if c.Telemetry.SampleRatio < 0 || c.Telemetry.SampleRatio > 1 {
+		add("telemetry.sample_ratio", "must be between 0 and 1")
+	}
+
+	if c.Health.CacheTTL < 0 {
+		add("health.cache_ttl", "must not be negative")
+	}
+	if c.Health.Timeout <= 0 {
+		add("health.timeout", "must be greater than 0")
+	}
+
+	if len(c.Webhook.APIKeys) > 0 && c.Webhook.APIKeyHeader == "" {
+		add("webhook.api_key_header", "required when webhook.api_keys is set")
+	}
+	for i, key := range c.Webhook.APIKeys {
+		if len(key) < minSecretLength {
+			add(fmt.Sprintf("webhook.api_keys[%d]", i), "must be at least %d characters", minSecretLength)
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("config: invalid configuration:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+func oneOf(s string, values ...string) bool {
+	for _, v := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+func validHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func validAddrOrPrefix(s string) bool {
+	if strings.Contains(s, "/") {
+		_, err := netip.ParsePrefix(s)
+		return err == nil
+	}
+	_, err := netip.ParseAddr(s)
+	return err == nil
+}
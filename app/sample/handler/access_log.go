@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+)
+
+// アクセスログ
+//
+// ステータスコード、レスポンスサイズは ResponseWriter をラップして記録する
+// ユーザ(identity)の ID は setSession で判明するため、loggingRquest で作成したエントリへ後から設定する
+
+type accessLogEntryContextKey struct{}
+
+type accessLogEntry struct {
+	identityID string
+}
+
+func contextWithAccessLogEntry(ctx context.Context) (context.Context, *accessLogEntry) {
+	entry := &accessLogEntry{}
+	return context.WithValue(ctx, accessLogEntryContextKey{}, entry), entry
+}
+
+// アクセスログに出力するユーザ(identity)の ID を設定する
+func setAccessLogIdentityID(ctx context.Context, identityID string) {
+	if entry, ok := ctx.Value(accessLogEntryContextKey{}).(*accessLogEntry); ok {
+		entry.identityID = identityID
+	}
+}
+
+// 引き継ぐリクエストIDの形式 (ログへの不正な文字列の混入を防ぐ)
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9\-_.:]{1,128}$`)
+
+func validRequestID(requestID string) bool {
+	return requestIDPattern.MatchString(requestID)
+}
+
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (rec *responseRecorder) WriteHeader(statusCode int) {
+	if rec.status == 0 {
+		rec.status = statusCode
+	}
+	rec.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+// http.ResponseController から Flush 等を使用できるようにする
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+func (rec *responseRecorder) statusCode() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+	return rec.status
+}
@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"kratos_example/kratos"
+	"kratos_example/store"
+	"time"
+)
+
+// アプリ側のプロフィール
+//
+// Kratos の Identity に対応する、アプリ独自の情報(作成日時、最終ログイン日時等)
+// Kratos の web_hook により、会員登録時に作成し、プロフィールの更新、メールアドレスの検証、ログイン時に更新する
+// サンプルのため、ストアに保存する (実際のアプリではデータベースに保存する)
+//
+// web_hook は同じイベントが複数回送信される場合があるため、既に反映済みの場合も同じ結果となるよう更新する
+
+// ストアに保存する期間 (更新のたびに延長する)
+const appProfileTTL = 365 * 24 * time.Hour
+
+type appProfile struct {
+	IdentityID string    `json:"identity_id"`
+	Email      string    `json:"email"`
+	Nickname   string    `json:"nickname"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+	// メールアドレスを検証した日時 (未検証の場合はゼロ値)
+	VerifiedAt  time.Time `json:"verified_at"`
+	LastLoginAt time.Time `json:"last_login_at"`
+	// 最後にログインしたセッション (同じログインの web_hook を重複して処理しないために使用する)
+	LastSessionID string `json:"last_session_id"`
+}
+
+func appProfileStoreKey(identityID string) string {
+	return "app_profile:" + identityID
+}
+
+// webhookHandler after_registration
+// プロフィールを作成する (作成済みの場合は Identity の内容のみ反映する)
+func (p *Provider) provisionAppProfile(ctx context.Context, payload webhookPayload) error {
+	return p.updateAppProfile(ctx, payload.Identity, func(profile *appProfile, now time.Time) {})
+}
+
+// webhookHandler after_settings
+// プロフィールの更新(メールアドレス、ニックネームの変更)を反映する
+func (p *Provider) syncAppProfile(ctx context.Context, payload webhookPayload) error {
+	return p.updateAppProfile(ctx, payload.Identity, func(profile *appProfile, now time.Time) {
+		profile.UpdatedAt = now
+	})
+}
+
+// webhookHandler after_verification
+func (p *Provider) markAppProfileVerified(ctx context.Context, payload webhookPayload) error {
+	return p.updateAppProfile(ctx, payload.Identity, func(profile *appProfile, now time.Time) {
+		if profile.VerifiedAt.IsZero() {
+			profile.VerifiedAt = now
+		}
+	})
+}
+
+// webhookHandler after_login
+func (p *Provider) recordAppProfileLogin(ctx context.Context, payload webhookPayload) error {
+	return p.updateAppProfile(ctx, payload.Identity, func(profile *appProfile, now time.Time) {
+		if payload.SessionID != "" && payload.SessionID == profile.LastSessionID {
+			return
+		}
+		profile.LastLoginAt = now
+		profile.LastSessionID = payload.SessionID
+	})
+}
+
+// プロフィールを取得し、Identity の内容と update による変更を反映して保存する
+// プロフィールが存在しない場合(会員登録の web_hook を受信できなかった場合等)は作成する
+func (p *Provider) updateAppProfile(ctx context.Context, identity kratos.Identity, update func(profile *appProfile, now time.Time)) error {
+	// 同じ Identity の web_hook を同時に受信した場合に、更新が失われないようにする
+	// (複数プロセスで運用する場合は、データベースのトランザクション等で排他制御する)
+	p.appProfileMu.Lock()
+	defer p.appProfileMu.Unlock()
+
+	now := time.Now()
+	profile, err := p.loadAppProfile(ctx, identity.ID)
+	if err != nil {
+		return err
+	}
+	if profile.IdentityID == "" {
+		profile = appProfile{
+			IdentityID: identity.ID,
+			CreatedAt:  now,
+			UpdatedAt:  now,
+		}
+	}
+	profile.Email = identity.Traits.Email
+	profile.Nickname = identity.Traits.Nickname
+	update(&profile, now)
+
+	b, err := json.Marshal(profile)
+	if err != nil {
+		return err
+	}
+	return p.d.Store.Set(ctx, appProfileStoreKey(identity.ID), b, appProfileTTL)
+}
+
+// プロフィールを取得する
+// 存在しない場合はゼロ値を返却する
+func (p *Provider) loadAppProfile(ctx context.Context, identityID string) (appProfile, error) {
+	b, err := p.d.Store.Get(ctx, appProfileStoreKey(identityID))
+	if errors.Is(err, store.ErrNotFound) {
+		return appProfile{}, nil
+	}
+	if err != nil {
+		return appProfile{}, err
+	}
+	var profile appProfile
+	if err := json.Unmarshal(b, &profile); err != nil {
+		return appProfile{}, err
+	}
+	return profile, nil
+}
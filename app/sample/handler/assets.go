@@ -0,0 +1,250 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"html/template"
+	"io"
+	"io/fs"
+	"kratos_example/web"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// テンプレート、静的ファイル
+//
+// 通常はバイナリに埋め込んだファイル(web パッケージ)を使用する
+// Config.DevAssetsDir を指定した場合(開発時)は、ディレクトリのファイルを直接読み込み、
+// テンプレートは変更を検知して再読み込みする (静的ファイルはキャッシュさせない)
+//
+// 静的ファイルのURLは、テンプレートの static 関数によりファイルの内容のハッシュ値を含める (/static/user.0123456789abcdef.png)
+// URL が内容ごとに変わるため、長期間キャッシュさせる
+
+const (
+	STATIC_PATH_PREFIX = "/static/"
+	// ハッシュ値(16進数)の長さ
+	STATIC_FINGERPRINT_LENGTH = 16
+
+	CACHE_CONTROL_IMMUTABLE = "public, max-age=31536000, immutable"
+	CACHE_CONTROL_NO_CACHE  = "no-cache"
+)
+
+var templatePatterns = []string{"*/*.html", "*/*/*.html"}
+
+// テンプレートと静的ファイルを読み込む
+func loadAssets(devAssetsDir string) (*templateSet, *staticAssets, error) {
+	fsys := web.FS()
+	dev := devAssetsDir != ""
+	if dev {
+		fsys = os.DirFS(devAssetsDir)
+	}
+	staticFS, err := fs.Sub(fsys, web.STATIC_DIR)
+	if err != nil {
+		return nil, nil, err
+	}
+	templatesFS, err := fs.Sub(fsys, web.TEMPLATES_DIR)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	static, err := newStaticAssets(staticFS, dev)
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl, err := newTemplateSet(templatesFS, dev, template.FuncMap{
+		"static": static.url,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return tmpl, static, nil
+}
+
+// テンプレート
+// 開発時は、実行のたびにファイルの更新を確認し、変更されている場合は再読み込みする
+type templateSet struct {
+	fsys  fs.FS
+	dev   bool
+	funcs template.FuncMap
+
+	mu         sync.Mutex
+	tmpl       *template.Template
+	modifiedAt time.Time
+	fileCount  int
+}
+
+func newTemplateSet(fsys fs.FS, dev bool, funcs template.FuncMap) (*templateSet, error) {
+	s := templateSet{
+		fsys:  fsys,
+		dev:   dev,
+		funcs: funcs,
+	}
+	if err := s.parse(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (s *templateSet) parse() error {
+	modifiedAt, fileCount, err := s.lastModified()
+	if err != nil {
+		return err
+	}
+	tmpl, err := template.New("").Funcs(s.funcs).ParseFS(s.fsys, templatePatterns...)
+	if err != nil {
+		return err
+	}
+	s.tmpl = tmpl
+	s.modifiedAt = modifiedAt
+	s.fileCount = fileCount
+	return nil
+}
+
+// テンプレートの最終更新日時とファイル数 (追加、削除の検知に使用する)
+func (s *templateSet) lastModified() (time.Time, int, error) {
+	var modifiedAt time.Time
+	var fileCount int
+	err := fs.WalkDir(s.fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		fileCount++
+		if info.ModTime().After(modifiedAt) {
+			modifiedAt = info.ModTime()
+		}
+		return nil
+	})
+	return modifiedAt, fileCount, err
+}
+
+// 現在のテンプレートを返却する
+// 開発時にテンプレートの再読み込みに失敗した場合は、エラーを出力して読み込み済みのテンプレートを使用する
+func (s *templateSet) current() *template.Template {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.dev {
+		modifiedAt, fileCount, err := s.lastModified()
+		if err != nil {
+			slog.Error("failed to check templates", "Error", err)
+		} else if !modifiedAt.Equal(s.modifiedAt) || fileCount != s.fileCount {
+			if err := s.parse(); err != nil {
+				slog.Error("failed to reload templates", "Error", err)
+			} else {
+				slog.Info("templates reloaded")
+			}
+		}
+	}
+	return s.tmpl
+}
+
+func (s *templateSet) ExecuteTemplate(w io.Writer, name string, data any) error {
+	return s.current().ExecuteTemplate(w, name, data)
+}
+
+func (s *templateSet) Lookup(name string) *template.Template {
+	return s.current().Lookup(name)
+}
+
+// 静的ファイル
+type staticAssets struct {
+	fsys fs.FS
+	dev  bool
+	// ファイル名 → ハッシュ値 (埋め込んだファイルのみ、起動時に計算する)
+	fingerprints map[string]string
+	// ハッシュ値を含むファイル名 → ファイル名
+	fingerprinted map[string]string
+}
+
+func newStaticAssets(fsys fs.FS, dev bool) (*staticAssets, error) {
+	a := staticAssets{
+		fsys:          fsys,
+		dev:           dev,
+		fingerprints:  make(map[string]string),
+		fingerprinted: make(map[string]string),
+	}
+	if dev {
+		return &a, nil
+	}
+
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		b, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(b)
+		fingerprint := hex.EncodeToString(sum[:])[:STATIC_FINGERPRINT_LENGTH]
+		a.fingerprints[name] = fingerprint
+		a.fingerprinted[fingerprintedName(name, fingerprint)] = name
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// user.png → user.0123456789abcdef.png
+func fingerprintedName(name string, fingerprint string) string {
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + fingerprint + ext
+}
+
+// テンプレートの static 関数
+// 静的ファイルのURLを返却する (開発時はハッシュ値を含めない)
+func (a *staticAssets) url(name string) string {
+	name = strings.TrimPrefix(name, "/")
+	if fingerprint, ok := a.fingerprints[name]; ok {
+		return STATIC_PATH_PREFIX + fingerprintedName(name, fingerprint)
+	}
+	if !a.dev {
+		slog.Warn("static file not found", "name", name)
+	}
+	return STATIC_PATH_PREFIX + name
+}
+
+// Handler GET /static/
+// ハッシュ値を含むURLは長期間キャッシュさせ、含まないURL(外部から参照されている場合等)はキャッシュの再検証を必須とする
+func (a *staticAssets) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, STATIC_PATH_PREFIX) {
+		http.NotFound(w, r)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, STATIC_PATH_PREFIX)
+	if !fs.ValidPath(name) || name == "." {
+		http.NotFound(w, r)
+		return
+	}
+
+	cacheControl := CACHE_CONTROL_NO_CACHE
+	if original, ok := a.fingerprinted[name]; ok {
+		name = original
+		cacheControl = CACHE_CONTROL_IMMUTABLE
+	}
+
+	// ディレクトリの一覧は返却しない
+	info, err := fs.Stat(a.fsys, name)
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Cache-Control", cacheControl)
+	if fingerprint, ok := a.fingerprints[name]; ok {
+		// 埋め込んだファイルは更新日時を持たないため、ハッシュ値により条件付きリクエストに応答する
+		w.Header().Set("ETag", `"`+fingerprint+`"`)
+	}
+	http.ServeFileFS(w, r, a.fsys, name)
+}
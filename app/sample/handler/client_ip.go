@@ -0,0 +1,146 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// クライアントのIPアドレス
+//
+// ロードバランサ等のリバースプロキシを経由する場合、r.RemoteAddr はプロキシのアドレスとなる
+// 接続元が信頼できるプロキシ(Config.TrustedProxies)の場合のみ、Forwarded / X-Forwarded-For ヘッダから
+// クライアントのIPアドレスを取得する (信頼できない接続元のヘッダは、偽装される可能性があるため使用しない)
+// 取得したIPアドレスは、Kratos への転送、ログ、レート制限で共通して使用する
+
+type clientIPContextKey struct{}
+
+// 信頼できるプロキシのリストを読み込む
+// IPアドレス("10.0.0.1")もしくはCIDR("10.0.0.0/8")で指定する
+func loadTrustedProxies(proxies []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, proxy := range proxies {
+		if strings.Contains(proxy, "/") {
+			prefix, err := netip.ParsePrefix(proxy)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy: %s", proxy)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %s", proxy)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+	return prefixes, nil
+}
+
+func (p *Provider) isTrustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range p.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// クライアントのIPアドレスを保存したコンテキストを返却する
+func (p *Provider) contextWithClientIP(ctx context.Context, r *http.Request) context.Context {
+	return context.WithValue(ctx, clientIPContextKey{}, p.resolveClientIP(r))
+}
+
+// リクエスト元のクライアントのIPアドレス(ポート番号を含まない)を取得
+// loggingRquest を経由していない場合は、ヘッダを信頼せず接続元のアドレスを返却する
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPContextKey{}).(string); ok {
+		return ip
+	}
+	if remote := remoteIP(r.RemoteAddr); remote.IsValid() {
+		return remote.Unmap().String()
+	}
+	return r.RemoteAddr
+}
+
+// 接続元から順に、信頼できるプロキシを経由している間はヘッダを遡り、最初に見つかった信頼できないアドレスをクライアントとする
+// ヘッダの左側(クライアント側)はクライアントが任意に設定できるため、右側(接続元に近い側)から判定する
+func (p *Provider) resolveClientIP(r *http.Request) string {
+	remote := remoteIP(r.RemoteAddr)
+	if !remote.IsValid() {
+		return r.RemoteAddr
+	}
+	if !p.isTrustedProxy(remote) {
+		return remote.String()
+	}
+
+	forwarded := forwardedFor(r.Header)
+	client := remote
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := forwarded[i]
+		if !addr.IsValid() {
+			// 解析できない値(unknown, 難読化された識別子等)以降は信頼できないため、直前のアドレスを使用する
+			break
+		}
+		client = addr
+		if !p.isTrustedProxy(addr) {
+			break
+		}
+	}
+	return client.Unmap().String()
+}
+
+func remoteIP(remoteAddr string) netip.Addr {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr.Unmap()
+}
+
+// Forwarded ヘッダ(RFC 7239)の for パラメータ、ない場合は X-Forwarded-For ヘッダのアドレスを、クライアント側から順に返却する
+// 解析できない値は無効なアドレス(netip.Addr{})とする
+func forwardedFor(header http.Header) []netip.Addr {
+	var addrs []netip.Addr
+	if values := header.Values("Forwarded"); len(values) > 0 {
+		for _, value := range values {
+			for _, element := range strings.Split(value, ",") {
+				for _, pair := range strings.Split(element, ";") {
+					key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+					if !ok || !strings.EqualFold(key, "for") {
+						continue
+					}
+					addrs = append(addrs, parseForwardedAddr(strings.Trim(val, `"`)))
+				}
+			}
+		}
+		return addrs
+	}
+
+	for _, value := range header.Values("X-Forwarded-For") {
+		for _, element := range strings.Split(value, ",") {
+			addrs = append(addrs, parseForwardedAddr(strings.TrimSpace(element)))
+		}
+	}
+	return addrs
+}
+
+// "192.0.2.1", "192.0.2.1:8080", "[2001:db8::1]", "[2001:db8::1]:8080" 形式のアドレスを解析する
+func parseForwardedAddr(value string) netip.Addr {
+	if addrPort, err := netip.ParseAddrPort(value); err == nil {
+		return addrPort.Addr().Unmap()
+	}
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(value, "["), "]"))
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr.Unmap()
+}
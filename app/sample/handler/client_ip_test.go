@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResolveClientIP(t *testing.T) {
+	trustedProxies, err := loadTrustedProxies([]string{"10.0.0.0/8", "192.0.2.10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Provider{trustedProxies: trustedProxies}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{
+			name:       "direct connection",
+			remoteAddr: "203.0.113.5:51234",
+			want:       "203.0.113.5",
+		},
+		{
+			name:       "untrusted remote ignores headers",
+			remoteAddr: "203.0.113.5:51234",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			want:       "203.0.113.5",
+		},
+		{
+			name:       "spoofed leftmost x-forwarded-for",
+			remoteAddr: "10.0.0.1:443",
+			headers:    map[string]string{"X-Forwarded-For": "1.2.3.4, 198.51.100.7"},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "trusted proxy chain",
+			remoteAddr: "10.0.0.1:443",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.7, 192.0.2.10, 10.1.2.3"},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "all trusted uses leftmost",
+			remoteAddr: "10.0.0.1:443",
+			headers:    map[string]string{"X-Forwarded-For": "10.9.9.9, 10.1.2.3"},
+			want:       "10.9.9.9",
+		},
+		{
+			name:       "unparsable element stops the walk",
+			remoteAddr: "10.0.0.1:443",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.7, unknown, 10.1.2.3"},
+			want:       "10.1.2.3",
+		},
+		{
+			name:       "forwarded header",
+			remoteAddr: "10.0.0.1:443",
+			headers: map[string]string{
+				"Forwarded":       `for=1.2.3.4, for="[2001:db8::1]:8080";proto=https, for=192.0.2.10`,
+				"X-Forwarded-For": "198.51.100.9",
+			},
+			want: "2001:db8::1",
+		},
+		{
+			name:       "ipv4-mapped remote",
+			remoteAddr: "[::ffff:10.0.0.1]:443",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.7"},
+			want:       "198.51.100.7",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			if got := p.resolveClientIP(r); got != tt.want {
+				t.Errorf("resolveClientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"kratos_example/kratos"
+	"kratos_example/logging"
+)
+
+// リクエストのコンテキストに保存する値
+//
+// 他のパッケージと衝突しないよう、キーには非公開の型を使用し、値の設定・取得は本ファイルの関数を経由する
+
+var (
+	// 未ログイン(セッションが存在しない)
+	ErrNoSession = errors.New("no session")
+	// Kratos に接続できない等により、セッションの有無を判定できない
+	ErrSessionUnavailable = errors.New("session unavailable")
+)
+
+type sessionContextKey struct{}
+
+type sessionContextValue struct {
+	session *kratos.Session
+	err     error
+}
+
+// セッションを保存したコンテキストを返却する
+// session が nil の場合は未ログインとして扱う
+func ContextWithSession(ctx context.Context, session *kratos.Session) context.Context {
+	if session == nil {
+		return context.WithValue(ctx, sessionContextKey{}, sessionContextValue{err: ErrNoSession})
+	}
+	// 呼び出し元での変更が影響しないようコピーを保存する
+	s := *session
+	return context.WithValue(ctx, sessionContextKey{}, sessionContextValue{session: &s})
+}
+
+// セッションを取得できなかったことを保存したコンテキストを返却する
+func ContextWithSessionUnavailable(ctx context.Context, err error) context.Context {
+	return context.WithValue(ctx, sessionContextKey{}, sessionContextValue{err: errors.Join(ErrSessionUnavailable, err)})
+}
+
+// コンテキストからセッションを取得する
+// 未ログインの場合は ErrNoSession、セッションの有無を判定できない場合は ErrSessionUnavailable を返却する
+// (errors.Is で判定すること)
+func SessionFromContext(ctx context.Context) (*kratos.Session, error) {
+	v, ok := ctx.Value(sessionContextKey{}).(sessionContextValue)
+	if !ok {
+		return nil, ErrSessionUnavailable
+	}
+	if v.err != nil {
+		return nil, v.err
+	}
+	s := *v.session
+	return &s, nil
+}
+
+// ログインしているユーザ(identity)を取得する
+func IdentityFromContext(ctx context.Context) (*kratos.Identity, error) {
+	session, err := SessionFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &session.Identity, nil
+}
+
+// セッションの認証レベル(aal1, aal2 等)を取得する
+// 未ログインの場合は空文字を返却する
+func AALFromContext(ctx context.Context) string {
+	session, err := SessionFromContext(ctx)
+	if err != nil {
+		return ""
+	}
+	return session.AuthenticatorAssuranceLevel
+}
+
+// セッションの認証に使用した方式(password, oidc 等)を取得する
+func AuthenticationMethodsFromContext(ctx context.Context) []kratos.AuthenticationMethod {
+	session, err := SessionFromContext(ctx)
+	if err != nil {
+		return nil
+	}
+	return session.AuthenticationMethods
+}
+
+// リクエストIDを保存したコンテキストを返却する
+// ログ、Kratos へのリクエストでも使用するため、logging パッケージのキーで保存する
+func ContextWithRequestID(ctx context.Context, requestID string) context.Context {
+	return logging.ContextWithRequestID(ctx, requestID)
+}
+
+// コンテキストからリクエストIDを取得する
+// 設定されていない場合は空文字を返却する
+func RequestIDFromContext(ctx context.Context) string {
+	return logging.RequestIDFromContext(ctx)
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,175 @@
+package handler
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"strings"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// エラー画面
+//
+// 存在しないURL(404)、許可されていないメソッド(405)、ハンドラでの panic(500)、Kratos のエラー(/auth/error)等を、共通のエラー画面で表示する
+// htmx による画面の一部を更新するリクエストの場合は、画面全体を差し替えないよう、画面上部のアラート(#global-alert)に表示する
+
+const ERROR_PAGE_TEMPLATE = "error/index.html"
+
+// エラー画面を出力する
+// messages を指定しない場合は、ステータスコードに応じたメッセージを表示する
+func (p *Provider) renderError(w http.ResponseWriter, r *http.Request, statusCode int, messages ...string) {
+	if len(messages) == 0 {
+		messages = []string{defaultErrorMessage(statusCode)}
+	}
+
+	if isPartialRequest(r) {
+		w.Header().Set("HX-Retarget", "#global-alert")
+		w.Header().Set("HX-Reswap", "innerHTML")
+		p.render(w, r, statusCode, "_alert.html", map[string]any{
+			"ErrorMessages": messages,
+		})
+		return
+	}
+
+	session := getSession(r.Context())
+	p.render(w, r, statusCode, ERROR_PAGE_TEMPLATE, viewParameters(session, r, map[string]any{
+		"Title":         errorTitle(statusCode),
+		"StatusCode":    statusCode,
+		"ErrorMessages": messages,
+	}))
+}
+
+func errorTitle(statusCode int) string {
+	switch statusCode {
+	case http.StatusNotFound:
+		return "ページが見つかりません"
+	case http.StatusForbidden:
+		return "アクセスできません"
+	case http.StatusTooManyRequests:
+		return "しばらくお待ちください"
+	}
+	if statusCode >= 500 {
+		return "エラーが発生しました"
+	}
+	return "リクエストを処理できませんでした"
+}
+
+func defaultErrorMessage(statusCode int) string {
+	switch statusCode {
+	case http.StatusBadRequest:
+		return "リクエストが正しくありません。画面を再読み込みしてから再度お試しください。"
+	case http.StatusForbidden:
+		return "このページへのアクセスは許可されていません。"
+	case http.StatusNotFound:
+		return "お探しのページは見つかりませんでした。URLをご確認ください。"
+	case http.StatusMethodNotAllowed:
+		return "このページでは、この操作は許可されていません。"
+	case http.StatusServiceUnavailable:
+		return "ただいまサービスをご利用いただけません。時間をおいて再度お試しください。"
+	}
+	return "エラーが発生しました。時間をおいて再度お試しください。"
+}
+
+// Handler 登録されていないURL
+// 他のメソッドで登録されているURLの場合は、405 を返却する
+// ("/" で全てのリクエストを受け付けるため、ServeMux による 405 の判定が行われない)
+func (p *Provider) handleNotFound(mux *http.ServeMux) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if allowed := allowedMethods(mux, r); len(allowed) > 0 {
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			p.renderError(w, r, http.StatusMethodNotAllowed)
+			return
+		}
+		p.renderError(w, r, http.StatusNotFound)
+	}
+}
+
+// リクエストのURLが登録されているメソッド
+func allowedMethods(mux *http.ServeMux, r *http.Request) []string {
+	var allowed []string
+	for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+		if method == r.Method {
+			continue
+		}
+		req := r.Clone(r.Context())
+		req.Method = method
+		if _, pattern := mux.Handler(req); pattern != "" && pattern != "/" {
+			allowed = append(allowed, method)
+		}
+	}
+	return allowed
+}
+
+// ハンドラで panic が発生した場合に、スタックトレースをログへ出力し、エラー画面(500)を返却する
+// レスポンスの出力を開始していた場合はエラー画面を出力できないため、http.ErrAbortHandler により接続を切断する
+// ハンドラが panic の前に設定したヘッダ(Set-Cookie, HX-Redirect 等)は、ミドルウェアで設定したヘッダに戻す
+func (p *Provider) recoverPanic(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header().Clone()
+		rec := &responseRecorder{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+
+			logPanic(r, v)
+			if rec.status != 0 {
+				panic(http.ErrAbortHandler)
+			}
+			clear(w.Header())
+			for key, values := range header {
+				w.Header()[key] = values
+			}
+			p.renderError(w, r, http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// セッション、CSRFトークン等を設定するミドルウェアで panic が発生した場合に、テキストのエラー(500)を返却する
+// エラー画面の表示にはミドルウェアで設定する値が必要なため、recoverPanic とは別に、ミドルウェアの外側で復旧する
+// (ハンドラの panic は、内側の recoverPanic でエラー画面を表示する)
+func (p *Provider) recoverMiddlewarePanic(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header().Clone()
+		rec := &responseRecorder{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+
+			logPanic(r, v)
+			if rec.status != 0 {
+				panic(http.ErrAbortHandler)
+			}
+			clear(w.Header())
+			for key, values := range header {
+				w.Header()[key] = values
+			}
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+func logPanic(r *http.Request, v any) {
+	ctx := r.Context()
+	slog.ErrorContext(ctx, "panic recovered",
+		"panic", v,
+		"method", r.Method,
+		"path", r.URL.Path,
+		"stack", string(debug.Stack()),
+	)
+	trace.SpanFromContext(ctx).SetStatus(codes.Error, fmt.Sprintf("panic: %v", v))
+}
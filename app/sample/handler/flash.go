@@ -0,0 +1,158 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"kratos_example/store"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// フラッシュメッセージ
+//
+// リダイレクト(HX-Redirect を含む)後の画面に、一度だけ表示するメッセージ
+// ログアウト後、会員登録の途中等、Kratos のセッションがない場合も表示できるよう、
+// セッションストアではなく、Cookie に保存したIDごとにストアへ保存する
+//
+// メッセージは、次に画面(もしくは部分テンプレート)を出力した際に layout/_flash.html で表示し、ストアから削除する
+
+const (
+	FLASH_COOKIE_KEY = "app_flash"
+	// 追加してから表示されるまでの有効期限
+	FLASH_TTL = 5 * time.Minute
+
+	FLASH_TYPE_INFO    = flashType("info")
+	FLASH_TYPE_SUCCESS = flashType("success")
+	FLASH_TYPE_WARNING = flashType("warning")
+	FLASH_TYPE_ERROR   = flashType("error")
+)
+
+// daisyUI の alert-{type} のクラス名として使用する
+type flashType string
+
+type flashMessage struct {
+	Type    flashType `json:"type"`
+	Message string    `json:"message"`
+}
+
+var validFlashID = regexp.MustCompile(`^[A-Za-z0-9\-_]{43}$`)
+
+// リクエストごとのフラッシュメッセージのID
+// 同じリクエストの中で、Cookie を発行した後にメッセージを追加、表示できるよう、ポインタで保持する
+type flashState struct {
+	mu sync.Mutex
+	id string
+}
+
+type flashStateContextKey struct{}
+
+func flashStoreKey(id string) string {
+	return "flash:" + id
+}
+
+// Cookie からフラッシュメッセージのIDを取得し、コンテキストへ保存する
+func (p *Provider) flash(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state := &flashState{}
+		if cookie, err := r.Cookie(FLASH_COOKIE_KEY); err == nil && validFlashID.MatchString(cookie.Value) {
+			state.id = cookie.Value
+		}
+		ctx := context.WithValue(r.Context(), flashStateContextKey{}, state)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// フラッシュメッセージを追加する
+// リダイレクトする場合は、リダイレクトの前に呼び出す (Cookie を発行する場合があるため)
+func (p *Provider) addFlash(w http.ResponseWriter, r *http.Request, t flashType, message string) {
+	ctx := r.Context()
+	state, ok := ctx.Value(flashStateContextKey{}).(*flashState)
+	if !ok {
+		slog.ErrorContext(ctx, "flash middleware is not applied", "path", r.URL.Path)
+		return
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if state.id == "" {
+		state.id = newFlashID()
+		http.SetCookie(w, &http.Cookie{
+			Name:     FLASH_COOKIE_KEY,
+			Value:    state.id,
+			Path:     p.cookieParams.Path,
+			Domain:   p.cookieParams.Domain,
+			Secure:   p.cookieParams.Secure,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+
+	messages, err := p.loadFlashes(ctx, state.id)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to load flash messages", "Error", err)
+	}
+	messages = append(messages, flashMessage{Type: t, Message: message})
+	b, err := json.Marshal(messages)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to marshal flash messages", "Error", err)
+		return
+	}
+	if err := p.d.Store.Set(ctx, flashStoreKey(state.id), b, FLASH_TTL); err != nil {
+		slog.ErrorContext(ctx, "failed to save flash messages", "Error", err)
+	}
+}
+
+// 表示するフラッシュメッセージを取得し、ストアから削除する
+func (p *Provider) popFlashes(ctx context.Context) []flashMessage {
+	state, ok := ctx.Value(flashStateContextKey{}).(*flashState)
+	if !ok {
+		return nil
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if state.id == "" {
+		return nil
+	}
+	messages, err := p.loadFlashes(ctx, state.id)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to load flash messages", "Error", err)
+		return nil
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+	if err := p.d.Store.Delete(ctx, flashStoreKey(state.id)); err != nil {
+		slog.ErrorContext(ctx, "failed to delete flash messages", "Error", err)
+	}
+	return messages
+}
+
+func (p *Provider) loadFlashes(ctx context.Context, id string) ([]flashMessage, error) {
+	b, err := p.d.Store.Get(ctx, flashStoreKey(id))
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var messages []flashMessage
+	if err := json.Unmarshal(b, &messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+func newFlashID() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,175 @@
+package handler
+
+import (
+	"fmt"
+	"kratos_example/kratos"
+	"log/slog"
+	"net/http"
+	"net/url"
+)
+
+// flow の有効期限切れ
+//
+// Kratos の flow (login, registration, recovery, settings) は、有効期限(selfservice.flows.*.lifespan)を過ぎると送信できない
+// 送信(POST)時に有効期限が切れていた場合は、flow を作成し直し、パスワード等を除く入力内容を引き継いだフォームを表示して再度送信してもらう
+// 画面の表示(GET)時に有効期限が切れていた場合は、flow を指定せずに同じ画面へリダイレクトし、新しい flow を作成する
+
+const FLOW_EXPIRED_MESSAGE = "有効期限が切れたため、入力内容をご確認のうえ、もう一度送信してください。"
+
+type flowType string
+
+const (
+	FLOW_TYPE_LOGIN        = flowType("login")
+	FLOW_TYPE_REGISTRATION = flowType("registration")
+	FLOW_TYPE_RECOVERY     = flowType("recovery")
+	FLOW_TYPE_SETTINGS     = flowType("settings")
+)
+
+type restartFlowOutput struct {
+	flowID            string
+	csrfToken         string
+	passkeyChallenge  string
+	passkeyCreateData string
+}
+
+// 有効期限切れの flow の代わりに、新しい flow を作成する
+// Kratos の Cookie をレスポンスへ設定し、htmx によるリクエストの場合はブラウザのURLの flow を置き換える
+func (p *Provider) restartFlow(w http.ResponseWriter, r *http.Request, t flowType) (restartFlowOutput, error) {
+	ctx := r.Context()
+	cookie := r.Header.Get("Cookie")
+
+	var (
+		output  restartFlowOutput
+		cookies []string
+	)
+	switch t {
+	case FLOW_TYPE_LOGIN:
+		createOutput, err := p.d.Kratos.CreateLoginFlow(ctx, kratos.CreateLoginFlowInput{
+			Cookie:   cookie,
+			ClientIP: clientIP(r),
+			Refresh:  isAuthenticated(getSession(ctx)),
+		})
+		if err != nil {
+			return output, err
+		}
+		output.flowID = createOutput.FlowID
+		output.csrfToken = createOutput.CsrfToken
+		output.passkeyChallenge = createOutput.PasskeyChallenge
+		cookies = createOutput.Cookies
+	case FLOW_TYPE_REGISTRATION:
+		createOutput, err := p.d.Kratos.CreateRegistrationFlow(ctx, kratos.CreateRegistrationFlowInput{
+			Cookie:   cookie,
+			ClientIP: clientIP(r),
+		})
+		if err != nil {
+			return output, err
+		}
+		output.flowID = createOutput.FlowID
+		output.csrfToken = createOutput.CsrfToken
+		output.passkeyCreateData = createOutput.PasskeyCreateData
+		cookies = createOutput.Cookies
+	case FLOW_TYPE_RECOVERY:
+		createOutput, err := p.d.Kratos.CreateRecoveryFlow(ctx, kratos.CreateRecoveryFlowInput{
+			Cookie:   cookie,
+			ClientIP: clientIP(r),
+		})
+		if err != nil {
+			return output, err
+		}
+		output.flowID = createOutput.FlowID
+		output.csrfToken = createOutput.CsrfToken
+		cookies = createOutput.Cookies
+	case FLOW_TYPE_SETTINGS:
+		createOutput, err := p.d.Kratos.CreateSettingsFlow(ctx, kratos.CreateSettingsFlowInput{
+			Cookie:   cookie,
+			ClientIP: clientIP(r),
+		})
+		if err != nil {
+			return output, err
+		}
+		output.flowID = createOutput.FlowID
+		output.csrfToken = createOutput.CsrfToken
+		cookies = createOutput.Cookies
+	default:
+		return output, fmt.Errorf("unknown flow type: %s", t)
+	}
+	// Kratos のレスポンスがエラーの場合も、err が nil で返却される場合がある
+	if output.flowID == "" {
+		return output, fmt.Errorf("failed to create %s flow", t)
+	}
+
+	// kratosのcookieをそのままブラウザへ受け渡す
+	setCookieToResponseHeader(w, cookies)
+	replaceFlowInCurrentURL(w, r, output.flowID)
+	p.metrics.flowRestarts.WithLabelValues(string(t)).Inc()
+	return output, nil
+}
+
+// テンプレートで flow のIDを参照するキー
+func (t flowType) flowIDKey() string {
+	switch t {
+	case FLOW_TYPE_LOGIN:
+		return "LoginFlowID"
+	case FLOW_TYPE_REGISTRATION:
+		return "RegistrationFlowID"
+	case FLOW_TYPE_RECOVERY:
+		return "RecoveryFlowID"
+	default:
+		return "SettingsFlowID"
+	}
+}
+
+// 送信時に flow の有効期限が切れていた場合に、新しい flow を作成してフォームを表示する
+// data には引き継ぐ入力内容(パスワード等を除く)を指定し、flow のID、CSRFトークン、パスキーのチャレンジは新しい flow の値を設定する
+// messages を指定しない場合は FLOW_EXPIRED_MESSAGE を表示する
+// flow を作成できなかった場合は false を返却する (呼び出し元で、有効期限切れのエラーとして表示する)
+func (p *Provider) renderFormWithNewFlow(w http.ResponseWriter, r *http.Request, t flowType, name string, data map[string]any, messages ...string) bool {
+	restarted, err := p.restartFlow(w, r, t)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to restart flow", "flow", t, "Error", err)
+		return false
+	}
+	if len(messages) == 0 {
+		messages = []string{FLOW_EXPIRED_MESSAGE}
+	}
+	data[t.flowIDKey()] = restarted.flowID
+	data["CsrfToken"] = restarted.csrfToken
+	data["ErrorMessages"] = messages
+	if restarted.passkeyChallenge != "" {
+		data["PasskeyChallenge"] = restarted.passkeyChallenge
+	}
+	if restarted.passkeyCreateData != "" {
+		data["PasskeyCreateData"] = restarted.passkeyCreateData
+	}
+	p.render(w, r, http.StatusUnprocessableEntity, name, viewParameters(getSession(r.Context()), r, data))
+	return true
+}
+
+// 画面の表示時に flow の有効期限が切れていた場合に、flow を指定せずに同じ画面へリダイレクトする
+// return_to 等、flow 以外のクエリパラメータは引き継ぐ
+func (p *Provider) redirectToNewFlow(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	query.Del("flow")
+	redirectTo := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+	p.addFlash(w, r, FLASH_TYPE_WARNING, "有効期限が切れたため、もう一度お試しください。")
+	redirect(w, r, redirectTo.String())
+}
+
+// htmx によるリクエストの場合に、ブラウザのURL(HX-Current-URL)の flow を新しい flow に置き換える
+// 再読み込みした際に、有効期限切れの flow を再度取得しないようにする
+func replaceFlowInCurrentURL(w http.ResponseWriter, r *http.Request, flowID string) {
+	if r.Header.Get("HX-Request") != "true" {
+		return
+	}
+	currentURL, err := url.Parse(r.Header.Get("HX-Current-URL"))
+	if err != nil || currentURL.Path == "" {
+		return
+	}
+	query := currentURL.Query()
+	if !query.Has("flow") {
+		return
+	}
+	query.Set("flow", flowID)
+	replaceURL := url.URL{Path: currentURL.Path, RawQuery: query.Encode()}
+	w.Header().Set("HX-Replace-Url", replaceURL.String())
+}
@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"errors"
 	"fmt"
 	"kratos_example/kratos"
 	"log"
@@ -14,8 +15,9 @@ import (
 
 // Handler GET /auth/registration
 type handleGetAuthRegistrationdRequestParams struct {
-	cookie string
-	flowID string
+	cookie   string
+	flowID   string
+	returnTo string
 }
 
 func (p *Provider) handleGetAuthRegistration(w http.ResponseWriter, r *http.Request) {
@@ -23,70 +25,70 @@ func (p *Provider) handleGetAuthRegistration(w http.ResponseWriter, r *http.Requ
 	session := getSession(ctx)
 
 	reqParams := handleGetAuthRegistrationdRequestParams{
-		cookie: r.Header.Get("Cookie"),
-		flowID: r.URL.Query().Get("flow"),
+		cookie:   r.Header.Get("Cookie"),
+		flowID:   r.URL.Query().Get("flow"),
+		returnTo: p.getReturnTo(r),
 	}
 
-	slog.Info(fmt.Sprintf("%v", reqParams))
-
 	// Registration flowを新規作成した場合は、FlowIDを含めてリダイレクト
 	if reqParams.flowID == "" {
-		output, err := p.d.Kratos.CreateRegistrationFlow(kratos.CreateRegistrationFlowInput{
-			Cookie:     reqParams.cookie,
-			RemoteAddr: r.RemoteAddr,
+		output, err := p.d.Kratos.CreateRegistrationFlow(ctx, kratos.CreateRegistrationFlowInput{
+			Cookie:   reqParams.cookie,
+			ClientIP: clientIP(r),
 		})
 		if err != nil {
-			w.WriteHeader(http.StatusOK)
-			pkgVars.tmpl.ExecuteTemplate(w, "auth/registration/index.html", viewParameters(session, r, map[string]any{
+			p.render(w, r, http.StatusOK, "auth/registration/index.html", viewParameters(session, r, map[string]any{
 				"ErrorMessages": output.ErrorMessages,
 			}))
 			return
 		}
-		redirect(w, r, fmt.Sprintf("%s?flow=%s", "/auth/registration", output.FlowID))
+		p.metrics.registrationsStarted.Inc()
+		redirect(w, r, appendReturnTo(fmt.Sprintf("%s?flow=%s", "/auth/registration", output.FlowID), reqParams.returnTo))
 		return
 	}
 
 	// Registration Flow の 取得
-	output, err := p.d.Kratos.GetRegistrationFlow(kratos.GetRegistrationFlowInput{
-		Cookie:     reqParams.cookie,
-		RemoteAddr: r.RemoteAddr,
-		FlowID:     reqParams.flowID,
+	output, err := p.d.Kratos.GetRegistrationFlow(ctx, kratos.GetRegistrationFlowInput{
+		Cookie:   reqParams.cookie,
+		ClientIP: clientIP(r),
+		FlowID:   reqParams.flowID,
 	})
+	// 有効期限切れの場合は、新しい flow を作成する
+	if errors.Is(err, kratos.ErrFlowExpired) {
+		p.redirectToNewFlow(w, r)
+		return
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusOK)
-		pkgVars.tmpl.ExecuteTemplate(w, "auth/registration/index.html", viewParameters(session, r, map[string]any{
+		p.render(w, r, http.StatusOK, "auth/registration/index.html", viewParameters(session, r, map[string]any{
 			"ErrorMessages": output.ErrorMessages,
 		}))
 		return
 	}
 
 	if output.RequestFromOidc {
-		adminListIdentitiesOutput, err := p.d.Kratos.AdminListIdentities(kratos.AdminListIdentitiesInput{
+		adminListIdentitiesOutput, err := p.d.Kratos.AdminListIdentities(ctx, kratos.AdminListIdentitiesInput{
 			CredentialIdentifier: output.Traits.Email,
 			Cookie:               reqParams.cookie,
 		})
 		if err != nil {
-			w.WriteHeader(http.StatusOK)
-			pkgVars.tmpl.ExecuteTemplate(w, "auth/registration/index.html", viewParameters(session, r, map[string]any{
+			p.render(w, r, http.StatusOK, "auth/registration/index.html", viewParameters(session, r, map[string]any{
 				"ErrorMessages": output.ErrorMessages,
 			}))
 			return
 		}
 
-		slog.Info(fmt.Sprintf("%v", adminListIdentitiesOutput))
-
 		if len(adminListIdentitiesOutput.Identities) > 0 {
-			updateRegistrationOutput, err := p.d.Kratos.UpdateRegistrationFlow(kratos.UpdateRegistrationFlowInput{
-				Cookie:     r.Header.Get("Cookie"),
-				RemoteAddr: r.RemoteAddr,
-				FlowID:     reqParams.flowID,
-				CsrfToken:  output.CsrfToken,
-				Method:     "oidc",
-				Provider:   "google",
-				Traits:     adminListIdentitiesOutput.Identities[0].Traits,
+			updateRegistrationOutput, err := p.d.Kratos.UpdateRegistrationFlow(ctx, kratos.UpdateRegistrationFlowInput{
+				Cookie:    r.Header.Get("Cookie"),
+				ClientIP:  clientIP(r),
+				FlowID:    reqParams.flowID,
+				CsrfToken: output.CsrfToken,
+				Method:    "oidc",
+				Provider:  "google",
+				Traits:    adminListIdentitiesOutput.Identities[0].Traits,
 			})
 			if err != nil || len(output.ErrorMessages) > 0 {
-				pkgVars.tmpl.ExecuteTemplate(w, "auth/registration/_form.html", viewParameters(session, r, map[string]any{
+				p.render(w, r, http.StatusUnprocessableEntity, "auth/registration/_form.html", viewParameters(session, r, map[string]any{
 					"RegistrationFlowID": reqParams.flowID,
 					"CsrfToken":          output.CsrfToken,
 					"Traits":             adminListIdentitiesOutput.Identities[0].Traits,
@@ -95,7 +97,7 @@ func (p *Provider) handleGetAuthRegistration(w http.ResponseWriter, r *http.Requ
 				return
 			}
 
-			slog.Info(fmt.Sprintf("%v", updateRegistrationOutput))
+			p.metrics.registrationsCompleted.WithLabelValues("oidc").Inc()
 			if updateRegistrationOutput.RedirectBrowserTo != "" {
 				setCookieToResponseHeader(w, updateRegistrationOutput.Cookies)
 				redirect(w, r, updateRegistrationOutput.RedirectBrowserTo)
@@ -106,17 +108,17 @@ func (p *Provider) handleGetAuthRegistration(w http.ResponseWriter, r *http.Requ
 	setCookieToResponseHeader(w, output.Cookies)
 
 	// flowの情報に従ってレンダリング
-	w.WriteHeader(http.StatusOK)
 	if output.RenderingType == kratos.RegistrationRenderingTypeOidc {
-		pkgVars.tmpl.ExecuteTemplate(w, "auth/registration/oidc.html", viewParameters(session, r, map[string]any{
+		p.render(w, r, http.StatusOK, "auth/registration/oidc.html", viewParameters(session, r, map[string]any{
 			"RegistrationFlowID": output.FlowID,
 			"CsrfToken":          output.CsrfToken,
 			"Traits":             output.Traits,
 		}))
 	} else {
-		pkgVars.tmpl.ExecuteTemplate(w, "auth/registration/index.html", viewParameters(session, r, map[string]any{
+		p.render(w, r, http.StatusOK, "auth/registration/index.html", viewParameters(session, r, map[string]any{
 			"RegistrationFlowID": output.FlowID,
 			"CsrfToken":          output.CsrfToken,
+			"ReturnTo":           url.QueryEscape(reqParams.returnTo),
 		}))
 	}
 }
@@ -136,17 +138,14 @@ func (p *Provider) handleGetAuthRegistrationPasskey(w http.ResponseWriter, r *ht
 		flowID: r.URL.Query().Get("flow"),
 	}
 
-	slog.Info(fmt.Sprintf("%v", reqParams))
-
 	// Registration flowを新規作成した場合は、FlowIDを含めてリダイレクト
 	if reqParams.flowID == "" {
-		output, err := p.d.Kratos.CreateRegistrationFlow(kratos.CreateRegistrationFlowInput{
-			Cookie:     reqParams.cookie,
-			RemoteAddr: r.RemoteAddr,
+		output, err := p.d.Kratos.CreateRegistrationFlow(ctx, kratos.CreateRegistrationFlowInput{
+			Cookie:   reqParams.cookie,
+			ClientIP: clientIP(r),
 		})
 		if err != nil {
-			w.WriteHeader(http.StatusOK)
-			pkgVars.tmpl.ExecuteTemplate(w, "auth/registration/passkey.html", viewParameters(session, r, map[string]any{
+			p.render(w, r, http.StatusOK, "auth/registration/passkey.html", viewParameters(session, r, map[string]any{
 				"ErrorMessages": output.ErrorMessages,
 			}))
 			return
@@ -156,14 +155,18 @@ func (p *Provider) handleGetAuthRegistrationPasskey(w http.ResponseWriter, r *ht
 	}
 
 	// Registration Flow の 取得
-	output, err := p.d.Kratos.GetRegistrationFlow(kratos.GetRegistrationFlowInput{
-		Cookie:     reqParams.cookie,
-		RemoteAddr: r.RemoteAddr,
-		FlowID:     reqParams.flowID,
+	output, err := p.d.Kratos.GetRegistrationFlow(ctx, kratos.GetRegistrationFlowInput{
+		Cookie:   reqParams.cookie,
+		ClientIP: clientIP(r),
+		FlowID:   reqParams.flowID,
 	})
+	// 有効期限切れの場合は、新しい flow を作成する
+	if errors.Is(err, kratos.ErrFlowExpired) {
+		p.redirectToNewFlow(w, r)
+		return
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusOK)
-		pkgVars.tmpl.ExecuteTemplate(w, "auth/registration/passkey.html", viewParameters(session, r, map[string]any{
+		p.render(w, r, http.StatusOK, "auth/registration/passkey.html", viewParameters(session, r, map[string]any{
 			"ErrorMessages": output.ErrorMessages,
 		}))
 		return
@@ -172,8 +175,7 @@ func (p *Provider) handleGetAuthRegistrationPasskey(w http.ResponseWriter, r *ht
 	setCookieToResponseHeader(w, output.Cookies)
 
 	// flowの情報に従ってレンダリング
-	w.WriteHeader(http.StatusOK)
-	pkgVars.tmpl.ExecuteTemplate(w, "auth/registration/passkey.html", viewParameters(session, r, map[string]any{
+	p.render(w, r, http.StatusOK, "auth/registration/passkey.html", viewParameters(session, r, map[string]any{
 		"RegistrationFlowID": output.FlowID,
 		"CsrfToken":          output.CsrfToken,
 		"Traits":             output.Traits,
@@ -188,14 +190,15 @@ type handlePostAuthRegistrationRequestParams struct {
 	Traits               kratos.Traits `validate:"required"`
 	Password             string        `validate:"required" ja:"パスワード"`
 	PasswordConfirmation string        `validate:"required" ja:"パスワード確認"`
+	ReturnTo             string
 }
 
-func (p *handlePostAuthRegistrationRequestParams) validate() map[string]string {
-	err := pkgVars.validate.Struct(p)
+func (p *handlePostAuthRegistrationRequestParams) validate(v *paramsValidator) map[string]string {
+	err := v.validate.Struct(p)
 	if err != nil {
 		slog.Error(err.Error())
 	}
-	fieldErrors := validationFieldErrors(pkgVars.validate.Struct(p))
+	fieldErrors := v.fieldErrors(v.validate.Struct(p))
 	if p.Password != p.PasswordConfirmation {
 		fieldErrors["Password"] = "パスワードとパスワード確認が一致しません"
 	}
@@ -213,52 +216,66 @@ func (p *Provider) handlePostAuthRegistration(w http.ResponseWriter, r *http.Req
 		Lastname:  r.PostFormValue("traits.lastname"),
 		Nickname:  r.PostFormValue("traits.nickname"),
 	}
-	traits.Birthdate, _ = time.Parse(pkgVars.birthdateFormat, r.PostFormValue("traits.birthdate"))
+	traits.Birthdate, _ = time.Parse(p.birthdateFormat, r.PostFormValue("traits.birthdate"))
 	reqParams := handlePostAuthRegistrationRequestParams{
 		FlowID:               r.URL.Query().Get("flow"),
 		CsrfToken:            r.PostFormValue("csrf_token"),
 		Traits:               traits,
 		Password:             r.PostFormValue("password"),
 		PasswordConfirmation: r.PostFormValue("password-confirmation"),
+		ReturnTo:             p.getReturnTo(r),
 	}
-	validationFieldErrors := reqParams.validate()
+	validationFieldErrors := reqParams.validate(p.validator)
 	if len(validationFieldErrors) > 0 {
-		pkgVars.tmpl.ExecuteTemplate(w, "auth/registration/_form.html", viewParameters(session, r, map[string]any{
+		p.render(w, r, http.StatusUnprocessableEntity, "auth/registration/_form.html", viewParameters(session, r, map[string]any{
 			"RegistrationFlowID":   reqParams.FlowID,
 			"CsrfToken":            reqParams.CsrfToken,
 			"Traits":               traits,
 			"Password":             reqParams.Password,
+			"ReturnTo":             url.QueryEscape(reqParams.ReturnTo),
 			"ValidationFieldError": validationFieldErrors,
 		}))
 		return
 	}
 
 	// Registration Flow 更新
-	output, err := p.d.Kratos.UpdateRegistrationFlow(kratos.UpdateRegistrationFlowInput{
-		Cookie:     r.Header.Get("Cookie"),
-		RemoteAddr: r.RemoteAddr,
-		FlowID:     reqParams.FlowID,
-		CsrfToken:  reqParams.CsrfToken,
-		Method:     "password",
-		Traits:     traits,
-		Password:   reqParams.Password,
+	output, err := p.d.Kratos.UpdateRegistrationFlow(ctx, kratos.UpdateRegistrationFlowInput{
+		Cookie:    r.Header.Get("Cookie"),
+		ClientIP:  clientIP(r),
+		FlowID:    reqParams.FlowID,
+		CsrfToken: reqParams.CsrfToken,
+		Method:    "password",
+		Traits:    traits,
+		Password:  reqParams.Password,
 	})
+	// 有効期限切れの場合は、パスワード以外の入力内容を引き継いで新しい flow のフォームを表示する
+	if errors.Is(err, kratos.ErrFlowExpired) && p.renderFormWithNewFlow(w, r, FLOW_TYPE_REGISTRATION, "auth/registration/_form.html", map[string]any{
+		"Traits":   traits,
+		"ReturnTo": url.QueryEscape(reqParams.ReturnTo),
+	}) {
+		return
+	}
 	if err != nil || len(output.ErrorMessages) > 0 {
-		pkgVars.tmpl.ExecuteTemplate(w, "auth/registration/_form.html", viewParameters(session, r, map[string]any{
+		p.render(w, r, http.StatusUnprocessableEntity, "auth/registration/_form.html", viewParameters(session, r, map[string]any{
 			"RegistrationFlowID": reqParams.FlowID,
 			"CsrfToken":          reqParams.CsrfToken,
 			"Traits":             traits,
 			"Password":           reqParams.Password,
+			"ReturnTo":           url.QueryEscape(reqParams.ReturnTo),
 			"ErrorMessages":      output.ErrorMessages,
 		}))
 		return
 	}
 
+	p.metrics.registrationsCompleted.WithLabelValues("password").Inc()
+
 	// kratosのcookieをそのままブラウザへ受け渡す
 	setCookieToResponseHeader(w, output.Cookies)
 
 	// Registration flow成功時はVerification flowへリダイレクト
-	redirect(w, r, fmt.Sprintf("%s?flow=%s", "/auth/verification/code", output.VerificationFlowID))
+	// return_to は Verification flow 完了後のログインまで引き継ぐ
+	p.addFlash(w, r, FLASH_TYPE_SUCCESS, "会員登録が完了しました。メールアドレスに届いた確認コードを入力してください。")
+	redirect(w, r, appendReturnTo(fmt.Sprintf("%s?flow=%s", "/auth/verification/code", output.VerificationFlowID), reqParams.ReturnTo))
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -270,12 +287,12 @@ type handlePostAuthRegistrationOidcRequestParams struct {
 	Traits    kratos.Traits `validate:"required"`
 }
 
-func (p *handlePostAuthRegistrationOidcRequestParams) validate() map[string]string {
-	err := pkgVars.validate.Struct(p)
+func (p *handlePostAuthRegistrationOidcRequestParams) validate(v *paramsValidator) map[string]string {
+	err := v.validate.Struct(p)
 	if err != nil {
 		slog.Error(err.Error())
 	}
-	fieldErrors := validationFieldErrors(pkgVars.validate.Struct(p))
+	fieldErrors := v.fieldErrors(v.validate.Struct(p))
 	return fieldErrors
 }
 
@@ -290,16 +307,16 @@ func (p *Provider) handlePostAuthRegistrationOidc(w http.ResponseWriter, r *http
 		Lastname:  r.PostFormValue("traits.lastname"),
 		Nickname:  r.PostFormValue("traits.nickname"),
 	}
-	traits.Birthdate, _ = time.Parse(pkgVars.birthdateFormat, r.PostFormValue("traits.birthdate"))
+	traits.Birthdate, _ = time.Parse(p.birthdateFormat, r.PostFormValue("traits.birthdate"))
 	reqParams := handlePostAuthRegistrationOidcRequestParams{
 		FlowID:    r.URL.Query().Get("flow"),
 		CsrfToken: r.PostFormValue("csrf_token"),
 		Provider:  r.PostFormValue("provider"),
 		Traits:    traits,
 	}
-	validationFieldErrors := reqParams.validate()
+	validationFieldErrors := reqParams.validate(p.validator)
 	if len(validationFieldErrors) > 0 {
-		pkgVars.tmpl.ExecuteTemplate(w, "auth/registration/_form_oidc.html", viewParameters(session, r, map[string]any{
+		p.render(w, r, http.StatusUnprocessableEntity, "auth/registration/_form_oidc.html", viewParameters(session, r, map[string]any{
 			"RegistrationFlowID":   reqParams.FlowID,
 			"CsrfToken":            reqParams.CsrfToken,
 			"Traits":               traits,
@@ -309,17 +326,22 @@ func (p *Provider) handlePostAuthRegistrationOidc(w http.ResponseWriter, r *http
 	}
 
 	// Registration Flow 更新
-	output, err := p.d.Kratos.UpdateRegistrationFlow(kratos.UpdateRegistrationFlowInput{
-		Cookie:     r.Header.Get("Cookie"),
-		RemoteAddr: r.RemoteAddr,
-		FlowID:     reqParams.FlowID,
-		CsrfToken:  reqParams.CsrfToken,
-		Method:     "oidc",
-		Provider:   reqParams.Provider,
-		Traits:     traits,
+	output, err := p.d.Kratos.UpdateRegistrationFlow(ctx, kratos.UpdateRegistrationFlowInput{
+		Cookie:    r.Header.Get("Cookie"),
+		ClientIP:  clientIP(r),
+		FlowID:    reqParams.FlowID,
+		CsrfToken: reqParams.CsrfToken,
+		Method:    "oidc",
+		Provider:  reqParams.Provider,
+		Traits:    traits,
 	})
+	if errors.Is(err, kratos.ErrFlowExpired) && p.renderFormWithNewFlow(w, r, FLOW_TYPE_REGISTRATION, "auth/registration/_form_oidc.html", map[string]any{
+		"Traits": traits,
+	}) {
+		return
+	}
 	if err != nil && output.RedirectBrowserTo == "" {
-		pkgVars.tmpl.ExecuteTemplate(w, "auth/registration/_form_oidc.html", viewParameters(session, r, map[string]any{
+		p.render(w, r, http.StatusUnprocessableEntity, "auth/registration/_form_oidc.html", viewParameters(session, r, map[string]any{
 			"RegistrationFlowID": reqParams.FlowID,
 			"CsrfToken":          reqParams.CsrfToken,
 			"Traits":             traits,
@@ -343,12 +365,12 @@ type handlePostAuthRegistrationPasskeyRequestParams struct {
 	PasskeyRegister string
 }
 
-func (p *handlePostAuthRegistrationPasskeyRequestParams) validate() map[string]string {
-	err := pkgVars.validate.Struct(p)
+func (p *handlePostAuthRegistrationPasskeyRequestParams) validate(v *paramsValidator) map[string]string {
+	err := v.validate.Struct(p)
 	if err != nil {
 		slog.Error(err.Error())
 	}
-	fieldErrors := validationFieldErrors(pkgVars.validate.Struct(p))
+	fieldErrors := v.fieldErrors(v.validate.Struct(p))
 	return fieldErrors
 }
 
@@ -363,16 +385,16 @@ func (p *Provider) handlePostAuthRegistrationPasskey(w http.ResponseWriter, r *h
 		Lastname:  r.PostFormValue("traits.lastname"),
 		Nickname:  r.PostFormValue("traits.nickname"),
 	}
-	traits.Birthdate, _ = time.Parse(pkgVars.birthdateFormat, r.PostFormValue("traits.birthdate"))
+	traits.Birthdate, _ = time.Parse(p.birthdateFormat, r.PostFormValue("traits.birthdate"))
 	reqParams := handlePostAuthRegistrationPasskeyRequestParams{
 		FlowID:          r.URL.Query().Get("flow"),
 		CsrfToken:       r.PostFormValue("csrf_token"),
 		Traits:          traits,
 		PasskeyRegister: r.PostFormValue("passkey_register"),
 	}
-	validationFieldErrors := reqParams.validate()
+	validationFieldErrors := reqParams.validate(p.validator)
 	if len(validationFieldErrors) > 0 {
-		pkgVars.tmpl.ExecuteTemplate(w, "auth/registration/_form_passkey.html", viewParameters(session, r, map[string]any{
+		p.render(w, r, http.StatusUnprocessableEntity, "auth/registration/_form_passkey.html", viewParameters(session, r, map[string]any{
 			"RegistrationFlowID":   reqParams.FlowID,
 			"CsrfToken":            reqParams.CsrfToken,
 			"Traits":               traits,
@@ -382,17 +404,23 @@ func (p *Provider) handlePostAuthRegistrationPasskey(w http.ResponseWriter, r *h
 	}
 
 	// Registration Flow 更新
-	output, err := p.d.Kratos.UpdateRegistrationFlow(kratos.UpdateRegistrationFlowInput{
+	output, err := p.d.Kratos.UpdateRegistrationFlow(ctx, kratos.UpdateRegistrationFlowInput{
 		Cookie:          r.Header.Get("Cookie"),
-		RemoteAddr:      r.RemoteAddr,
+		ClientIP:        clientIP(r),
 		FlowID:          reqParams.FlowID,
 		CsrfToken:       reqParams.CsrfToken,
 		Method:          "passkey",
 		Traits:          traits,
 		PasskeyRegister: reqParams.PasskeyRegister,
 	})
+	// パスキーは flow ごとのチャレンジに対して作成するため、新しい flow のチャレンジで作成し直してもらう
+	if errors.Is(err, kratos.ErrFlowExpired) && p.renderFormWithNewFlow(w, r, FLOW_TYPE_REGISTRATION, "auth/registration/_form_passkey.html", map[string]any{
+		"Traits": traits,
+	}) {
+		return
+	}
 	if err != nil || len(output.ErrorMessages) > 0 {
-		pkgVars.tmpl.ExecuteTemplate(w, "auth/registration/_form_passkey.html", viewParameters(session, r, map[string]any{
+		p.render(w, r, http.StatusUnprocessableEntity, "auth/registration/_form_passkey.html", viewParameters(session, r, map[string]any{
 			"RegistrationFlowID": reqParams.FlowID,
 			"CsrfToken":          reqParams.CsrfToken,
 			"Traits":             traits,
@@ -401,9 +429,12 @@ func (p *Provider) handlePostAuthRegistrationPasskey(w http.ResponseWriter, r *h
 		return
 	}
 
+	p.metrics.registrationsCompleted.WithLabelValues("passkey").Inc()
+
 	// kratosのcookieをそのままブラウザへ受け渡す
 	setCookieToResponseHeader(w, output.Cookies)
 
+	p.addFlash(w, r, FLASH_TYPE_SUCCESS, "会員登録が完了しました。")
 	redirect(w, r, output.RedirectBrowserTo)
 	// Registration flow成功時はVerification flowへリダイレクト
 	// redirect(w, r, fmt.Sprintf("%s?flow=%s", "/auth/verification/code", output.VerificationFlowID))
@@ -428,13 +459,12 @@ func (p *Provider) handleGetAuthVerification(w http.ResponseWriter, r *http.Requ
 
 	// Verification flowを新規作成した場合は、FlowIDを含めてリダイレクト
 	if reqParams.flowID == "" {
-		output, err := p.d.Kratos.CreateVerificationFlow(kratos.CreateVerificationFlowInput{
-			Cookie:     reqParams.cookie,
-			RemoteAddr: r.RemoteAddr,
+		output, err := p.d.Kratos.CreateVerificationFlow(ctx, kratos.CreateVerificationFlowInput{
+			Cookie:   reqParams.cookie,
+			ClientIP: clientIP(r),
 		})
 		if err != nil {
-			w.WriteHeader(http.StatusOK)
-			pkgVars.tmpl.ExecuteTemplate(w, "auth/verification/index.html", viewParameters(session, r, map[string]any{
+			p.render(w, r, http.StatusOK, "auth/verification/index.html", viewParameters(session, r, map[string]any{
 				"ErrorMessages": output.ErrorMessages,
 			}))
 			return
@@ -444,14 +474,13 @@ func (p *Provider) handleGetAuthVerification(w http.ResponseWriter, r *http.Requ
 	}
 
 	// Verification Flow の作成 or 取得
-	output, err := p.d.Kratos.GetVerificationFlow(kratos.GetVerificationFlowInput{
-		Cookie:     reqParams.cookie,
-		RemoteAddr: r.RemoteAddr,
-		FlowID:     reqParams.flowID,
+	output, err := p.d.Kratos.GetVerificationFlow(ctx, kratos.GetVerificationFlowInput{
+		Cookie:   reqParams.cookie,
+		ClientIP: clientIP(r),
+		FlowID:   reqParams.flowID,
 	})
 	if err != nil {
-		w.WriteHeader(http.StatusOK)
-		pkgVars.tmpl.ExecuteTemplate(w, "auth/verification/index.html", viewParameters(session, r, map[string]any{
+		p.render(w, r, http.StatusOK, "auth/verification/index.html", viewParameters(session, r, map[string]any{
 			"ErrorMessages": output.ErrorMessages,
 		}))
 		return
@@ -461,8 +490,7 @@ func (p *Provider) handleGetAuthVerification(w http.ResponseWriter, r *http.Requ
 	setCookieToResponseHeader(w, output.Cookies)
 
 	// 検証コード入力フォーム、もしくは既にVerification Flow が完了している旨のメッセージをレンダリング
-	w.WriteHeader(http.StatusOK)
-	pkgVars.tmpl.ExecuteTemplate(w, "auth/verification/index.html", viewParameters(session, r, map[string]any{
+	p.render(w, r, http.StatusOK, "auth/verification/index.html", viewParameters(session, r, map[string]any{
 		"VerificationFlowID": output.FlowID,
 		"CsrfToken":          output.CsrfToken,
 		"IsUsedFlow":         output.IsUsedFlow,
@@ -471,44 +499,44 @@ func (p *Provider) handleGetAuthVerification(w http.ResponseWriter, r *http.Requ
 
 // Handler GET /auth/verification/code handler
 type handleGetAuthVerificationCodeRequestParams struct {
-	cookie string
-	flowID string
+	cookie   string
+	flowID   string
+	returnTo string
 }
 
 func (p *Provider) handleGetAuthVerificationCode(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	session := getSession(ctx)
 	reqParams := handleGetAuthVerificationCodeRequestParams{
-		cookie: r.Header.Get("Cookie"),
-		flowID: r.URL.Query().Get("flow"),
+		cookie:   r.Header.Get("Cookie"),
+		flowID:   r.URL.Query().Get("flow"),
+		returnTo: p.getReturnTo(r),
 	}
 
 	// Verification flowを新規作成した場合は、FlowIDを含めてリダイレクト
 	if reqParams.flowID == "" {
-		output, err := p.d.Kratos.CreateVerificationFlow(kratos.CreateVerificationFlowInput{
-			Cookie:     reqParams.cookie,
-			RemoteAddr: r.RemoteAddr,
+		output, err := p.d.Kratos.CreateVerificationFlow(ctx, kratos.CreateVerificationFlowInput{
+			Cookie:   reqParams.cookie,
+			ClientIP: clientIP(r),
 		})
 		if err != nil {
-			w.WriteHeader(http.StatusOK)
-			pkgVars.tmpl.ExecuteTemplate(w, "auth/verification/code.html", viewParameters(session, r, map[string]any{
+			p.render(w, r, http.StatusOK, "auth/verification/code.html", viewParameters(session, r, map[string]any{
 				"ErrorMessages": output.ErrorMessages,
 			}))
 			return
 		}
-		redirect(w, r, fmt.Sprintf("%s?flow=%s", "/auth/registration", output.FlowID))
+		redirect(w, r, appendReturnTo(fmt.Sprintf("%s?flow=%s", "/auth/verification/code", output.FlowID), reqParams.returnTo))
 		return
 	}
 
 	// Verification Flow の作成 or 取得
-	output, err := p.d.Kratos.GetVerificationFlow(kratos.GetVerificationFlowInput{
-		Cookie:     reqParams.cookie,
-		RemoteAddr: r.RemoteAddr,
-		FlowID:     reqParams.flowID,
+	output, err := p.d.Kratos.GetVerificationFlow(ctx, kratos.GetVerificationFlowInput{
+		Cookie:   reqParams.cookie,
+		ClientIP: clientIP(r),
+		FlowID:   reqParams.flowID,
 	})
 	if err != nil {
-		w.WriteHeader(http.StatusOK)
-		pkgVars.tmpl.ExecuteTemplate(w, "auth/verification/index.html", viewParameters(session, r, map[string]any{
+		p.render(w, r, http.StatusOK, "auth/verification/index.html", viewParameters(session, r, map[string]any{
 			"ErrorMessages": output.ErrorMessages,
 		}))
 		return
@@ -518,11 +546,11 @@ func (p *Provider) handleGetAuthVerificationCode(w http.ResponseWriter, r *http.
 	setCookieToResponseHeader(w, output.Cookies)
 
 	// 検証コード入力フォーム、もしくは既にVerification Flow が完了している旨のメッセージをレンダリング
-	w.WriteHeader(http.StatusOK)
-	pkgVars.tmpl.ExecuteTemplate(w, "auth/verification/code.html", viewParameters(session, r, map[string]any{
+	p.render(w, r, http.StatusOK, "auth/verification/code.html", viewParameters(session, r, map[string]any{
 		"VerificationFlowID": output.FlowID,
 		"CsrfToken":          output.CsrfToken,
 		"IsUsedFlow":         output.IsUsedFlow,
+		"ReturnTo":           url.QueryEscape(reqParams.returnTo),
 	}))
 }
 
@@ -533,8 +561,8 @@ type handlePostVerificationEmailRequestParams struct {
 	email     string `validate:"required,email" ja:"メールアドレス"`
 }
 
-func (p *handlePostVerificationEmailRequestParams) validate() map[string]string {
-	fieldErrors := validationFieldErrors(pkgVars.validate.Struct(p))
+func (p *handlePostVerificationEmailRequestParams) validate(v *paramsValidator) map[string]string {
+	fieldErrors := v.fieldErrors(v.validate.Struct(p))
 	return fieldErrors
 }
 
@@ -547,9 +575,9 @@ func (p *Provider) handlePostVerificationEmail(w http.ResponseWriter, r *http.Re
 		csrfToken: r.PostFormValue("csrf_token"),
 		email:     r.PostFormValue("email"),
 	}
-	validationFieldErrors := reqParams.validate()
+	validationFieldErrors := reqParams.validate(p.validator)
 	if len(validationFieldErrors) > 0 {
-		pkgVars.tmpl.ExecuteTemplate(w, "auth/verification/_code_form.html", viewParameters(session, r, map[string]any{
+		p.render(w, r, http.StatusUnprocessableEntity, "auth/verification/_code_form.html", viewParameters(session, r, map[string]any{
 			"VerificationFlowID":   reqParams.flowID,
 			"CsrfToken":            reqParams.csrfToken,
 			"Email":                reqParams.email,
@@ -559,16 +587,15 @@ func (p *Provider) handlePostVerificationEmail(w http.ResponseWriter, r *http.Re
 	}
 
 	// Verification Flow 更新
-	output, err := p.d.Kratos.UpdateVerificationFlow(kratos.UpdateVerificationFlowInput{
-		Cookie:     r.Header.Get("Cookie"),
-		RemoteAddr: r.RemoteAddr,
-		FlowID:     reqParams.flowID,
-		CsrfToken:  reqParams.csrfToken,
-		Email:      reqParams.email,
+	output, err := p.d.Kratos.UpdateVerificationFlow(ctx, kratos.UpdateVerificationFlowInput{
+		Cookie:    r.Header.Get("Cookie"),
+		ClientIP:  clientIP(r),
+		FlowID:    reqParams.flowID,
+		CsrfToken: reqParams.csrfToken,
+		Email:     reqParams.email,
 	})
 	if err != nil {
-		w.WriteHeader(http.StatusOK)
-		pkgVars.tmpl.ExecuteTemplate(w, "auth/verification/_code_form.html", viewParameters(session, r, map[string]any{
+		p.render(w, r, http.StatusUnprocessableEntity, "auth/verification/_code_form.html", viewParameters(session, r, map[string]any{
 			"VerificationFlowID": reqParams.flowID,
 			"CsrfToken":          reqParams.csrfToken,
 			"ErrorMessages":      output.ErrorMessages,
@@ -576,11 +603,12 @@ func (p *Provider) handlePostVerificationEmail(w http.ResponseWriter, r *http.Re
 		return
 	}
 
+	p.metrics.verifications.WithLabelValues(METRICS_STEP_CODE_SENT).Inc()
+
 	// kratosのcookieをそのままブラウザへ受け渡す
 	setCookieToResponseHeader(w, output.Cookies)
 
-	w.WriteHeader(http.StatusOK)
-	pkgVars.tmpl.ExecuteTemplate(w, "auth/verification/_code_form.html", viewParameters(session, r, map[string]any{
+	p.render(w, r, http.StatusOK, "auth/verification/_code_form.html", viewParameters(session, r, map[string]any{
 		"VerificationFlowID": reqParams.flowID,
 		"CsrfToken":          reqParams.csrfToken,
 		"ErrorMessages":      output.ErrorMessages,
@@ -592,10 +620,11 @@ type handlePostVerificationCodeRequestParams struct {
 	flowID    string `validate:"uuid4"`
 	csrfToken string `validate:"required"`
 	code      string `validate:"required,len=6,number" ja:"検証コード"`
+	returnTo  string
 }
 
-func (p *handlePostVerificationCodeRequestParams) validate() map[string]string {
-	fieldErrors := validationFieldErrors(pkgVars.validate.Struct(p))
+func (p *handlePostVerificationCodeRequestParams) validate(v *paramsValidator) map[string]string {
+	fieldErrors := v.fieldErrors(v.validate.Struct(p))
 	return fieldErrors
 }
 
@@ -607,41 +636,46 @@ func (p *Provider) handlePostVerificationCode(w http.ResponseWriter, r *http.Req
 		flowID:    r.URL.Query().Get("flow"),
 		csrfToken: r.PostFormValue("csrf_token"),
 		code:      r.PostFormValue("code"),
+		returnTo:  p.getReturnTo(r),
 	}
-	validationFieldErrors := reqParams.validate()
+	validationFieldErrors := reqParams.validate(p.validator)
 	if len(validationFieldErrors) > 0 {
-		pkgVars.tmpl.ExecuteTemplate(w, "auth/verification/_code_form.html", viewParameters(session, r, map[string]any{
+		p.render(w, r, http.StatusUnprocessableEntity, "auth/verification/_code_form.html", viewParameters(session, r, map[string]any{
 			"VerificationFlowID":   reqParams.flowID,
 			"CsrfToken":            reqParams.csrfToken,
 			"Code":                 reqParams.code,
+			"ReturnTo":             url.QueryEscape(reqParams.returnTo),
 			"ValidationFieldError": validationFieldErrors,
 		}))
 		return
 	}
 
 	// Verification Flow 更新
-	output, err := p.d.Kratos.UpdateVerificationFlow(kratos.UpdateVerificationFlowInput{
-		Cookie:     r.Header.Get("Cookie"),
-		RemoteAddr: r.RemoteAddr,
-		FlowID:     reqParams.flowID,
-		Code:       reqParams.code,
-		CsrfToken:  reqParams.csrfToken,
+	output, err := p.d.Kratos.UpdateVerificationFlow(ctx, kratos.UpdateVerificationFlowInput{
+		Cookie:    r.Header.Get("Cookie"),
+		ClientIP:  clientIP(r),
+		FlowID:    reqParams.flowID,
+		Code:      reqParams.code,
+		CsrfToken: reqParams.csrfToken,
 	})
 	if err != nil {
-		w.WriteHeader(http.StatusOK)
-		pkgVars.tmpl.ExecuteTemplate(w, "auth/verification/_code_form.html", viewParameters(session, r, map[string]any{
+		p.render(w, r, http.StatusUnprocessableEntity, "auth/verification/_code_form.html", viewParameters(session, r, map[string]any{
 			"VerificationFlowID": reqParams.flowID,
 			"CsrfToken":          reqParams.csrfToken,
+			"ReturnTo":           url.QueryEscape(reqParams.returnTo),
 			"ErrorMessages":      output.ErrorMessages,
 		}))
 		return
 	}
 
+	p.metrics.verifications.WithLabelValues(METRICS_STEP_COMPLETED).Inc()
+
 	// kratosのcookieをそのままブラウザへ受け渡す
 	setCookieToResponseHeader(w, output.Cookies)
 
 	// Loign 画面へリダイレクト
-	redirect(w, r, "/auth/login")
+	p.addFlash(w, r, FLASH_TYPE_SUCCESS, "メールアドレスの確認が完了しました。ログインしてください。")
+	redirect(w, r, appendReturnTo("/auth/login", reqParams.returnTo))
 }
 
 // ------------------------- Authentication Login -------------------------
@@ -665,46 +699,43 @@ func (p *Provider) handleGetAuthLogin(w http.ResponseWriter, r *http.Request) {
 	// プロフィール設定時に認証時刻が一定期間内である必要があり、過ぎている場合はログイン画面へリダイレクトし、ログインを促している
 	refresh := isAuthenticated(session)
 
-	returnTo := url.QueryEscape(r.URL.Query().Get("return_to"))
+	returnTo := p.getReturnTo(r)
 
 	// Login flowを新規作成した場合は、FlowIDを含めてリダイレクト
 	if reqParams.flowID == "" {
-		output, err := p.d.Kratos.CreateLoginFlow(kratos.CreateLoginFlowInput{
-			Cookie:     reqParams.cookie,
-			RemoteAddr: r.RemoteAddr,
-			Refresh:    refresh,
+		output, err := p.d.Kratos.CreateLoginFlow(ctx, kratos.CreateLoginFlowInput{
+			Cookie:   reqParams.cookie,
+			ClientIP: clientIP(r),
+			Refresh:  refresh,
 		})
 		if err != nil {
-			pkgVars.tmpl.ExecuteTemplate(w, "auth/login/index.html", viewParameters(session, r, map[string]any{
+			p.render(w, r, http.StatusOK, "auth/login/index.html", viewParameters(session, r, map[string]any{
 				"ErrorMessages": output.ErrorMessages,
 			}))
 			return
 		}
 
-		slog.Info(fmt.Sprintf("%v", output))
 		// Login flowを新規作成した場合は、FlowIDを含めてリダイレクト
 		// return_to
 		//   指定時: ログイン後にreturn_toで指定されたURLへリダイレクト
 		//   未指定時: ログイン後にホーム画面へリダイレクト
-		var redirectTo string
-		if returnTo == "" {
-			redirectTo = fmt.Sprintf("%s?flow=%s", "/auth/login", output.FlowID)
-		} else {
-			redirectTo = fmt.Sprintf("%s?flow=%s&return_to=%s", "/auth/login", output.FlowID, returnTo)
-		}
-		redirect(w, r, redirectTo)
+		redirect(w, r, appendReturnTo(fmt.Sprintf("%s?flow=%s", "/auth/login", output.FlowID), returnTo))
 		return
 	}
 
 	// Login Flow の 取得
-	output, err := p.d.Kratos.GetLoginFlow(kratos.GetLoginFlowInput{
-		Cookie:     reqParams.cookie,
-		RemoteAddr: r.RemoteAddr,
-		FlowID:     reqParams.flowID,
+	output, err := p.d.Kratos.GetLoginFlow(ctx, kratos.GetLoginFlowInput{
+		Cookie:   reqParams.cookie,
+		ClientIP: clientIP(r),
+		FlowID:   reqParams.flowID,
 	})
+	// 有効期限切れの場合は、新しい flow を作成する
+	if errors.Is(err, kratos.ErrFlowExpired) {
+		p.redirectToNewFlow(w, r)
+		return
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusOK)
-		pkgVars.tmpl.ExecuteTemplate(w, "auth/login/index.html", viewParameters(session, r, map[string]any{
+		p.render(w, r, http.StatusOK, "auth/login/index.html", viewParameters(session, r, map[string]any{
 			"ErrorMessages": output.ErrorMessages,
 		}))
 		return
@@ -722,16 +753,11 @@ func (p *Provider) handleGetAuthLogin(w http.ResponseWriter, r *http.Request) {
 	// kratosのcookieをそのままブラウザへ受け渡す
 	setCookieToResponseHeader(w, output.Cookies)
 
-	if existsAfterLoginHook(r, AFTER_LOGIN_HOOK_COOKIE_KEY_SETTINGS_PROFILE_UPDATE) {
-		information = "プロフィール更新のために、再度ログインをお願いします。"
-	}
-
-	slog.Info("ShowSocialLogin", showSocialLogin)
+	slog.Info("ShowSocialLogin", "showSocialLogin", showSocialLogin)
 
-	w.WriteHeader(http.StatusOK)
-	pkgVars.tmpl.ExecuteTemplate(w, "auth/login/index.html", viewParameters(session, r, map[string]any{
+	p.render(w, r, http.StatusOK, "auth/login/index.html", viewParameters(session, r, map[string]any{
 		"LoginFlowID":      output.FlowID,
-		"ReturnTo":         returnTo,
+		"ReturnTo":         url.QueryEscape(returnTo),
 		"Information":      information,
 		"CsrfToken":        output.CsrfToken,
 		"Traits":           traits,
@@ -748,8 +774,8 @@ type handlePostAuthLoginRequestParams struct {
 	password   string `validate:"required" ja:"パスワード"`
 }
 
-func (p *handlePostAuthLoginRequestParams) validate() map[string]string {
-	fieldErrors := validationFieldErrors(pkgVars.validate.Struct(p))
+func (p *handlePostAuthLoginRequestParams) validate(v *paramsValidator) map[string]string {
+	fieldErrors := v.fieldErrors(v.validate.Struct(p))
 	return fieldErrors
 }
 
@@ -763,10 +789,9 @@ func (p *Provider) handlePostAuthLogin(w http.ResponseWriter, r *http.Request) {
 		identifier: r.PostFormValue("identifier"),
 		password:   r.PostFormValue("password"),
 	}
-	validationFieldErrors := reqParams.validate()
+	validationFieldErrors := reqParams.validate(p.validator)
 	if len(validationFieldErrors) > 0 {
-		slog.Info(fmt.Sprintf("%v", validationFieldErrors))
-		pkgVars.tmpl.ExecuteTemplate(w, "auth/login/_form.html", viewParameters(session, r, map[string]any{
+		p.render(w, r, http.StatusUnprocessableEntity, "auth/login/_form.html", viewParameters(session, r, map[string]any{
 			"LoginFlowID":          reqParams.flowID,
 			"CsrfToken":            reqParams.csrfToken,
 			"Identifier":           reqParams.identifier,
@@ -777,50 +802,41 @@ func (p *Provider) handlePostAuthLogin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Login Flow 更新
-	output, err := p.d.Kratos.UpdateLoginFlow(kratos.UpdateLoginFlowInput{
+	output, err := p.d.Kratos.UpdateLoginFlow(ctx, kratos.UpdateLoginFlowInput{
 		Cookie:     r.Header.Get("Cookie"),
-		RemoteAddr: r.RemoteAddr,
+		ClientIP:   clientIP(r),
 		FlowID:     reqParams.flowID,
 		CsrfToken:  reqParams.csrfToken,
 		Identifier: reqParams.identifier,
 		Password:   reqParams.password,
 	})
+	// 有効期限切れの場合は、メールアドレスを引き継いで新しい flow のフォームを表示する
+	if errors.Is(err, kratos.ErrFlowExpired) && p.renderFormWithNewFlow(w, r, FLOW_TYPE_LOGIN, "auth/login/_form.html", p.loginFormWithNewFlow(r, reqParams.identifier)) {
+		return
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusOK)
-		pkgVars.tmpl.ExecuteTemplate(w, "auth/login/_form.html", viewParameters(session, r, map[string]any{
+		p.metrics.logins.WithLabelValues("password", METRICS_RESULT_FAILURE).Inc()
+		p.render(w, r, http.StatusUnprocessableEntity, "auth/login/_form.html", viewParameters(session, r, map[string]any{
 			"LoginFlowID":   reqParams.flowID,
 			"CsrfToken":     reqParams.csrfToken,
 			"ErrorMessages": output.ErrorMessages,
 		}))
 		return
 	}
+	p.metrics.logins.WithLabelValues("password", METRICS_RESULT_SUCCESS).Inc()
+	// ログイン済みの場合は、再認証(privileged session の更新)の完了
+	if isAuthenticated(session) {
+		p.metrics.stepUps.WithLabelValues(METRICS_RESULT_COMPLETED).Inc()
+	}
 
 	// kratosのcookieをそのままブラウザへ受け渡す
 	setCookieToResponseHeader(w, output.Cookies)
 
-	// ログインフック実行
-	hook, err := loadAfterLoginHook(r, AFTER_LOGIN_HOOK_COOKIE_KEY_SETTINGS_PROFILE_UPDATE)
-	if err != nil {
-		slog.Error(err.Error())
-		return
-	}
-	if hook.Operation == AFTER_LOGIN_HOOK_OPERATION_UPDATE_PROFILE {
-		hookParams, _ := hook.Params.(map[string]interface{})
-		birthdate, _ := time.Parse(pkgVars.birthdateFormat, hookParams["birthdate"].(string))
-		err := p.updateProfile(w, r, updateProfileParams{
-			FlowID:    hookParams["flow_id"].(string),
-			Email:     hookParams["email"].(string),
-			Nickname:  hookParams["nickname"].(string),
-			Birthdate: birthdate,
-		})
-		if err != nil {
-			slog.Error(err.Error())
-			return
-		}
-	}
+	// ログインフックは、ログイン後の最初のリクエストで executeAfterLoginHook により実行される
 
 	// return_to 指定時はreturn_toへリダイレクト
-	returnTo := r.URL.Query().Get("return_to")
+	// 許可されていない return_to は無視してホーム画面へリダイレクト
+	returnTo := p.getReturnTo(r)
 	slog.Info(returnTo)
 	var redirectTo string
 	if returnTo != "" {
@@ -838,8 +854,8 @@ type handlePostAuthLoginOidcRequestParams struct {
 	provider  string `validate:"required"`
 }
 
-func (p *handlePostAuthLoginOidcRequestParams) validate() map[string]string {
-	fieldErrors := validationFieldErrors(pkgVars.validate.Struct(p))
+func (p *handlePostAuthLoginOidcRequestParams) validate(v *paramsValidator) map[string]string {
+	fieldErrors := v.fieldErrors(v.validate.Struct(p))
 	return fieldErrors
 }
 
@@ -852,11 +868,9 @@ func (p *Provider) handlePostAuthLoginOidc(w http.ResponseWriter, r *http.Reques
 		csrfToken: r.PostFormValue("csrf_token"),
 		provider:  r.PostFormValue("provider"),
 	}
-	slog.Info(fmt.Sprintf("%v", reqParams))
-	validationFieldErrors := reqParams.validate()
+	validationFieldErrors := reqParams.validate(p.validator)
 	if len(validationFieldErrors) > 0 {
-		slog.Info(fmt.Sprintf("%v", validationFieldErrors))
-		pkgVars.tmpl.ExecuteTemplate(w, "auth/login/_form.html", viewParameters(session, r, map[string]any{
+		p.render(w, r, http.StatusUnprocessableEntity, "auth/login/_form.html", viewParameters(session, r, map[string]any{
 			"LoginFlowID":          reqParams.flowID,
 			"CsrfToken":            reqParams.csrfToken,
 			"ValidationFieldError": validationFieldErrors,
@@ -865,22 +879,27 @@ func (p *Provider) handlePostAuthLoginOidc(w http.ResponseWriter, r *http.Reques
 	}
 
 	// Login Flow 更新
-	output, err := p.d.Kratos.UpdateOidcLoginFlow(kratos.UpdateOidcLoginFlowInput{
-		Cookie:     r.Header.Get("Cookie"),
-		RemoteAddr: r.RemoteAddr,
-		FlowID:     reqParams.flowID,
-		CsrfToken:  reqParams.csrfToken,
-		Provider:   reqParams.provider,
+	output, err := p.d.Kratos.UpdateOidcLoginFlow(ctx, kratos.UpdateOidcLoginFlowInput{
+		Cookie:    r.Header.Get("Cookie"),
+		ClientIP:  clientIP(r),
+		FlowID:    reqParams.flowID,
+		CsrfToken: reqParams.csrfToken,
+		Provider:  reqParams.provider,
 	})
+	if errors.Is(err, kratos.ErrFlowExpired) && p.renderFormWithNewFlow(w, r, FLOW_TYPE_LOGIN, "auth/login/_form.html", p.loginFormWithNewFlow(r, "")) {
+		return
+	}
 	if err != nil && output.RedirectBrowserTo == "" {
-		w.WriteHeader(http.StatusOK)
-		pkgVars.tmpl.ExecuteTemplate(w, "auth/login/_form.html", viewParameters(session, r, map[string]any{
+		p.metrics.logins.WithLabelValues("oidc", METRICS_RESULT_FAILURE).Inc()
+		p.render(w, r, http.StatusUnprocessableEntity, "auth/login/_form.html", viewParameters(session, r, map[string]any{
 			"LoginFlowID":   reqParams.flowID,
 			"CsrfToken":     reqParams.csrfToken,
 			"ErrorMessages": output.ErrorMessages,
 		}))
 		return
 	}
+	// ログインの完了は、プロバイダでの認証後に Kratos で判定される
+	p.metrics.logins.WithLabelValues("oidc", METRICS_RESULT_REDIRECTED).Inc()
 
 	// kratosのcookieをそのままブラウザへ受け渡す
 	setCookieToResponseHeader(w, output.Cookies)
@@ -889,38 +908,59 @@ func (p *Provider) handlePostAuthLoginOidc(w http.ResponseWriter, r *http.Reques
 	redirect(w, r, output.RedirectBrowserTo)
 }
 
+// 有効期限切れの Login flow の代わりに作成した flow で表示する、ログインフォームの入力内容
+// パスワードは引き継がない
+func (p *Provider) loginFormWithNewFlow(r *http.Request, identifier string) map[string]any {
+	return map[string]any{
+		"ReturnTo":        url.QueryEscape(p.getReturnTo(r)),
+		"Traits":          kratos.Traits{Email: identifier},
+		"ShowSocialLogin": true,
+	}
+}
+
 // ------------------------- Authentication Logout -------------------------
 
 // Handler POST /auth/logout
 type handlePostAuthLogoutRequestParams struct {
-	cookie string
+	cookie   string
+	returnTo string
 }
 
 func (p *Provider) handlePostAuthLogout(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	session := getSession(ctx)
 	reqParams := handlePostAuthLogoutRequestParams{
-		cookie: r.Header.Get("Cookie"),
+		cookie:   r.Header.Get("Cookie"),
+		returnTo: p.getReturnTo(r),
 	}
+	if reqParams.returnTo == "" {
+		reqParams.returnTo = "/"
+	}
+	// セッションストアに保存している値を削除
+	p.deleteAfterLoginHook(ctx, session)
+
 	// Logout
-	_, err := p.d.Kratos.Logout(kratos.LogoutFlowInput{
-		Cookie:     reqParams.cookie,
-		RemoteAddr: r.RemoteAddr,
+	_, err := p.d.Kratos.Logout(ctx, kratos.LogoutFlowInput{
+		Cookie:   reqParams.cookie,
+		ClientIP: clientIP(r),
 	})
 	http.SetCookie(w, &http.Cookie{
-		Name:     pkgVars.cookieParams.SessionCookieName,
+		Name:     p.cookieParams.SessionCookieName,
 		Value:    "",
 		MaxAge:   -1,
-		Path:     pkgVars.cookieParams.Path,
-		Domain:   pkgVars.cookieParams.Domain,
-		Secure:   pkgVars.cookieParams.Secure,
+		Path:     p.cookieParams.Path,
+		Domain:   p.cookieParams.Domain,
+		Secure:   p.cookieParams.Secure,
 		HttpOnly: true,
 	})
 	if err != nil {
-		redirect(w, r, "/")
+		redirect(w, r, reqParams.returnTo)
 		w.WriteHeader(http.StatusOK)
 		return
 	}
 
-	redirect(w, r, "/")
+	p.addFlash(w, r, FLASH_TYPE_INFO, "ログアウトしました。")
+	redirect(w, r, reqParams.returnTo)
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -942,14 +982,13 @@ func (p *Provider) handleGetAuthRecovery(w http.ResponseWriter, r *http.Request)
 
 	// Recovery flowを新規作成した場合は、FlowIDを含めてリダイレクト
 	if reqParams.flowID == "" {
-		output, err := p.d.Kratos.CreateRecoveryFlow(kratos.CreateRecoveryFlowInput{
-			Cookie:     reqParams.cookie,
-			RemoteAddr: r.RemoteAddr,
-			FlowID:     reqParams.flowID,
+		output, err := p.d.Kratos.CreateRecoveryFlow(ctx, kratos.CreateRecoveryFlowInput{
+			Cookie:   reqParams.cookie,
+			ClientIP: clientIP(r),
+			FlowID:   reqParams.flowID,
 		})
 		if err != nil {
-			w.WriteHeader(http.StatusOK)
-			pkgVars.tmpl.ExecuteTemplate(w, "auth/recovery/index.html", viewParameters(session, r, map[string]any{
+			p.render(w, r, http.StatusOK, "auth/recovery/index.html", viewParameters(session, r, map[string]any{
 				"ErrorMessages": output.ErrorMessages,
 			}))
 			return
@@ -959,14 +998,18 @@ func (p *Provider) handleGetAuthRecovery(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Recovery Flow の 取得
-	output, err := p.d.Kratos.GetRecoveryFlow(kratos.GetRecoveryFlowInput{
-		Cookie:     reqParams.cookie,
-		RemoteAddr: r.RemoteAddr,
-		FlowID:     reqParams.flowID,
+	output, err := p.d.Kratos.GetRecoveryFlow(ctx, kratos.GetRecoveryFlowInput{
+		Cookie:   reqParams.cookie,
+		ClientIP: clientIP(r),
+		FlowID:   reqParams.flowID,
 	})
+	// 有効期限切れの場合は、新しい flow を作成する
+	if errors.Is(err, kratos.ErrFlowExpired) {
+		p.redirectToNewFlow(w, r)
+		return
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusOK)
-		pkgVars.tmpl.ExecuteTemplate(w, "auth/recovery/index.html", viewParameters(session, r, map[string]any{
+		p.render(w, r, http.StatusOK, "auth/recovery/index.html", viewParameters(session, r, map[string]any{
 			"ErrorMessages": output.ErrorMessages,
 		}))
 		return
@@ -976,7 +1019,7 @@ func (p *Provider) handleGetAuthRecovery(w http.ResponseWriter, r *http.Request)
 	setCookieToResponseHeader(w, output.Cookies)
 
 	// flowの情報に従ってレンダリング
-	pkgVars.tmpl.ExecuteTemplate(w, "auth/recovery/index.html", viewParameters(session, r, map[string]any{
+	p.render(w, r, http.StatusOK, "auth/recovery/index.html", viewParameters(session, r, map[string]any{
 		"RecoveryFlowID": output.FlowID,
 		"CsrfToken":      output.CsrfToken,
 	}))
@@ -989,8 +1032,8 @@ type handlePostAuthRecoveryEmailRequestParams struct {
 	email     string `validate:"required,email" ja:"メールアドレス"`
 }
 
-func (p *handlePostAuthRecoveryEmailRequestParams) validate() map[string]string {
-	fieldErrors := validationFieldErrors(pkgVars.validate.Struct(p))
+func (p *handlePostAuthRecoveryEmailRequestParams) validate(v *paramsValidator) map[string]string {
+	fieldErrors := v.fieldErrors(v.validate.Struct(p))
 	return fieldErrors
 }
 
@@ -1003,9 +1046,9 @@ func (p *Provider) handlePostAuthRecoveryEmail(w http.ResponseWriter, r *http.Re
 		csrfToken: r.PostFormValue("csrf_token"),
 		email:     r.PostFormValue("email"),
 	}
-	validationFieldErrors := reqParams.validate()
+	validationFieldErrors := reqParams.validate(p.validator)
 	if len(validationFieldErrors) > 0 {
-		pkgVars.tmpl.ExecuteTemplate(w, "auth/recovery/_code_form.html", viewParameters(session, r, map[string]any{
+		p.render(w, r, http.StatusUnprocessableEntity, "auth/recovery/_code_form.html", viewParameters(session, r, map[string]any{
 			"RecoveryFlowID":       reqParams.flowID,
 			"CsrfToken":            reqParams.csrfToken,
 			"Email":                reqParams.email,
@@ -1015,15 +1058,21 @@ func (p *Provider) handlePostAuthRecoveryEmail(w http.ResponseWriter, r *http.Re
 	}
 
 	// Recovery Flow 更新
-	output, err := p.d.Kratos.UpdateRecoveryFlow(kratos.UpdateRecoveryFlowInput{
-		Cookie:     r.Header.Get("Cookie"),
-		RemoteAddr: r.RemoteAddr,
-		FlowID:     reqParams.flowID,
-		CsrfToken:  reqParams.csrfToken,
-		Email:      reqParams.email,
+	output, err := p.d.Kratos.UpdateRecoveryFlow(ctx, kratos.UpdateRecoveryFlowInput{
+		Cookie:    r.Header.Get("Cookie"),
+		ClientIP:  clientIP(r),
+		FlowID:    reqParams.flowID,
+		CsrfToken: reqParams.csrfToken,
+		Email:     reqParams.email,
 	})
+	// 有効期限切れの場合は、メールアドレスを引き継いで新しい flow のフォームを表示する
+	if errors.Is(err, kratos.ErrFlowExpired) && p.renderFormWithNewFlow(w, r, FLOW_TYPE_RECOVERY, "auth/recovery/_email_form.html", map[string]any{
+		"Email": reqParams.email,
+	}) {
+		return
+	}
 	if err != nil {
-		pkgVars.tmpl.ExecuteTemplate(w, "auth/recovery/_code_form.html", viewParameters(session, r, map[string]any{
+		p.render(w, r, http.StatusUnprocessableEntity, "auth/recovery/_code_form.html", viewParameters(session, r, map[string]any{
 			"RecoveryFlowID": reqParams.flowID,
 			"CsrfToken":      reqParams.csrfToken,
 			"Email":          reqParams.email,
@@ -1032,11 +1081,13 @@ func (p *Provider) handlePostAuthRecoveryEmail(w http.ResponseWriter, r *http.Re
 		return
 	}
 
+	p.metrics.recoveries.WithLabelValues(METRICS_STEP_CODE_SENT).Inc()
+
 	// kratosのcookieをそのままブラウザへ受け渡す
 	setCookieToResponseHeader(w, output.Cookies)
 
 	// flowの情報に従ってレンダリング
-	pkgVars.tmpl.ExecuteTemplate(w, "auth/recovery/_code_form.html", viewParameters(session, r, map[string]any{
+	p.render(w, r, http.StatusOK, "auth/recovery/_code_form.html", viewParameters(session, r, map[string]any{
 		"RecoveryFlowID":           reqParams.flowID,
 		"CsrfToken":                reqParams.csrfToken,
 		"Email":                    reqParams.email,
@@ -1051,8 +1102,8 @@ type handlePostAuthRecoveryCodeRequestParams struct {
 	code      string `validate:"required,,len=6,number" ja:"復旧コード"`
 }
 
-func (p *handlePostAuthRecoveryCodeRequestParams) validate() map[string]string {
-	fieldErrors := validationFieldErrors(pkgVars.validate.Struct(p))
+func (p *handlePostAuthRecoveryCodeRequestParams) validate(v *paramsValidator) map[string]string {
+	fieldErrors := v.fieldErrors(v.validate.Struct(p))
 	return fieldErrors
 }
 
@@ -1065,9 +1116,9 @@ func (p *Provider) handlePostAuthRecoveryCode(w http.ResponseWriter, r *http.Req
 		csrfToken: r.PostFormValue("csrf_token"),
 		code:      r.PostFormValue("code"),
 	}
-	validationFieldErrors := reqParams.validate()
+	validationFieldErrors := reqParams.validate(p.validator)
 	if len(validationFieldErrors) > 0 {
-		pkgVars.tmpl.ExecuteTemplate(w, "auth/recovery/_code_form.html", viewParameters(session, r, map[string]any{
+		p.render(w, r, http.StatusUnprocessableEntity, "auth/recovery/_code_form.html", viewParameters(session, r, map[string]any{
 			"RecoveryFlowID":       reqParams.flowID,
 			"CsrfToken":            reqParams.csrfToken,
 			"Code":                 reqParams.code,
@@ -1077,15 +1128,19 @@ func (p *Provider) handlePostAuthRecoveryCode(w http.ResponseWriter, r *http.Req
 	}
 
 	// Recovery Flow 更新
-	output, err := p.d.Kratos.UpdateRecoveryFlow(kratos.UpdateRecoveryFlowInput{
-		Cookie:     r.Header.Get("Cookie"),
-		RemoteAddr: r.RemoteAddr,
-		FlowID:     reqParams.flowID,
-		CsrfToken:  reqParams.csrfToken,
-		Code:       reqParams.code,
+	output, err := p.d.Kratos.UpdateRecoveryFlow(ctx, kratos.UpdateRecoveryFlowInput{
+		Cookie:    r.Header.Get("Cookie"),
+		ClientIP:  clientIP(r),
+		FlowID:    reqParams.flowID,
+		CsrfToken: reqParams.csrfToken,
+		Code:      reqParams.code,
 	})
+	// 復旧コードは flow ごとに送信されるため、新しい flow でメールアドレスの入力からやり直してもらう
+	if errors.Is(err, kratos.ErrFlowExpired) && p.renderFormWithNewFlow(w, r, FLOW_TYPE_RECOVERY, "auth/recovery/_email_form.html", map[string]any{}, "有効期限が切れたため、もう一度メールアドレスを入力して復旧コードを受け取ってください。") {
+		return
+	}
 	if err != nil && output.RedirectBrowserTo == "" {
-		pkgVars.tmpl.ExecuteTemplate(w, "auth/recovery/_code_form.html", viewParameters(session, r, map[string]any{
+		p.render(w, r, http.StatusUnprocessableEntity, "auth/recovery/_code_form.html", viewParameters(session, r, map[string]any{
 			"RecoveryFlowID": reqParams.flowID,
 			"CsrfToken":      reqParams.csrfToken,
 			"Code":           reqParams.code,
@@ -1094,8 +1149,64 @@ func (p *Provider) handlePostAuthRecoveryCode(w http.ResponseWriter, r *http.Req
 		return
 	}
 
+	p.metrics.recoveries.WithLabelValues(METRICS_STEP_COMPLETED).Inc()
+
 	// kratosのcookieをそのままブラウザへ受け渡す
 	setCookieToResponseHeader(w, output.Cookies)
 	redirect(w, r, fmt.Sprintf("%s&from=recovery", output.RedirectBrowserTo))
 	w.WriteHeader(http.StatusOK)
 }
+
+// ------------------------- Authentication Error -------------------------
+
+// Handler GET /auth/error
+// Kratos の selfservice.flows.error.ui_url としてリダイレクトされ、id で指定されたエラーを表示する
+type handleGetAuthErrorRequestParams struct {
+	cookie  string
+	errorID string
+}
+
+func (p *Provider) handleGetAuthError(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	session := getSession(ctx)
+	reqParams := handleGetAuthErrorRequestParams{
+		cookie:  r.Header.Get("Cookie"),
+		errorID: r.URL.Query().Get("id"),
+	}
+	if reqParams.errorID == "" {
+		p.renderError(w, r, http.StatusNotFound)
+		return
+	}
+
+	output, err := p.d.Kratos.GetFlowError(ctx, kratos.GetFlowErrorInput{
+		Cookie:   reqParams.cookie,
+		ClientIP: clientIP(r),
+		ErrorID:  reqParams.errorID,
+	})
+	if errors.Is(err, kratos.ErrFlowErrorNotFound) {
+		p.renderError(w, r, http.StatusNotFound, "エラーの詳細が見つかりませんでした。恐れ入りますが、もう一度最初からお試しください。")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to get flow error", "Error", err, "errorID", reqParams.errorID)
+		p.renderError(w, r, http.StatusInternalServerError)
+		return
+	}
+	slog.WarnContext(ctx, "kratos flow error",
+		"errorID", reqParams.errorID,
+		"id", output.ErrorID,
+		"statusCode", output.StatusCode,
+		"reason", output.Reason,
+	)
+
+	statusCode := output.StatusCode
+	if statusCode < 400 || statusCode > 599 {
+		statusCode = http.StatusInternalServerError
+	}
+	p.render(w, r, statusCode, ERROR_PAGE_TEMPLATE, viewParameters(session, r, map[string]any{
+		"Title":         errorTitle(statusCode),
+		"StatusCode":    statusCode,
+		"ErrorMessages": output.ErrorMessages,
+		"ErrorID":       reqParams.errorID,
+	}))
+}
@@ -7,7 +7,8 @@ import (
 )
 
 type item struct {
-	Name        string `json:"name"`
+	Name string `json:"name"`
+	// 静的ファイル(web/static)のファイル名 (テンプレートで static によりURLへ変換する)
 	Image       string `json:"image"`
 	Description string `json:"description"`
 	Link        string `json:"link"`
@@ -23,8 +24,8 @@ func (p *Provider) handleGetItemDetail(w http.ResponseWriter, r *http.Request) {
 	session := getSession(ctx)
 
 	itemID, err := strconv.Atoi(r.PathValue("id"))
-	if err != nil {
-		http.Error(w, "Invalid item id", http.StatusBadRequest)
+	if err != nil || itemID < 0 || itemID >= len(items) {
+		p.renderError(w, r, http.StatusNotFound)
 		return
 	}
 	reqParams := handleGetItemDertailRequestPostForm{
@@ -32,7 +33,7 @@ func (p *Provider) handleGetItemDetail(w http.ResponseWriter, r *http.Request) {
 	}
 
 	item := items[reqParams.itemID]
-	pkgVars.tmpl.ExecuteTemplate(w, "item/detail.html", viewParameters(session, r, map[string]any{
+	p.render(w, r, http.StatusOK, "item/detail.html", viewParameters(session, r, map[string]any{
 		"ItemID":      itemID,
 		"Image":       item.Image,
 		"Name":        item.Name,
@@ -46,8 +47,8 @@ func (p *Provider) handleGetItemPurchase(w http.ResponseWriter, r *http.Request)
 	session := getSession(ctx)
 
 	itemID, err := strconv.Atoi(r.PathValue("id"))
-	if err != nil {
-		http.Error(w, "Invalid item id", http.StatusBadRequest)
+	if err != nil || itemID < 0 || itemID >= len(items) {
+		p.renderError(w, r, http.StatusNotFound)
 		return
 	}
 	reqParams := handleGetItemDertailRequestPostForm{
@@ -61,15 +62,8 @@ func (p *Provider) handleGetItemPurchase(w http.ResponseWriter, r *http.Request)
 		"Price":  item.Price,
 	}
 
-	if isAuthenticated(session) {
-		if r.Header.Get("HX-Request") == "true" {
-			pkgVars.tmpl.ExecuteTemplate(w, "item/_purchase.html", viewParameters(session, r, viewParams))
-		} else {
-			pkgVars.tmpl.ExecuteTemplate(w, "item/purchase.html", viewParameters(session, r, viewParams))
-		}
-	} else {
-		pkgVars.tmpl.ExecuteTemplate(w, "item/_purchase_without_auth.html", viewParameters(session, r, viewParams))
-	}
+	// 商品詳細画面からの htmx によるリクエストの場合は、購入の確認部分のみ返却する
+	p.render(w, r, http.StatusOK, "item/purchase.html", viewParameters(session, r, viewParams))
 }
 
 func (p *Provider) handlePostItemPurchase(w http.ResponseWriter, r *http.Request) {
@@ -77,8 +71,8 @@ func (p *Provider) handlePostItemPurchase(w http.ResponseWriter, r *http.Request
 	session := getSession(ctx)
 
 	itemID, err := strconv.Atoi(r.PathValue("id"))
-	if err != nil {
-		http.Error(w, "Invalid item id", http.StatusBadRequest)
+	if err != nil || itemID < 0 || itemID >= len(items) {
+		p.renderError(w, r, http.StatusNotFound)
 		return
 	}
 	reqParams := handleGetItemDertailRequestPostForm{
@@ -95,5 +89,5 @@ func (p *Provider) handlePostItemPurchase(w http.ResponseWriter, r *http.Request
 		"Price":  item.Price,
 	}
 
-	pkgVars.tmpl.ExecuteTemplate(w, "item/_purchase_complete.html", viewParameters(session, r, viewParams))
+	p.render(w, r, http.StatusOK, "item/_purchase_complete.html", viewParameters(session, r, viewParams))
 }
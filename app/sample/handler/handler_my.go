@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"errors"
 	"fmt"
 	"kratos_example/kratos"
 	"log/slog"
@@ -11,8 +12,9 @@ import (
 
 // Handler GET /my/password
 type handleGetMyPasswordRequestParams struct {
-	cookie string
-	flowID string
+	cookie   string
+	flowID   string
+	returnTo string
 }
 
 func (p *Provider) handleGetMyPassword(w http.ResponseWriter, r *http.Request) {
@@ -20,33 +22,41 @@ func (p *Provider) handleGetMyPassword(w http.ResponseWriter, r *http.Request) {
 	session := getSession(ctx)
 
 	reqParams := handleGetMyPasswordRequestParams{
-		cookie: r.Header.Get("Cookie"),
-		flowID: r.URL.Query().Get("flow"),
+		cookie:   r.Header.Get("Cookie"),
+		flowID:   r.URL.Query().Get("flow"),
+		returnTo: p.getReturnTo(r),
 	}
 
 	// Setting flowを新規作成した場合は、FlowIDを含めてリダイレクト
 	if reqParams.flowID == "" {
-		output, err := p.d.Kratos.CreateSettingsFlow(kratos.CreateSettingsFlowInput{
-			Cookie: reqParams.cookie,
-			FlowID: reqParams.flowID,
+		output, err := p.d.Kratos.CreateSettingsFlow(ctx, kratos.CreateSettingsFlowInput{
+			Cookie:   reqParams.cookie,
+			ClientIP: clientIP(r),
+			FlowID:   reqParams.flowID,
 		})
 		if err != nil {
-			pkgVars.tmpl.ExecuteTemplate(w, "my/password/index.html", viewParameters(session, r, map[string]any{
+			p.render(w, r, http.StatusOK, "my/password/index.html", viewParameters(session, r, map[string]any{
 				"ErrorMessages": output.ErrorMessages,
 			}))
 			return
 		}
-		redirect(w, r, fmt.Sprintf("%s?flow=%s", "/my/password", output.FlowID))
+		redirect(w, r, appendReturnTo(fmt.Sprintf("%s?flow=%s", "/my/password", output.FlowID), reqParams.returnTo))
 		return
 	}
 
 	// Setting Flow の作成 or 取得
-	output, err := p.d.Kratos.GetSettingsFlow(kratos.GetSettingsFlowInput{
-		Cookie: reqParams.cookie,
-		FlowID: reqParams.flowID,
+	output, err := p.d.Kratos.GetSettingsFlow(ctx, kratos.GetSettingsFlowInput{
+		Cookie:   reqParams.cookie,
+		ClientIP: clientIP(r),
+		FlowID:   reqParams.flowID,
 	})
+	// 有効期限切れの場合は、新しい flow を作成する
+	if errors.Is(err, kratos.ErrFlowExpired) {
+		p.redirectToNewFlow(w, r)
+		return
+	}
 	if err != nil {
-		pkgVars.tmpl.ExecuteTemplate(w, "my/password/index.html", viewParameters(session, r, map[string]any{
+		p.render(w, r, http.StatusOK, "my/password/index.html", viewParameters(session, r, map[string]any{
 			"ErrorMessages": output.ErrorMessages,
 		}))
 		return
@@ -56,9 +66,10 @@ func (p *Provider) handleGetMyPassword(w http.ResponseWriter, r *http.Request) {
 	setCookieToResponseHeader(w, output.Cookies)
 
 	// flowの情報に従ってレンダリング
-	pkgVars.tmpl.ExecuteTemplate(w, "my/password/index.html", viewParameters(session, r, map[string]any{
+	p.render(w, r, http.StatusOK, "my/password/index.html", viewParameters(session, r, map[string]any{
 		"SettingsFlowID":       output.FlowID,
 		"CsrfToken":            output.CsrfToken,
+		"ReturnTo":             url.QueryEscape(reqParams.returnTo),
 		"RedirectFromRecovery": reqParams.flowID == "recovery",
 	}))
 }
@@ -69,10 +80,11 @@ type handlePostMyPasswordRequestParams struct {
 	csrfToken            string `validate:"required"`
 	password             string `validate:"required" ja:"パスワード"`
 	passwordConfirmation string `validate:"required" ja:"パスワード確認"`
+	returnTo             string
 }
 
-func (p *handlePostMyPasswordRequestParams) validate() map[string]string {
-	fieldErrors := validationFieldErrors(pkgVars.validate.Struct(p))
+func (p *handlePostMyPasswordRequestParams) validate(v *paramsValidator) map[string]string {
+	fieldErrors := v.fieldErrors(v.validate.Struct(p))
 	if p.password != p.passwordConfirmation {
 		fieldErrors["Password"] = "パスワードとパスワード確認が一致しません"
 	}
@@ -89,42 +101,57 @@ func (p *Provider) handlePostMyPassword(w http.ResponseWriter, r *http.Request)
 		csrfToken:            r.PostFormValue("csrf_token"),
 		password:             r.PostFormValue("password"),
 		passwordConfirmation: r.PostFormValue("password-confirmation"),
+		returnTo:             p.getReturnTo(r),
 	}
-	validationFieldErrors := reqParams.validate()
+	validationFieldErrors := reqParams.validate(p.validator)
 	if len(validationFieldErrors) > 0 {
-		slog.Info(fmt.Sprintf("%v", validationFieldErrors))
-		pkgVars.tmpl.ExecuteTemplate(w, "my/password/_form.html", viewParameters(session, r, map[string]any{
+		p.render(w, r, http.StatusUnprocessableEntity, "my/password/_form.html", viewParameters(session, r, map[string]any{
 			"SettingsFlowID":       reqParams.flowID,
 			"CsrfToken":            reqParams.csrfToken,
 			"Password":             reqParams.password,
+			"ReturnTo":             url.QueryEscape(reqParams.returnTo),
 			"ValidationFieldError": validationFieldErrors,
 		}))
 		return
 	}
-	slog.Info(fmt.Sprintf("%v", reqParams))
 
 	// Setting Flow 更新
-	output, err := p.d.Kratos.UpdateSettingsFlow(kratos.UpdateSettingsFlowInput{
+	output, err := p.d.Kratos.UpdateSettingsFlow(ctx, kratos.UpdateSettingsFlowInput{
 		Cookie:    r.Header.Get("Cookie"),
+		ClientIP:  clientIP(r),
 		FlowID:    reqParams.flowID,
 		CsrfToken: reqParams.csrfToken,
 		Method:    "password",
 		Password:  reqParams.password,
 	})
+	// 有効期限切れの場合は、新しい flow のフォームを表示する (パスワードは引き継がない)
+	if errors.Is(err, kratos.ErrFlowExpired) && p.renderFormWithNewFlow(w, r, FLOW_TYPE_SETTINGS, "my/password/_form.html", map[string]any{
+		"ReturnTo": url.QueryEscape(reqParams.returnTo),
+	}) {
+		return
+	}
 	if err != nil {
 		slog.Info(err.Error())
-		pkgVars.tmpl.ExecuteTemplate(w, "my/password/_form.html", viewParameters(session, r, map[string]any{
+		p.render(w, r, http.StatusUnprocessableEntity, "my/password/_form.html", viewParameters(session, r, map[string]any{
 			"SettingsFlowID": reqParams.flowID,
 			"CsrfToken":      reqParams.csrfToken,
 			"Password":       reqParams.password,
+			"ReturnTo":       url.QueryEscape(reqParams.returnTo),
 			"ErrorMessages":  output.ErrorMessages,
 		}))
+		return
 	}
 
 	// kratosのcookieをそのままブラウザへ受け渡す
 	setCookieToResponseHeader(w, output.Cookies)
+	p.addFlash(w, r, FLASH_TYPE_SUCCESS, "パスワードを変更しました。")
 
-	redirect(w, r, "/")
+	// return_to 指定時はreturn_toへリダイレクト
+	if reqParams.returnTo != "" {
+		redirect(w, r, reqParams.returnTo)
+	} else {
+		redirect(w, r, "/")
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -145,12 +172,13 @@ func (p *Provider) handleGetMyProfile(w http.ResponseWriter, r *http.Request) {
 
 	// Setting flowを新規作成した場合は、FlowIDを含めてリダイレクト
 	if reqParams.flowID == "" {
-		output, err := p.d.Kratos.CreateSettingsFlow(kratos.CreateSettingsFlowInput{
-			Cookie: reqParams.cookie,
-			FlowID: reqParams.flowID,
+		output, err := p.d.Kratos.CreateSettingsFlow(ctx, kratos.CreateSettingsFlowInput{
+			Cookie:   reqParams.cookie,
+			ClientIP: clientIP(r),
+			FlowID:   reqParams.flowID,
 		})
 		if err != nil {
-			pkgVars.tmpl.ExecuteTemplate(w, "my/profile/index.html", viewParameters(session, r, map[string]any{
+			p.render(w, r, http.StatusOK, "my/profile/index.html", viewParameters(session, r, map[string]any{
 				"ErrorMessages": output.ErrorMessages,
 			}))
 			return
@@ -160,12 +188,18 @@ func (p *Provider) handleGetMyProfile(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Setting Flow の作成 or 取得
-	output, err := p.d.Kratos.GetSettingsFlow(kratos.GetSettingsFlowInput{
-		Cookie: reqParams.cookie,
-		FlowID: reqParams.flowID,
+	output, err := p.d.Kratos.GetSettingsFlow(ctx, kratos.GetSettingsFlowInput{
+		Cookie:   reqParams.cookie,
+		ClientIP: clientIP(r),
+		FlowID:   reqParams.flowID,
 	})
+	// 有効期限切れの場合は、新しい flow を作成する
+	if errors.Is(err, kratos.ErrFlowExpired) {
+		p.redirectToNewFlow(w, r)
+		return
+	}
 	if err != nil {
-		pkgVars.tmpl.ExecuteTemplate(w, "my/profile/index.html", viewParameters(session, r, map[string]any{
+		p.render(w, r, http.StatusOK, "my/profile/index.html", viewParameters(session, r, map[string]any{
 			"ErrorMessages": output.ErrorMessages,
 		}))
 		return
@@ -175,20 +209,14 @@ func (p *Provider) handleGetMyProfile(w http.ResponseWriter, r *http.Request) {
 	setCookieToResponseHeader(w, output.Cookies)
 
 	// flowの情報に従ってレンダリング
-	var information string
-	if existsAfterLoginHook(r, AFTER_LOGIN_HOOK_COOKIE_KEY_SETTINGS_PROFILE_UPDATE) {
-		information = "プロフィールを更新しました。"
-		deleteAfterLoginHook(w, AFTER_LOGIN_HOOK_COOKIE_KEY_SETTINGS_PROFILE_UPDATE)
-	}
-	pkgVars.tmpl.ExecuteTemplate(w, "my/profile/index.html", viewParameters(session, r, map[string]any{
+	p.render(w, r, http.StatusOK, "my/profile/index.html", viewParameters(session, r, map[string]any{
 		"SettingsFlowID": output.FlowID,
 		"CsrfToken":      output.CsrfToken,
 		"Email":          session.Identity.Traits.Email,
 		"Firstname":      session.Identity.Traits.Firstname,
 		"Lastname":       session.Identity.Traits.Lastname,
 		"Nickname":       session.Identity.Traits.Nickname,
-		"Birthdate":      session.Identity.Traits.Birthdate.Format(pkgVars.birthdateFormat),
-		"Information":    information,
+		"Birthdate":      session.Identity.Traits.Birthdate.Format(p.birthdateFormat),
 	}))
 }
 
@@ -209,11 +237,12 @@ func (p *Provider) handleGetMyProfileEdit(w http.ResponseWriter, r *http.Request
 
 	// Setting flowを新規作成した場合は、FlowIDを含めてリダイレクト
 	if reqParams.flowID == "" {
-		output, err := p.d.Kratos.CreateSettingsFlow(kratos.CreateSettingsFlowInput{
-			Cookie: reqParams.cookie,
+		output, err := p.d.Kratos.CreateSettingsFlow(ctx, kratos.CreateSettingsFlowInput{
+			Cookie:   reqParams.cookie,
+			ClientIP: clientIP(r),
 		})
 		if err != nil {
-			pkgVars.tmpl.ExecuteTemplate(w, "my/profile/edit.html", viewParameters(session, r, map[string]any{
+			p.render(w, r, http.StatusOK, "my/profile/edit.html", viewParameters(session, r, map[string]any{
 				"ErrorMessages": output.ErrorMessages,
 			}))
 			return
@@ -222,12 +251,18 @@ func (p *Provider) handleGetMyProfileEdit(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	output, err := p.d.Kratos.GetSettingsFlow(kratos.GetSettingsFlowInput{
-		Cookie: reqParams.cookie,
-		FlowID: reqParams.flowID,
+	output, err := p.d.Kratos.GetSettingsFlow(ctx, kratos.GetSettingsFlowInput{
+		Cookie:   reqParams.cookie,
+		ClientIP: clientIP(r),
+		FlowID:   reqParams.flowID,
 	})
+	// 有効期限切れの場合は、新しい flow を作成する
+	if errors.Is(err, kratos.ErrFlowExpired) {
+		p.redirectToNewFlow(w, r)
+		return
+	}
 	if err != nil {
-		pkgVars.tmpl.ExecuteTemplate(w, "my/profile/edit.html", viewParameters(session, r, map[string]any{
+		p.render(w, r, http.StatusOK, "my/profile/edit.html", viewParameters(session, r, map[string]any{
 			"ErrorMessages": output.ErrorMessages,
 		}))
 		return
@@ -239,7 +274,7 @@ func (p *Provider) handleGetMyProfileEdit(w http.ResponseWriter, r *http.Request
 	// セッションから現在の値を取得
 	params := loadProfileFromSessionIfEmpty(updateProfileParams{}, session)
 
-	pkgVars.tmpl.ExecuteTemplate(w, "my/profile/edit.html", viewParameters(session, r, map[string]any{
+	p.render(w, r, http.StatusOK, "my/profile/edit.html", viewParameters(session, r, map[string]any{
 		"SettingsFlowID": output.FlowID,
 		"CsrfToken":      output.CsrfToken,
 		"Email":          params.Email,
@@ -263,11 +298,12 @@ func (p *Provider) handleGetMyProfileForm(w http.ResponseWriter, r *http.Request
 		cookie: r.Header.Get("Cookie"),
 	}
 
-	output, err := p.d.Kratos.CreateSettingsFlow(kratos.CreateSettingsFlowInput{
-		Cookie: reqParams.cookie,
+	output, err := p.d.Kratos.CreateSettingsFlow(ctx, kratos.CreateSettingsFlowInput{
+		Cookie:   reqParams.cookie,
+		ClientIP: clientIP(r),
 	})
 	if err != nil {
-		pkgVars.tmpl.ExecuteTemplate(w, "my/profile/_form.html", viewParameters(session, r, map[string]any{
+		p.render(w, r, http.StatusOK, "my/profile/_form.html", viewParameters(session, r, map[string]any{
 			"ErrorMessages": output.ErrorMessages,
 		}))
 		return
@@ -279,7 +315,7 @@ func (p *Provider) handleGetMyProfileForm(w http.ResponseWriter, r *http.Request
 	// セッションから現在の値を取得
 	params := loadProfileFromSessionIfEmpty(updateProfileParams{}, session)
 
-	pkgVars.tmpl.ExecuteTemplate(w, "my/profile/_form.html", viewParameters(session, r, map[string]any{
+	p.render(w, r, http.StatusOK, "my/profile/_form.html", viewParameters(session, r, map[string]any{
 		"SettingsFlowID": output.FlowID,
 		"CsrfToken":      output.CsrfToken,
 		"Email":          params.Email,
@@ -293,6 +329,7 @@ func (p *Provider) handleGetMyProfileForm(w http.ResponseWriter, r *http.Request
 // Handler POST /my/profile
 type handlePostMyProfileRequestPostForm struct {
 	cookie    string
+	returnTo  string
 	flowID    string `validate:"required,uuid4"`
 	csrfToken string `validate:"required"`
 	Email     string `validate:"required,email" ja:"メールアドレス"`
@@ -302,8 +339,8 @@ type handlePostMyProfileRequestPostForm struct {
 	Birthdate string `validate:"required,birthdate" ja:"生年月日"`
 }
 
-func (p *handlePostMyProfileRequestPostForm) validate() map[string]string {
-	fieldErrors := validationFieldErrors(pkgVars.validate.Struct(p))
+func (p *handlePostMyProfileRequestPostForm) validate(v *paramsValidator) map[string]string {
+	fieldErrors := v.fieldErrors(v.validate.Struct(p))
 	return fieldErrors
 }
 
@@ -314,6 +351,7 @@ func (p *Provider) handlePostMyProfile(w http.ResponseWriter, r *http.Request) {
 
 	reqParams := handlePostMyProfileRequestPostForm{
 		cookie:    r.Header.Get("Cookie"),
+		returnTo:  p.getReturnTo(r),
 		flowID:    r.URL.Query().Get("flow"),
 		csrfToken: r.PostFormValue("csrf_token"),
 		Email:     r.PostFormValue("email"),
@@ -322,9 +360,9 @@ func (p *Provider) handlePostMyProfile(w http.ResponseWriter, r *http.Request) {
 		Nickname:  r.PostFormValue("nickname"),
 		Birthdate: r.PostFormValue("birthdate"),
 	}
-	validationFieldErrors := reqParams.validate()
+	validationFieldErrors := reqParams.validate(p.validator)
 	if len(validationFieldErrors) > 0 {
-		pkgVars.tmpl.ExecuteTemplate(w, "my/profile/_form.html", viewParameters(session, r, map[string]any{
+		p.render(w, r, http.StatusUnprocessableEntity, "my/profile/_form.html", viewParameters(session, r, map[string]any{
 			"RegistrationFlowID":   reqParams.flowID,
 			"CsrfToken":            reqParams.csrfToken,
 			"Email":                reqParams.Email,
@@ -337,7 +375,7 @@ func (p *Provider) handlePostMyProfile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	birthdate, err := time.Parse(pkgVars.birthdateFormat, reqParams.Birthdate)
+	birthdate, err := time.Parse(p.birthdateFormat, reqParams.Birthdate)
 	if err != nil {
 		slog.Error(err.Error())
 	}
@@ -350,16 +388,17 @@ func (p *Provider) handlePostMyProfile(w http.ResponseWriter, r *http.Request) {
 		Birthdate: birthdate,
 	}, session)
 
-	deleteAfterLoginHook(w, AFTER_LOGIN_HOOK_COOKIE_KEY_SETTINGS_PROFILE_UPDATE)
-
 	// セッションが privileged_session_max_age を過ぎていた場合、ログイン画面へリダイレクト（再ログインの強制）
-	if session.NeedLoginWhenPrivilegedAccess() {
-		err := saveAfterLoginHook(w, afterLoginHook{
-			Operation: AFTER_LOGIN_HOOK_OPERATION_UPDATE_PROFILE,
-			Params:    params,
-		}, AFTER_LOGIN_HOOK_COOKIE_KEY_SETTINGS_PROFILE_UPDATE)
+	// 入力内容は Kratos へ送信せずに保存し、再ログイン後にサーバ側で取得した Kratos の csrf_token で送信するため、
+	// Kratos の csrf_token の代わりに、アプリのCSRFトークンを検証する
+	if session.NeedLoginWhenPrivilegedAccess(p.privilegedAccessLimit) {
+		if !verifyRequestCsrfToken(r) {
+			p.renderCsrfError(w, r)
+			return
+		}
+		err := p.saveAfterLoginHook(ctx, session, AFTER_LOGIN_HOOK_OPERATION_UPDATE_PROFILE, params)
 		if err != nil {
-			pkgVars.tmpl.ExecuteTemplate(w, "my/profile/_form.html", viewParameters(session, r, map[string]any{
+			p.render(w, r, http.StatusOK, "my/profile/_form.html", viewParameters(session, r, map[string]any{
 				"SettingsFlowID": reqParams.flowID,
 				"CsrfToken":      reqParams.csrfToken,
 				"ErrorMessages":  []string{"Error"},
@@ -370,18 +409,23 @@ func (p *Provider) handlePostMyProfile(w http.ResponseWriter, r *http.Request) {
 				"Birthdate":      params.Birthdate,
 			}))
 		} else {
-			returnTo := url.QueryEscape("/my/profile")
+			// ログイン後はフック実行結果を表示するため、Settings flow を指定してプロフィール画面へ戻す
+			returnTo := fmt.Sprintf("/my/profile?flow=%s", reqParams.flowID)
 			slog.Info(returnTo)
-			redirect(w, r, fmt.Sprintf("/auth/login?return_to=%s", returnTo))
+			// 再ログインが必要な理由を、ログイン画面に表示する
+			p.addFlash(w, r, FLASH_TYPE_INFO, p.afterLoginHooks[AFTER_LOGIN_HOOK_OPERATION_UPDATE_PROFILE].loginInformation)
+			redirect(w, r, appendReturnTo("/auth/login", returnTo))
 		}
 		return
 	}
 
 	// Settings Flow の送信(完了)
-	output, err := p.d.Kratos.UpdateSettingsFlow(kratos.UpdateSettingsFlowInput{
+	output, err := p.d.Kratos.UpdateSettingsFlow(ctx, kratos.UpdateSettingsFlowInput{
 		Cookie:    reqParams.cookie,
+		ClientIP:  clientIP(r),
 		FlowID:    reqParams.flowID,
 		CsrfToken: reqParams.csrfToken,
+		Method:    "profile",
 		Traits: kratos.Traits{
 			Email:     params.Email,
 			Firstname: params.Firstname,
@@ -390,9 +434,19 @@ func (p *Provider) handlePostMyProfile(w http.ResponseWriter, r *http.Request) {
 			Birthdate: params.Birthdate,
 		},
 	})
+	// 有効期限切れの場合は、入力内容を引き継いで新しい flow のフォームを表示する
+	if errors.Is(err, kratos.ErrFlowExpired) && p.renderFormWithNewFlow(w, r, FLOW_TYPE_SETTINGS, "my/profile/_form.html", map[string]any{
+		"Email":     params.Email,
+		"Firstname": params.Firstname,
+		"Lastname":  params.Lastname,
+		"Nickname":  params.Nickname,
+		"Birthdate": params.Birthdate,
+	}) {
+		return
+	}
 	if err != nil {
 		slog.Error(err.Error())
-		pkgVars.tmpl.ExecuteTemplate(w, "my/profile/_form.html", viewParameters(session, r, map[string]any{
+		p.render(w, r, http.StatusUnprocessableEntity, "my/profile/_form.html", viewParameters(session, r, map[string]any{
 			"CsrfToken":     reqParams.csrfToken,
 			"ErrorMessages": output.ErrorMessages,
 			"Email":         params.Email,
@@ -407,8 +461,35 @@ func (p *Provider) handlePostMyProfile(w http.ResponseWriter, r *http.Request) {
 	// kratosのcookieをそのままブラウザへ受け渡す
 	setCookieToResponseHeader(w, output.Cookies)
 
+	// return_to 指定時はreturn_toへリダイレクト
+	if reqParams.returnTo != "" {
+		redirect(w, r, reqParams.returnTo)
+		return
+	}
+
+	// htmx によるリクエストの場合は、フォームを更新後の値で表示し、ナビゲーションバーのニックネームを out-of-band swap で更新する
+	if r.Header.Get("HX-Request") == "true" {
+		updated := *session
+		updated.Identity.Traits = kratos.Traits{
+			Email:     params.Email,
+			Firstname: params.Firstname,
+			Lastname:  params.Lastname,
+			Nickname:  params.Nickname,
+			Birthdate: params.Birthdate,
+		}
+		p.addFlash(w, r, FLASH_TYPE_SUCCESS, "プロフィールを更新しました。")
+		p.render(w, r, http.StatusOK, "my/profile/_form.html", viewParameters(&updated, r, map[string]any{
+			"SettingsFlowID": reqParams.flowID,
+			"CsrfToken":      reqParams.csrfToken,
+			"Email":          params.Email,
+			"Firstname":      params.Firstname,
+			"Lastname":       params.Lastname,
+			"Nickname":       params.Nickname,
+			"Birthdate":      params.Birthdate.Format(p.birthdateFormat),
+		}), OOB_NAVBAR)
+		return
+	}
 	redirect(w, r, "/")
-	w.WriteHeader(http.StatusOK)
 }
 
 type updateProfileParams struct {
@@ -441,32 +522,36 @@ func loadProfileFromSessionIfEmpty(params updateProfileParams, session *kratos.S
 	return params
 }
 
-func (p *Provider) updateProfile(w http.ResponseWriter, r *http.Request, params updateProfileParams) error {
+// ログインフック(AFTER_LOGIN_HOOK_OPERATION_UPDATE_PROFILE)
+// 再ログイン前に入力されたプロフィールで、Settings Flow を送信(完了)する
+func (p *Provider) updateProfile(w http.ResponseWriter, r *http.Request, session *kratos.Session, params updateProfileParams) error {
 	ctx := r.Context()
-	session := getSession(ctx)
-
-	params = loadProfileFromSessionIfEmpty(updateProfileParams{
-		Email:     params.Email,
-		Firstname: params.Firstname,
-		Lastname:  params.Lastname,
-		Nickname:  params.Nickname,
-		Birthdate: params.Birthdate,
-	}, session)
+	params = loadProfileFromSessionIfEmpty(params, session)
 
-	output, err := p.d.Kratos.GetSettingsFlow(kratos.GetSettingsFlowInput{
-		Cookie: r.Header.Get("Cookie"),
-		FlowID: params.FlowID,
+	output, err := p.d.Kratos.GetSettingsFlow(ctx, kratos.GetSettingsFlowInput{
+		Cookie:   r.Header.Get("Cookie"),
+		ClientIP: clientIP(r),
+		FlowID:   params.FlowID,
 	})
+	// 再ログインの間に有効期限が切れた場合は、新しい flow で送信する
+	if errors.Is(err, kratos.ErrFlowExpired) {
+		var restarted restartFlowOutput
+		restarted, err = p.restartFlow(w, r, FLOW_TYPE_SETTINGS)
+		output.FlowID = restarted.flowID
+		output.CsrfToken = restarted.csrfToken
+	}
 	if err != nil {
 		slog.Error(err.Error())
 		return err
 	}
 
 	// Settings Flow の送信(完了)
-	updateOutput, err := p.d.Kratos.UpdateSettingsFlow(kratos.UpdateSettingsFlowInput{
+	updateOutput, err := p.d.Kratos.UpdateSettingsFlow(ctx, kratos.UpdateSettingsFlowInput{
 		Cookie:    r.Header.Get("Cookie"),
+		ClientIP:  clientIP(r),
 		FlowID:    output.FlowID,
 		CsrfToken: output.CsrfToken,
+		Method:    "profile",
 		Traits: kratos.Traits{
 			Email:     params.Email,
 			Firstname: params.Firstname,
@@ -482,6 +567,7 @@ func (p *Provider) updateProfile(w http.ResponseWriter, r *http.Request, params
 
 	// kratosのcookieをそのままブラウザへ受け渡す
 	setCookieToResponseHeader(w, updateOutput.Cookies)
+	p.addFlash(w, r, FLASH_TYPE_SUCCESS, "プロフィールを更新しました。")
 
 	return nil
 }
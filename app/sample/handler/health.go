@@ -0,0 +1,219 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kratos_example/kratos"
+	"kratos_example/store"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ヘルスチェック
+//
+// GET /livez  プロセスが応答できるか (失敗した場合は再起動する)。依存先は確認しない
+// GET /readyz リクエストを処理できるか (失敗した場合はロードバランサの振り分け先から外す)
+//   Kratos(Public, Admin)、ストア、テンプレート、設定の状態を確認し、依存先ごとの結果を JSON で返却する
+//   Kratos への問い合わせがプローブの頻度に比例して増えないよう、結果は HealthCheckParams.CacheTTL の間キャッシュする
+// GET /health 互換性のため残す (/livez と同じく依存先は確認しない)
+//
+// 終了処理(graceful shutdown)の開始後は、ロードバランサが新しいリクエストを振り分けないよう /readyz, /health は 503 を返却する
+// 処理中のリクエストは、サーバの Shutdown により完了を待つ
+
+const (
+	HEALTH_STATUS_OK   = "ok"
+	HEALTH_STATUS_FAIL = "fail"
+)
+
+type HealthCheckParams struct {
+	// /readyz の結果をキャッシュする期間 (0 の場合はキャッシュしない)
+	CacheTTL time.Duration
+	// 依存先ごとの確認のタイムアウト
+	Timeout time.Duration
+}
+
+// 画面の表示に必要なテンプレート (読み込まれていない場合は準備ができていないとする)
+var requiredTemplates = []string{
+	"top/index.html",
+	"auth/registration/index.html",
+	"auth/verification/index.html",
+	"auth/login/index.html",
+	"auth/recovery/index.html",
+	"my/profile/index.html",
+	"my/password/index.html",
+	"item/detail.html",
+	ERROR_PAGE_TEMPLATE,
+}
+
+// 認証なしで公開するため、エラーの内容(依存先のURL、ホスト名等)は含めず、ログにのみ出力する
+type healthCheckResult struct {
+	Status    string `json:"status"`
+	LatencyMs int64  `json:"latency_ms"`
+}
+
+type readinessResponse struct {
+	Status    string                       `json:"status"`
+	CheckedAt time.Time                    `json:"checked_at"`
+	Checks    map[string]healthCheckResult `json:"checks"`
+}
+
+type readinessCache struct {
+	mu       sync.Mutex
+	response readinessResponse
+}
+
+// 終了処理の開始を通知する (以降の /readyz, /health は失敗する)
+func (p *Provider) StartDraining() {
+	p.draining.Store(true)
+}
+
+// Handler GET /livez
+func (p *Provider) handleGetLivez(w http.ResponseWriter, r *http.Request) {
+	writeHealthResponse(w, http.StatusOK, map[string]string{"status": HEALTH_STATUS_OK})
+}
+
+// Handler GET /health
+func (p *Provider) handleGetHealth(w http.ResponseWriter, r *http.Request) {
+	if p.draining.Load() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Handler GET /readyz
+func (p *Provider) handleGetReadyz(w http.ResponseWriter, r *http.Request) {
+	if p.draining.Load() {
+		writeHealthResponse(w, http.StatusServiceUnavailable, readinessResponse{
+			Status:    HEALTH_STATUS_FAIL,
+			CheckedAt: time.Now(),
+			Checks: map[string]healthCheckResult{
+				"draining": {Status: HEALTH_STATUS_FAIL},
+			},
+		})
+		return
+	}
+
+	response := p.readiness(r.Context())
+	statusCode := http.StatusOK
+	if response.Status != HEALTH_STATUS_OK {
+		statusCode = http.StatusServiceUnavailable
+	}
+	writeHealthResponse(w, statusCode, response)
+}
+
+// 依存先の状態を確認する
+// キャッシュの期間内の場合は、前回の結果を返却する (確認中に届いたプローブは、確認の完了を待って同じ結果を返却する)
+func (p *Provider) readiness(ctx context.Context) readinessResponse {
+	p.readinessCache.mu.Lock()
+	defer p.readinessCache.mu.Unlock()
+
+	params := p.healthCheck
+	cached := p.readinessCache.response
+	if !cached.CheckedAt.IsZero() && time.Since(cached.CheckedAt) < params.CacheTTL {
+		return cached
+	}
+
+	checks := map[string]func(context.Context) error{
+		"kratos_public": func(ctx context.Context) error {
+			_, err := p.d.Kratos.HealthReady(ctx, kratos.HealthReadyInput{Admin: false})
+			return err
+		},
+		"kratos_admin": func(ctx context.Context) error {
+			_, err := p.d.Kratos.HealthReady(ctx, kratos.HealthReadyInput{Admin: true})
+			return err
+		},
+		"store":     p.checkStore,
+		"templates": func(context.Context) error { return p.checkTemplates() },
+		"config":    func(context.Context) error { return p.checkConfig() },
+	}
+
+	response := readinessResponse{
+		Status: HEALTH_STATUS_OK,
+		Checks: make(map[string]healthCheckResult, len(checks)),
+	}
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(context.Context) error) {
+			defer wg.Done()
+			// プローブのリクエストがキャンセルされても、キャッシュする結果は最後まで確認する
+			checkCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), params.Timeout)
+			defer cancel()
+
+			start := time.Now()
+			err := check(checkCtx)
+			result := healthCheckResult{
+				Status:    HEALTH_STATUS_OK,
+				LatencyMs: time.Since(start).Milliseconds(),
+			}
+			if err != nil {
+				slog.WarnContext(ctx, "readiness check failed", "check", name, "Error", err)
+				result.Status = HEALTH_STATUS_FAIL
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			response.Checks[name] = result
+			if err != nil {
+				response.Status = HEALTH_STATUS_FAIL
+			}
+		}(name, check)
+	}
+	wg.Wait()
+
+	response.CheckedAt = time.Now()
+	p.readinessCache.response = response
+	return response
+}
+
+// 存在しないキーを取得し、ストアに接続できるか確認する
+func (p *Provider) checkStore(ctx context.Context) error {
+	_, err := p.d.Store.Get(ctx, "health:readyz")
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+func (p *Provider) checkTemplates() error {
+	if p.tmpl == nil {
+		return errors.New("templates are not loaded")
+	}
+	for _, name := range requiredTemplates {
+		if p.tmpl.Lookup(name) == nil {
+			return fmt.Errorf("template is not loaded: %s", name)
+		}
+	}
+	return nil
+}
+
+// New により設定が読み込まれているか確認する
+func (p *Provider) checkConfig() error {
+	if p.validator == nil {
+		return errors.New("validator is not initialized")
+	}
+	if p.afterLoginHookBox == nil {
+		return errors.New("after login hook secrets are not configured")
+	}
+	if len(p.allowedReturnURLs) == 0 {
+		return errors.New("allowed return urls are not configured")
+	}
+	return nil
+}
+
+func writeHealthResponse(w http.ResponseWriter, statusCode int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error(err.Error())
+	}
+}
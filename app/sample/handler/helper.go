@@ -2,46 +2,24 @@ package handler
 
 import (
 	"context"
-	"fmt"
 	"kratos_example/kratos"
 	"log/slog"
 	"net/http"
-
-	"github.com/go-playground/validator/v10"
+	"net/url"
 )
 
+// コンテキストからセッションを取得
+// 未ログインの場合、セッションの有無を判定できない場合は nil を返却する (区別が必要な場合は SessionFromContext を使用する)
 func getSession(ctx context.Context) *kratos.Session {
-	session := ctx.Value("session")
-	if session == nil {
+	session, err := SessionFromContext(ctx)
+	if err != nil {
 		return nil
 	}
-
-	kratosSession, ok := session.(kratos.Session)
-	slog.Info(fmt.Sprintf("%v", ok))
-
-	slog.Info(fmt.Sprintf("%v", kratosSession))
-	return &kratosSession
+	return session
 }
 
 func isAuthenticated(session *kratos.Session) bool {
-	slog.Info(fmt.Sprintf("%v", session))
-	if session != nil {
-		return true
-	} else {
-		return false
-	}
-}
-
-func validationFieldErrors(err error) map[string]string {
-	if err == nil {
-		return map[string]string{}
-	}
-
-	fieldsErrors := make(map[string]string)
-	for _, err := range err.(validator.ValidationErrors) {
-		fieldsErrors[err.StructField()] = err.Translate(pkgVars.trans)
-	}
-	return fieldsErrors
+	return session != nil
 }
 
 func setCookieToResponseHeader(w http.ResponseWriter, cookies []string) {
@@ -62,11 +40,36 @@ func redirect(w http.ResponseWriter, r *http.Request, redirectTo string) {
 	}
 }
 
+// ログイン画面へリダイレクト
+// ログイン後に元の画面へ戻れるよう、return_to をエンコードして付与する
+func redirectToLogin(w http.ResponseWriter, r *http.Request) {
+	loginURL := url.URL{
+		Path:     "/auth/login",
+		RawQuery: url.Values{"return_to": []string{returnToFromRequest(r)}}.Encode(),
+	}
+	redirect(w, r, loginURL.String())
+}
+
+// ログイン後に戻る画面のURL(path + query)を取得
+// htmx によるリクエストや GET 以外のリクエストは、画面そのものではないため、ブラウザで表示中の画面(HX-Current-URL)へ戻す
+func returnToFromRequest(r *http.Request) string {
+	if r.Method == http.MethodGet && r.Header.Get("HX-Request") != "true" {
+		return r.URL.RequestURI()
+	}
+	currentURL, err := url.Parse(r.Header.Get("HX-Current-URL"))
+	if err != nil || currentURL.Path == "" {
+		return "/"
+	}
+	return currentURL.RequestURI()
+}
+
 func viewParameters(session *kratos.Session, r *http.Request, p map[string]any) map[string]any {
 	params := p
 	params["IsAuthenticated"] = isAuthenticated(session)
 	params["Navbar"] = getNavbarviewParameters(session)
 	params["CurrentPath"] = r.URL.Path
+	params["AppCsrfToken"] = csrfTokenFromContext(r.Context())
+	params["CspNonce"] = cspNonceFromContext(r.Context())
 	return params
 }
 
@@ -0,0 +1,46 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// トレーシング、メトリクス
+//
+// ルート(ServeMux のパターン)ごとにスパンを作成し、リクエスト数・レイテンシを記録する
+// リバースプロキシ等から traceparent ヘッダが送信された場合は、そのトレースを引き継ぐ
+
+// pattern は ServeMux に登録するパターン ("GET /item/{id}" 等)
+// スパン名、メトリクスのラベルには、パスパラメータの値を含まないよう、実際のパスではなくパターンを使用する
+func (p *Provider) instrument(pattern string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		_, route, _ := strings.Cut(pattern, " ")
+		ctx, span := p.tracer.Start(ctx, pattern,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.HTTPRoute(route),
+				semconv.URLPath(r.URL.Path),
+			),
+		)
+		defer span.End()
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		p.metrics.observeHTTPRequest(pattern, rec.statusCode(), time.Since(start))
+		span.SetAttributes(semconv.HTTPResponseStatusCode(rec.statusCode()))
+		if rec.statusCode() >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rec.statusCode()))
+		}
+	})
+}
@@ -1,90 +1,245 @@
 package handler
 
 import (
-	"encoding/base64"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"kratos_example/kratos"
 	"log/slog"
 	"net/http"
+	"sync"
+	"time"
 )
 
+// ログインフック
+//
+// 再ログイン(privileged session の更新など)が必要な操作を、ログイン後に継続して実行するための仕組み
+// 各ハンドラは、操作(operation)ごとに型付きのパラメータを受け取るフックを登録し、
+// 再ログインが必要な場合は saveAfterLoginHook でパラメータを保存してログイン画面へリダイレクトする
+// フックはセッションストアに保存するため、再ログイン(refresh)によりセッションIDが変わらないことを前提とする
+// 保存されたフックは、ログイン方式(password, oidc, passkey)に関わらず、ログイン後の最初のリクエストで
+// executeAfterLoginHook ミドルウェアにより実行され、削除される
+
+// ログインフックの有効期間
+const afterLoginHookLifetime = time.Hour
+
+// ログインフックを保存するセッションストアのキー
+const AFTER_LOGIN_HOOK_SESSION_KEY = "after_login_hook"
+
+var (
+	errAfterLoginHookExpired          = errors.New("after login hook is expired")
+	errAfterLoginHookIdentityMismatch = errors.New("after login hook identity mismatch")
+	errAfterLoginHookReplayed         = errors.New("after login hook is already consumed")
+	errAfterLoginHookNotRegistered    = errors.New("after login hook is not registered")
+)
+
+// ログインフック
+// ストア(ファイル, Redis等)上での漏洩、改ざんを防ぐため暗号化して保存し、フックを登録したユーザ(IdentityID)と有効期限に紐付ける
 type afterLoginHook struct {
-	Operation afterLoginHookOperation `json:"operation"`
-	Params    interface{}             `json:"params"`
+	ID         string                  `json:"id"`
+	IdentityID string                  `json:"identity_id"`
+	CreatedAt  time.Time               `json:"created_at"`
+	ExpiresAt  time.Time               `json:"expires_at"`
+	Operation  afterLoginHookOperation `json:"operation"`
+	Params     json.RawMessage         `json:"params"`
 }
 
 type afterLoginHookOperation string
 
 const (
-	AFTER_LOGIN_HOOK_OPERATION_UPDATE_PROFILE = "update_profile"
+	AFTER_LOGIN_HOOK_OPERATION_UPDATE_PROFILE = afterLoginHookOperation("update_profile")
 )
 
-type afterLoginHookCookieKey string
+// 登録済みのログインフック
+type registeredAfterLoginHook struct {
+	// ログイン画面に表示する、再ログインが必要な理由
+	loginInformation string
+	execute          func(w http.ResponseWriter, r *http.Request, session *kratos.Session, params json.RawMessage) error
+}
 
-const (
-	AFTER_LOGIN_HOOK_COOKIE_KEY_SETTINGS_PROFILE_UPDATE = "after_login_hook_settings_profile_update"
-)
+// ログインフックの登録
+func (p *Provider) registerAfterLoginHooks() {
+	registerAfterLoginHook(p, AFTER_LOGIN_HOOK_OPERATION_UPDATE_PROFILE, "プロフィール更新のために、再度ログインをお願いします。", p.updateProfile)
+}
 
-func saveAfterLoginHook(w http.ResponseWriter, loginHook afterLoginHook, cookieKey afterLoginHookCookieKey) error {
-	cookieString, err := json.Marshal(loginHook)
+// 型付きのパラメータを受け取るログインフックを登録する
+// パラメータは JSON として保存されるため、T は JSON へ変換可能な型とする
+func registerAfterLoginHook[T any](
+	p *Provider,
+	operation afterLoginHookOperation,
+	loginInformation string,
+	fn func(w http.ResponseWriter, r *http.Request, session *kratos.Session, params T) error,
+) {
+	if _, ok := p.afterLoginHooks[operation]; ok {
+		panic(fmt.Sprintf("after login hook is already registered: %s", operation))
+	}
+	p.afterLoginHooks[operation] = registeredAfterLoginHook{
+		loginInformation: loginInformation,
+		execute: func(w http.ResponseWriter, r *http.Request, session *kratos.Session, rawParams json.RawMessage) error {
+			var params T
+			if err := json.Unmarshal(rawParams, &params); err != nil {
+				return err
+			}
+			return fn(w, r, session, params)
+		},
+	}
+}
+
+// 実行済みのログインフックのID
+// 同時に送信されたリクエストにより、フックが複数回実行されることを防ぐ
+type consumedAfterLoginHooks struct {
+	mu  sync.Mutex
+	ids map[string]time.Time
+}
+
+// ログインフックを実行済みとして記録する
+// 既に実行済みの場合は false を返却する
+func (c *consumedAfterLoginHooks) consume(id string, expiresAt time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for consumedID, consumedExpiresAt := range c.ids {
+		if consumedExpiresAt.Before(now) {
+			delete(c.ids, consumedID)
+		}
+	}
+
+	if _, ok := c.ids[id]; ok {
+		return false
+	}
+	if c.ids == nil {
+		c.ids = make(map[string]time.Time)
+	}
+	c.ids[id] = expiresAt
+	return true
+}
+
+// ログインフックを保存する
+// 保存済みのフックがある場合は上書きする
+func (p *Provider) saveAfterLoginHook(ctx context.Context, session *kratos.Session, operation afterLoginHookOperation, params any) error {
+	if session == nil {
+		return errAfterLoginHookIdentityMismatch
+	}
+	if _, ok := p.afterLoginHooks[operation]; !ok {
+		return errAfterLoginHookNotRegistered
+	}
+
+	paramsBytes, err := json.Marshal(params)
 	if err != nil {
 		slog.Error(err.Error())
 		return err
 	}
-	base64CookieString := base64.URLEncoding.EncodeToString(cookieString)
-	http.SetCookie(w, &http.Cookie{
-		Name:     string(cookieKey),
-		Value:    base64CookieString,
-		MaxAge:   3600,
-		Path:     pkgVars.cookieParams.Path,
-		Domain:   pkgVars.cookieParams.Domain,
-		Secure:   pkgVars.cookieParams.Secure,
-		HttpOnly: true,
-	})
-	return nil
-}
 
-func existsAfterLoginHook(r *http.Request, cookieKey afterLoginHookCookieKey) bool {
-	_, err := r.Cookie(string(cookieKey))
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		slog.Error(err.Error())
+		return err
+	}
+	now := time.Now()
+	loginHook := afterLoginHook{
+		ID:         hex.EncodeToString(id),
+		IdentityID: session.Identity.ID,
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(afterLoginHookLifetime),
+		Operation:  operation,
+		Params:     paramsBytes,
+	}
+
+	hookBytes, err := json.Marshal(loginHook)
 	if err != nil {
-		// Cookieがない場合にエラーとはしない
-		slog.Info(err.Error())
-		return false
-	} else {
-		return true
+		slog.Error(err.Error())
+		return err
+	}
+	// ストアのキーを additional data とし、他の用途の値への流用を防ぐ
+	sealedHook, err := p.afterLoginHookBox.seal(hookBytes, []byte(AFTER_LOGIN_HOOK_SESSION_KEY))
+	if err != nil {
+		slog.Error(err.Error())
+		return err
 	}
+	return p.saveSessionValue(ctx, session, AFTER_LOGIN_HOOK_SESSION_KEY, sealedHook, afterLoginHookLifetime)
 }
 
-func loadAfterLoginHook(r *http.Request, cookieKey afterLoginHookCookieKey) (afterLoginHook, error) {
-	cookieString, err := r.Cookie(string(cookieKey))
-	if err != nil {
-		// Cookieがない場合にエラーとはしない
-		slog.Info(err.Error())
-		return afterLoginHook{}, nil
+// 保存されているログインフックを、実行済みとして記録せずに取得する
+// 復号できない場合や有効期限切れの場合は false を返却する
+func (p *Provider) peekAfterLoginHook(ctx context.Context, session *kratos.Session) (afterLoginHook, bool) {
+	var sealedHook string
+	ok, err := p.loadSessionValue(ctx, session, AFTER_LOGIN_HOOK_SESSION_KEY, &sealedHook)
+	if err != nil || !ok {
+		// 保存されていない場合にエラーとはしない
+		return afterLoginHook{}, false
 	}
-	cookieBytes, err := base64.URLEncoding.DecodeString(cookieString.Value)
+	hookBytes, err := p.afterLoginHookBox.open(sealedHook, []byte(AFTER_LOGIN_HOOK_SESSION_KEY))
 	if err != nil {
 		slog.Error(err.Error())
-		return afterLoginHook{}, err
+		return afterLoginHook{}, false
 	}
 
 	var hook afterLoginHook
-	err = json.Unmarshal(cookieBytes, &hook)
-	if err != nil {
+	if err := json.Unmarshal(hookBytes, &hook); err != nil {
 		slog.Error(err.Error())
-		return afterLoginHook{}, err
+		return afterLoginHook{}, false
+	}
+	if hook.ExpiresAt.Before(time.Now()) {
+		slog.Error(errAfterLoginHookExpired.Error(), "id", hook.ID)
+		return afterLoginHook{}, false
 	}
+	return hook, true
+}
 
-	return hook, nil
+// ログインフックの実行前に、ログインしたユーザ(session)とフックを登録したユーザが一致すること、
+// 実行済みでないことを検証し、実行済みとして記録する
+func (p *Provider) consumeAfterLoginHook(hook afterLoginHook, session *kratos.Session) error {
+	if session == nil || session.Identity.ID != hook.IdentityID {
+		slog.Error(errAfterLoginHookIdentityMismatch.Error(), "id", hook.ID)
+		return errAfterLoginHookIdentityMismatch
+	}
+	if !p.consumedAfterLoginHooks.consume(hook.ID, hook.ExpiresAt) {
+		slog.Error(errAfterLoginHookReplayed.Error(), "id", hook.ID)
+		return errAfterLoginHookReplayed
+	}
+	return nil
+}
+
+func (p *Provider) deleteAfterLoginHook(ctx context.Context, session *kratos.Session) {
+	p.deleteSessionValue(ctx, session, AFTER_LOGIN_HOOK_SESSION_KEY)
 }
 
-func deleteAfterLoginHook(w http.ResponseWriter, cookieKey afterLoginHookCookieKey) {
-	http.SetCookie(w, &http.Cookie{
-		Name:     string(cookieKey),
-		Value:    "",
-		MaxAge:   -1,
-		Path:     pkgVars.cookieParams.Path,
-		Domain:   pkgVars.cookieParams.Domain,
-		Secure:   pkgVars.cookieParams.Secure,
-		HttpOnly: true,
+// ログイン後の最初のリクエストで、保存されているログインフックを実行する
+// フック保存後にログイン(認証時刻の更新)が行われていない場合は、ログイン待ちとして実行しない
+// 実行後はセッション情報が更新されている可能性があるため、セッションを再取得する
+func (p *Provider) executeAfterLoginHook(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		session := getSession(ctx)
+
+		hook, ok := p.peekAfterLoginHook(ctx, session)
+		if !ok || !session.AuthenticatedAt.After(hook.CreatedAt) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// 実行の成否に関わらず、フックは一度だけ実行する
+		p.deleteAfterLoginHook(ctx, session)
+		if err := p.consumeAfterLoginHook(hook, session); err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		registered, ok := p.afterLoginHooks[hook.Operation]
+		if !ok {
+			slog.Error(errAfterLoginHookNotRegistered.Error(), "operation", hook.Operation)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err := registered.execute(w, r, session, hook.Params); err != nil {
+			slog.Error("after login hook failed", "operation", hook.Operation, "Error", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		p.setSession(next).ServeHTTP(w, r)
 	})
 }
@@ -0,0 +1,128 @@
+package handler
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// メトリクス
+//
+// ルートごとのリクエスト数・レイテンシと、認証のファネル(登録、検証、復旧、ログイン、再認証)、有効期限切れによる flow の作成し直し、Kratos の web_hook の受信の件数を記録する
+// ファネルの件数は、アプリで完了を判定できる箇所でのみ記録する
+// (OIDC 等、Kratos へリダイレクトした後に完了するものは、リダイレクトした件数を記録する)
+
+type metrics struct {
+	httpRequests           *prometheus.CounterVec
+	httpRequestDuration    *prometheus.HistogramVec
+	registrationsStarted   prometheus.Counter
+	registrationsCompleted *prometheus.CounterVec
+	verifications          *prometheus.CounterVec
+	recoveries             *prometheus.CounterVec
+	logins                 *prometheus.CounterVec
+	stepUps                *prometheus.CounterVec
+	flowRestarts           *prometheus.CounterVec
+	webhooks               *prometheus.CounterVec
+}
+
+// Provider ごとにメトリクスを生成する (同じプロセスで複数の Provider を生成した場合も、別の Registry に登録できるようにする)
+func newMetrics() *metrics {
+	return &metrics{
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "app",
+			Name:      "http_requests_total",
+			Help:      "HTTP requests by route and status code.",
+		}, []string{"route", "status_code"}),
+
+		httpRequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "app",
+			Name:      "http_request_duration_seconds",
+			Help:      "Latency of HTTP requests by route.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route"}),
+
+		registrationsStarted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "app",
+			Name:      "registrations_started_total",
+			Help:      "Registration flows created.",
+		}),
+
+		registrationsCompleted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "app",
+			Name:      "registrations_completed_total",
+			Help:      "Registration flows submitted successfully by method.",
+		}, []string{"method"}),
+
+		verifications: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "app",
+			Name:      "verifications_total",
+			Help:      "Verification flow steps (code_sent, completed).",
+		}, []string{"step"}),
+
+		recoveries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "app",
+			Name:      "recoveries_total",
+			Help:      "Recovery flow steps (code_sent, completed).",
+		}, []string{"step"}),
+
+		logins: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "app",
+			Name:      "logins_total",
+			Help:      "Login attempts by method and result (success, failure, redirected).",
+		}, []string{"method", "result"}),
+
+		stepUps: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "app",
+			Name:      "step_ups_total",
+			Help:      "Re-authentication of privileged sessions by result (required, completed).",
+		}, []string{"result"}),
+
+		flowRestarts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "app",
+			Name:      "flow_restarts_total",
+			Help:      "Self-service flows recreated after expiry by flow type.",
+		}, []string{"flow"}),
+
+		webhooks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "app",
+			Name:      "webhooks_total",
+			Help:      "Kratos web hooks received by event and result (success, failure, unauthorized).",
+		}, []string{"event", "result"}),
+	}
+}
+
+const (
+	METRICS_STEP_CODE_SENT = "code_sent"
+	METRICS_STEP_COMPLETED = "completed"
+
+	METRICS_RESULT_SUCCESS      = "success"
+	METRICS_RESULT_FAILURE      = "failure"
+	METRICS_RESULT_REDIRECTED   = "redirected"
+	METRICS_RESULT_REQUIRED     = "required"
+	METRICS_RESULT_COMPLETED    = "completed"
+	METRICS_RESULT_UNAUTHORIZED = "unauthorized"
+)
+
+// main で prometheus.Registry に登録する
+func (p *Provider) MetricsCollectors() []prometheus.Collector {
+	m := p.metrics
+	return []prometheus.Collector{
+		m.httpRequests,
+		m.httpRequestDuration,
+		m.registrationsStarted,
+		m.registrationsCompleted,
+		m.verifications,
+		m.recoveries,
+		m.logins,
+		m.stepUps,
+		m.flowRestarts,
+		m.webhooks,
+	}
+}
+
+// route は ServeMux に登録するパターン (パスパラメータの値によってラベルが増えないようにする)
+func (m *metrics) observeHTTPRequest(route string, statusCode int, duration time.Duration) {
+	m.httpRequests.WithLabelValues(route, strconv.Itoa(statusCode)).Inc()
+	m.httpRequestDuration.WithLabelValues(route).Observe(duration.Seconds())
+}
@@ -1,7 +1,7 @@
 package handler
 
 import (
-	"html/template"
+	"fmt"
 	"reflect"
 	"time"
 
@@ -11,16 +11,6 @@ import (
 	ja_translations "github.com/go-playground/validator/v10/translations/ja"
 )
 
-var pkgVars packageVariables
-
-type packageVariables struct {
-	tmpl            *template.Template
-	validate        *validator.Validate
-	trans           ut.Translator
-	cookieParams    CookieParams
-	birthdateFormat string
-}
-
 type CookieParams struct {
 	SessionCookieName string
 	Path              string
@@ -28,44 +18,78 @@ type CookieParams struct {
 	Secure            bool
 }
 
-type InitInput struct {
+type Config struct {
 	CookieParams    CookieParams
 	BirthdateFormat string
+	// セッションの認証から、再ログインなしでパスワード変更等を行える期間 (Kratos の privileged_session_max_age と同じ値を設定)
+	PrivilegedAccessLimit time.Duration
+	// return_to として許可するURL (kratos の selfservice.allowed_return_urls と同じ値を設定)
+	// 先頭のURLを相対パスの解決に使用する
+	AllowedReturnURLs []string
+	// ログインフックをセッションストアへ保存する際の暗号化に使用する secret
+	// 先頭の secret で暗号化し、復号は全ての secret で試行する (ローテーション時は新しい secret を先頭に追加する)
+	AfterLoginHookSecrets []string
+	// セキュリティ関連のレスポンスヘッダ (Content-Security-Policy 等)
+	SecurityHeaders SecurityHeadersParams
+	// エンドポイントごとのレート制限
+	RateLimitRules []RateLimitRule
+	// 信頼できるリバースプロキシ (IPアドレスもしくはCIDR)
+	// 接続元がこれらのアドレスの場合のみ、Forwarded / X-Forwarded-For ヘッダからクライアントのIPアドレスを取得する
+	TrustedProxies []string
+	// /readyz による依存先の確認
+	HealthCheck HealthCheckParams
+	// Kratos の web_hook の受信
+	Webhook WebhookParams
+	// 開発時に、テンプレート、静的ファイルを読み込むディレクトリ (templates, static を含むディレクトリ)
+	// 指定した場合は、テンプレートの変更を再起動なしで反映する (空の場合はバイナリに埋め込んだファイルを使用する)
+	DevAssetsDir string
 }
 
-func Init(i InitInput) {
-	loadTemplate()
-	initValidator()
-	pkgVars.cookieParams = i.CookieParams
-	pkgVars.birthdateFormat = i.BirthdateFormat
+// リクエストパラメータのバリデーション
+type paramsValidator struct {
+	validate *validator.Validate
+	trans    ut.Translator
 }
 
-func loadTemplate() {
-	pkgVars.tmpl = template.Must(template.New("").ParseGlob("templates/**/*.html"))
-	pkgVars.tmpl = template.Must(pkgVars.tmpl.ParseGlob("templates/**/**/*.html"))
-}
-
-func initValidator() {
+func newParamsValidator(birthdateFormat string) (*paramsValidator, error) {
 	ja := ja.New()
 	uni := ut.New(ja)
-	pkgVars.trans, _ = uni.GetTranslator("ja")
+	trans, _ := uni.GetTranslator("ja")
 
-	pkgVars.validate = validator.New(validator.WithRequiredStructEnabled())
-	pkgVars.validate.RegisterTagNameFunc(func(field reflect.StructField) string {
+	validate := validator.New(validator.WithRequiredStructEnabled())
+	validate.RegisterTagNameFunc(func(field reflect.StructField) string {
 		fieldName := field.Tag.Get("ja")
 		if fieldName == "-" {
 			return ""
 		}
 		return fieldName
 	})
-	err := ja_translations.RegisterDefaultTranslations(pkgVars.validate, pkgVars.trans)
+	if err := ja_translations.RegisterDefaultTranslations(validate, trans); err != nil {
+		return nil, err
+	}
+	err := validate.RegisterValidation("birthdate", func(fl validator.FieldLevel) bool {
+		_, err := time.Parse(birthdateFormat, fl.Field().String())
+		return err == nil
+	})
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("failed to register birthdate validation: %w", err)
 	}
-	pkgVars.validate.RegisterValidation("birthdate", validateBirthdate)
+
+	return &paramsValidator{
+		validate: validate,
+		trans:    trans,
+	}, nil
 }
 
-func validateBirthdate(fl validator.FieldLevel) bool {
-	_, err := time.Parse(pkgVars.birthdateFormat, fl.Field().String())
-	return err == nil
+// バリデーションエラーを、フィールドごとの日本語のエラーメッセージへ変換する
+func (v *paramsValidator) fieldErrors(err error) map[string]string {
+	if err == nil {
+		return map[string]string{}
+	}
+
+	fieldsErrors := make(map[string]string)
+	for _, err := range err.(validator.ValidationErrors) {
+		fieldsErrors[err.StructField()] = err.Translate(v.trans)
+	}
+	return fieldsErrors
 }
@@ -1,124 +1,328 @@
 package handler
 
 import (
-	"context"
-	"fmt"
+	"errors"
 	"kratos_example/kratos"
+	"kratos_example/ratelimit"
+	"kratos_example/store"
 	"log/slog"
 	"net/http"
-	"strings"
+	"net/netip"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Provider struct {
-	d Dependencies
+	d               Dependencies
+	afterLoginHooks map[afterLoginHookOperation]registeredAfterLoginHook
+	webhookHandlers map[webhookEvent][]webhookHandler
+
+	tmpl                  *templateSet
+	static                *staticAssets
+	validator             *paramsValidator
+	cookieParams          CookieParams
+	birthdateFormat       string
+	privilegedAccessLimit time.Duration
+	allowedReturnURLs     []*url.URL
+	securityHeadersParams SecurityHeadersParams
+	rateLimitRules        map[string]RateLimitRule
+	trustedProxies        []netip.Prefix
+	healthCheck           HealthCheckParams
+	webhookParams         WebhookParams
+
+	afterLoginHookBox       *secretBox
+	consumedAfterLoginHooks consumedAfterLoginHooks
+
+	appProfileMu sync.Mutex
+
+	// メトリクス、トレーシング (Provider ごとに生成する)
+	metrics *metrics
+	tracer  trace.Tracer
+
+	// 終了処理(graceful shutdown)中
+	draining       atomic.Bool
+	readinessCache readinessCache
 }
 
 type Dependencies struct {
 	Kratos *kratos.Provider
+	// Kratos のセッションごとのアプリの状態を保存するストア
+	Store store.Store
+	// レート制限 (nil の場合は制限しない)
+	Limiter ratelimit.Limiter
+	// /metrics で公開するメトリクス (nil の場合は公開しない)
+	MetricsGatherer prometheus.Gatherer
 }
 
 type NewInput struct {
 	Dependencies Dependencies
+	Config       Config
 }
 
 func New(i NewInput) (*Provider, error) {
+	tmpl, static, err := loadAssets(i.Config.DevAssetsDir)
+	if err != nil {
+		return nil, err
+	}
+	validator, err := newParamsValidator(i.Config.BirthdateFormat)
+	if err != nil {
+		return nil, err
+	}
+	allowedReturnURLs, err := loadAllowedReturnURLs(i.Config.AllowedReturnURLs)
+	if err != nil {
+		return nil, err
+	}
+	trustedProxies, err := loadTrustedProxies(i.Config.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	afterLoginHookBox, err := newSecretBox(i.Config.AfterLoginHookSecrets)
+	if err != nil {
+		return nil, err
+	}
+
 	p := Provider{
-		d: i.Dependencies,
+		d:                     i.Dependencies,
+		afterLoginHooks:       make(map[afterLoginHookOperation]registeredAfterLoginHook),
+		webhookHandlers:       make(map[webhookEvent][]webhookHandler),
+		tmpl:                  tmpl,
+		static:                static,
+		validator:             validator,
+		cookieParams:          i.Config.CookieParams,
+		birthdateFormat:       i.Config.BirthdateFormat,
+		privilegedAccessLimit: i.Config.PrivilegedAccessLimit,
+		allowedReturnURLs:     allowedReturnURLs,
+		securityHeadersParams: i.Config.SecurityHeaders,
+		rateLimitRules:        loadRateLimitRules(i.Config.RateLimitRules),
+		trustedProxies:        trustedProxies,
+		healthCheck:           i.Config.HealthCheck,
+		webhookParams:         i.Config.Webhook,
+		afterLoginHookBox:     afterLoginHookBox,
+		metrics:               newMetrics(),
+		tracer:                otel.Tracer("kratos_example/handler"),
 	}
+	p.registerAfterLoginHooks()
+	p.registerWebhookHandlers()
 	return &p, nil
 }
 
 func (p *Provider) RegisterHandles(mux *http.ServeMux) *http.ServeMux {
 	// Static files
-	fileServer := http.StripPrefix("/static/", http.FileServer(http.Dir("static")))
-	mux.HandleFunc("GET /static/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if strings.HasPrefix(r.URL.Path, "/static/") {
-			fileServer.ServeHTTP(w, r)
-		} else {
-			http.NotFound(w, r)
-		}
-	}))
+	mux.Handle("GET "+STATIC_PATH_PREFIX, p.static)
+
+	// ルートごとにスパンを作成し、メトリクスを記録する
+	handle := func(pattern string, handler http.Handler) {
+		mux.Handle(pattern, p.instrument(pattern, handler))
+	}
 
 	// health check
-	mux.Handle("GET /health", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-	}))
+	// プローブのたびにアクセスログが出力されないよう、ミドルウェアは使用しない
+	mux.Handle("GET /livez", http.HandlerFunc(p.handleGetLivez))
+	mux.Handle("GET /readyz", http.HandlerFunc(p.handleGetReadyz))
+	mux.Handle("GET /health", http.HandlerFunc(p.handleGetHealth))
+
+	// metrics
+	// 外部に公開しないよう、リバースプロキシ等で /metrics へのアクセスを制限すること
+	if p.d.MetricsGatherer != nil {
+		mux.Handle("GET /metrics", promhttp.HandlerFor(p.d.MetricsGatherer, promhttp.HandlerOpts{}))
+	}
+
+	// CSP violation report
+	// ブラウザから送信されるため、セッション、CSRFトークンの検証は行わない
+	handle("POST "+CSP_REPORT_PATH, p.loggingRquest(http.HandlerFunc(p.handlePostCspReport)))
+
+	// Kratos web_hook
+	// Kratos から送信されるため、セッション、CSRFトークンの検証、レート制限は行わず、API キーにより認証する
+	if len(p.webhookParams.APIKeys) > 0 {
+		handle("POST /webhooks/kratos/{event}", p.loggingRquest(p.recoverPanic(http.HandlerFunc(p.handlePostKratosWebhook))))
+	}
 
 	// Authentication Registration
-	mux.Handle("GET /auth/registration", p.baseMiddleware(p.handleGetAuthRegistration))
-	mux.Handle("GET /auth/registration/passkey", p.baseMiddleware(p.handleGetAuthRegistrationPasskey))
-	mux.Handle("POST /auth/registration", p.baseMiddleware(p.handlePostAuthRegistration))
-	mux.Handle("POST /auth/registration/oidc", p.baseMiddleware(p.handlePostAuthRegistrationOidc))
-	mux.Handle("POST /auth/registration/passkey", p.baseMiddleware(p.handlePostAuthRegistrationPasskey))
+	handle("GET /auth/registration", p.baseMiddleware(p.handleGetAuthRegistration))
+	handle("GET /auth/registration/passkey", p.baseMiddleware(p.handleGetAuthRegistrationPasskey))
+	handle("POST /auth/registration", p.kratosFlowMiddleware(p.handlePostAuthRegistration))
+	handle("POST /auth/registration/oidc", p.kratosFlowMiddleware(p.handlePostAuthRegistrationOidc))
+	handle("POST /auth/registration/passkey", p.kratosFlowMiddleware(p.handlePostAuthRegistrationPasskey))
 
 	// Authentication Verification
-	mux.Handle("GET /auth/verification", p.baseMiddleware(p.handleGetAuthVerification))
-	mux.Handle("GET /auth/verification/code", p.baseMiddleware(p.handleGetAuthVerificationCode))
-	mux.Handle("POST /auth/verification/email", p.baseMiddleware(p.handlePostVerificationEmail))
-	mux.Handle("POST /auth/verification/code", p.baseMiddleware(p.handlePostVerificationCode))
+	handle("GET /auth/verification", p.baseMiddleware(p.handleGetAuthVerification))
+	handle("GET /auth/verification/code", p.baseMiddleware(p.handleGetAuthVerificationCode))
+	handle("POST /auth/verification/email", p.kratosFlowMiddleware(p.handlePostVerificationEmail))
+	handle("POST /auth/verification/code", p.kratosFlowMiddleware(p.handlePostVerificationCode))
 
 	// Authentication Login
-	mux.Handle("GET /auth/login", p.baseMiddleware(p.handleGetAuthLogin))
-	mux.Handle("POST /auth/login", p.baseMiddleware(p.handlePostAuthLogin))
-	mux.Handle("POST /auth/login/oidc", p.baseMiddleware(p.handlePostAuthLoginOidc))
+	handle("GET /auth/login", p.baseMiddleware(p.handleGetAuthLogin))
+	handle("POST /auth/login", p.kratosFlowMiddleware(p.handlePostAuthLogin))
+	handle("POST /auth/login/oidc", p.kratosFlowMiddleware(p.handlePostAuthLoginOidc))
 
 	// Authentication Logout
-	mux.Handle("POST /auth/logout", p.baseMiddleware(p.handlePostAuthLogout))
+	handle("POST /auth/logout", p.baseMiddleware(p.handlePostAuthLogout))
+
+	// Authentication Error
+	handle("GET /auth/error", p.baseMiddleware(p.handleGetAuthError))
 
 	// Authentication Recovery
-	mux.Handle("GET /auth/recovery", p.baseMiddleware(p.handleGetAuthRecovery))
-	mux.Handle("POST /auth/recovery/email", p.baseMiddleware(p.handlePostAuthRecoveryEmail))
-	mux.Handle("POST /auth/recovery/code", p.baseMiddleware(p.handlePostAuthRecoveryCode))
+	handle("GET /auth/recovery", p.baseMiddleware(p.handleGetAuthRecovery))
+	handle("POST /auth/recovery/email", p.kratosFlowMiddleware(p.handlePostAuthRecoveryEmail))
+	handle("POST /auth/recovery/code", p.kratosFlowMiddleware(p.handlePostAuthRecoveryCode))
 
 	// My Password
-	mux.Handle("GET /my/password", p.baseMiddleware(p.handleGetMyPassword))
-	mux.Handle("POST /my/password", p.baseMiddleware(p.handlePostMyPassword))
+	handle("GET /my/password", p.baseMiddleware(p.requirePrivilegedSession(p.handleGetMyPassword)))
+	handle("POST /my/password", p.kratosFlowMiddleware(p.requirePrivilegedSession(p.handlePostMyPassword)))
 
 	// My Profile
-	mux.Handle("GET /my/profile", p.baseMiddleware(p.handleGetMyProfile))
-	mux.Handle("GET /my/profile/edit", p.baseMiddleware(p.handleGetMyProfileEdit))
-	mux.Handle("GET /my/profile/form", p.baseMiddleware(p.handleGetMyProfileForm))
-	mux.Handle("POST /my/profile", p.baseMiddleware(p.handlePostMyProfile))
+	handle("GET /my/profile", p.baseMiddleware(p.requireSession(p.handleGetMyProfile)))
+	handle("GET /my/profile/edit", p.baseMiddleware(p.requireSession(p.handleGetMyProfileEdit)))
+	handle("GET /my/profile/form", p.baseMiddleware(p.requireSession(p.handleGetMyProfileForm)))
+	handle("POST /my/profile", p.kratosFlowMiddleware(p.requireSession(p.handlePostMyProfile)))
 
 	// Top
-	mux.Handle("GET /", p.baseMiddleware(p.handleGetTop))
+	handle("GET /{$}", p.baseMiddleware(p.handleGetTop))
 
 	// Item
-	mux.Handle("GET /item/{id}", p.baseMiddleware(p.handleGetItemDetail))
-	mux.Handle("GET /item/{id}/purchase", p.baseMiddleware(p.handleGetItemPurchase))
-	mux.Handle("POST /item/{id}/purchase", p.baseMiddleware(p.handlePostItemPurchase))
+	handle("GET /item/{id}", p.baseMiddleware(p.handleGetItemDetail))
+	handle("GET /item/{id}/purchase", p.baseMiddleware(p.requireSession(p.handleGetItemPurchase)))
+	handle("POST /item/{id}/purchase", p.baseMiddleware(p.requireSession(p.handlePostItemPurchase)))
+
+	// Not Found / Method Not Allowed
+	// 他のパターンに一致しない全てのリクエスト
+	// 存在しないURLへの POST 等を CSRF エラー(403)としないよう、アプリのCSRFトークンは検証しない
+	handle("/", p.middleware(p.handleNotFound(mux), false))
 
 	return mux
 }
 
+// アプリ独自のエンドポイント用のミドルウェア
+// 状態を変更するリクエスト(POST等)は、CSRFトークンを検証する
 func (p *Provider) baseMiddleware(handler http.HandlerFunc) http.Handler {
+	return p.middleware(handler, true)
+}
+
+// Kratos の flow を送信するエンドポイント用のミドルウェア
+// Kratos の csrf_token により検証されるため、アプリのCSRFトークンは検証しない
+func (p *Provider) kratosFlowMiddleware(handler http.HandlerFunc) http.Handler {
+	return p.middleware(handler, false)
+}
+
+// ハンドラの panic からの復旧は、エラー画面をログイン状態、CSRFトークン、フラッシュメッセージを含めて表示できるよう、
+// セッション、CSRFトークンを設定した後(ハンドラの直前)で行う
+// セッション、CSRFトークン等を設定するミドルウェアの panic は、外側の recoverMiddlewarePanic で復旧する
+func (p *Provider) middleware(handler http.HandlerFunc, verifyCsrf bool) http.Handler {
 	return p.loggingRquest(
-		p.setSession(handler),
+		p.securityHeaders(
+			p.recoverMiddlewarePanic(
+				p.rateLimit(
+					p.setSession(
+						p.flash(
+							p.csrfProtect(
+								p.recoverPanic(
+									p.executeAfterLoginHook(handler),
+								),
+								verifyCsrf,
+							),
+						),
+					),
+				),
+			),
+		),
 	)
 }
 
+// アクセスログを出力する
+// リクエストIDを発行(もしくは引き継ぎ)し、以降のログ、Kratos へのリクエストに付与する
 func (p *Provider) loggingRquest(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
 		ctx := r.Context()
-		slog.Info(fmt.Sprintf("[Request] %s %s", r.Method, r.URL.Path))
-		next.ServeHTTP(w, r.WithContext(ctx))
+		// リバースプロキシ等で付与されたリクエストIDがある場合は引き継ぐ
+		requestID := r.Header.Get("X-Request-ID")
+		if !validRequestID(requestID) {
+			requestID = newRequestID()
+		}
+		ctx = ContextWithRequestID(ctx, requestID)
+		ctx = p.contextWithClientIP(ctx, r)
+		ctx, entry := contextWithAccessLogEntry(ctx)
+		w.Header().Set("X-Request-ID", requestID)
+		trace.SpanFromContext(ctx).SetAttributes(
+			attribute.String("request.id", requestID),
+			semconv.ClientAddress(clientIP(r.WithContext(ctx))),
+		)
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		slog.InfoContext(ctx, "[Access]",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.statusCode(),
+			"latency", time.Since(start),
+			"bytes", rec.bytes,
+			"clientIP", clientIP(r.WithContext(ctx)),
+			"identityID", entry.identityID,
+			"htmx", r.Header.Get("HX-Request") == "true",
+		)
 	})
 }
 
 func (p *Provider) setSession(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
-		output, err := p.d.Kratos.Whoami(kratos.WhoamiInput{
-			Cookie:     r.Header.Get("Cookie"),
-			RemoteAddr: r.RemoteAddr,
+		output, err := p.d.Kratos.Whoami(ctx, kratos.WhoamiInput{
+			Cookie:   r.Header.Get("Cookie"),
+			ClientIP: clientIP(r),
 		})
-		if err != nil || output.Session == nil {
-			ctx = context.WithValue(ctx, "session", nil)
+		if err != nil {
+			// Kratos に接続できない場合は、未ログインと区別する
+			slog.ErrorContext(ctx, "failed to get session", "Error", err)
+			ctx = ContextWithSessionUnavailable(ctx, err)
 			next.ServeHTTP(w, r.WithContext(ctx))
 			return
 		}
-		slog.Info(fmt.Sprintf("%v", output.Session))
-		ctx = context.WithValue(ctx, "session", *output.Session)
+		if output.Session != nil {
+			setAccessLogIdentityID(ctx, output.Session.Identity.ID)
+			trace.SpanFromContext(ctx).SetAttributes(semconv.EnduserID(output.Session.Identity.ID))
+		}
+		ctx = ContextWithSession(ctx, output.Session)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// 未ログインの場合は、ログイン後に元の画面へ戻れるよう return_to を付与してログイン画面へリダイレクト
+// Kratos に接続できずセッションの有無を判定できない場合は、ログイン画面へはリダイレクトせずエラーとする
+func (p *Provider) requireSession(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, err := SessionFromContext(r.Context())
+		if errors.Is(err, ErrSessionUnavailable) {
+			p.renderError(w, r, http.StatusServiceUnavailable, "認証サーバに接続できません。時間をおいて再度お試しください。")
+			return
+		}
+		if err != nil {
+			redirectToLogin(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// セッションが privileged_session_max_age を過ぎている場合は、ログイン画面へリダイレクト（再ログインの強制）
+// 再ログイン後は return_to により元の画面へ戻る
+func (p *Provider) requirePrivilegedSession(next http.HandlerFunc) http.HandlerFunc {
+	return p.requireSession(func(w http.ResponseWriter, r *http.Request) {
+		session := getSession(r.Context())
+		if session.NeedLoginWhenPrivilegedAccess(p.privilegedAccessLimit) {
+			p.metrics.stepUps.WithLabelValues(METRICS_RESULT_REQUIRED).Inc()
+			redirectToLogin(w, r)
+			return
+		}
+		next(w, r)
+	})
+}
@@ -0,0 +1,105 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"kratos_example/ratelimit"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// レート制限
+//
+// ログイン、アカウント登録等のエンドポイントへの総当たり攻撃を防ぐため、
+// クライアントのIPアドレスごと、送信された識別子(メールアドレス等)ごとにリクエストを制限する
+// 対象のエンドポイントと制限は Config.RateLimitRules で設定する
+
+type RateLimitRule struct {
+	Method string
+	Path   string
+	// クライアントのIPアドレスごとの制限
+	PerIP ratelimit.Rule
+	// 識別子を送信するフォームのフィールド名 (空の場合は識別子ごとの制限は行わない)
+	IdentifierField string
+	// 識別子ごとの制限 (複数のIPアドレスから、同じアカウントを狙う攻撃を防ぐ)
+	PerIdentifier ratelimit.Rule
+}
+
+func loadRateLimitRules(rules []RateLimitRule) map[string]RateLimitRule {
+	m := make(map[string]RateLimitRule)
+	for _, rule := range rules {
+		m[rateLimitRuleKey(rule.Method, rule.Path)] = rule
+	}
+	return m
+}
+
+func rateLimitRuleKey(method string, path string) string {
+	return method + " " + path
+}
+
+func (p *Provider) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rule, ok := p.rateLimitRules[rateLimitRuleKey(r.Method, r.URL.Path)]
+		if !ok || p.d.Limiter == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ruleKey := rateLimitRuleKey(rule.Method, rule.Path)
+
+		if !p.allowRequest(w, r, fmt.Sprintf("%s:ip:%s", ruleKey, clientIP(r)), rule.PerIP) {
+			return
+		}
+		if rule.IdentifierField != "" {
+			identifier := normalizeIdentifier(r.PostFormValue(rule.IdentifierField))
+			if identifier != "" && !p.allowRequest(w, r, fmt.Sprintf("%s:identifier:%s", ruleKey, identifier), rule.PerIdentifier) {
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// レート制限を確認し、制限された場合は 429 を返却して false を返却する
+// 制限の確認に失敗した場合(共有ストアの障害等)は、リクエストを許可する
+func (p *Provider) allowRequest(w http.ResponseWriter, r *http.Request, key string, rule ratelimit.Rule) bool {
+	result, err := p.d.Limiter.Allow(r.Context(), key, rule)
+	if err != nil {
+		slog.Error("rate limit error", "Error", err)
+		return true
+	}
+	if result.Allowed {
+		return true
+	}
+
+	slog.Warn("rate limited", "key", key, "retryAfter", result.RetryAfter)
+	p.writeTooManyRequests(w, r, result.RetryAfter)
+	return false
+}
+
+// 429 Too Many Requests を返却する
+// エラー画面(htmx によるリクエストの場合は、画面上部のアラート)に再試行までの時間を表示する
+func (p *Provider) writeTooManyRequests(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	message := fmt.Sprintf("リクエストが多すぎます。%d秒後に再度お試しください。", seconds)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	p.renderError(w, r, http.StatusTooManyRequests, message)
+}
+
+// 識別子を正規化し、ハッシュ値を返却する
+// 大文字・小文字や前後の空白の違いで制限を回避されないようにし、キーに識別子そのものを含めない
+func normalizeIdentifier(identifier string) string {
+	identifier = strings.ToLower(strings.TrimSpace(identifier))
+	if identifier == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(identifier))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+)
+
+// テンプレートの出力
+//
+// テンプレートは、画面全体(layout/_header.html, layout/_footer.html を含む)と、
+// htmx により画面の一部を更新するための部分テンプレート(ファイル名が "_" で始まる)に分かれる
+// render は htmx によるリクエストかどうか(HX-Request, HX-Target)により、画面全体と部分テンプレートを選択する
+//
+// テンプレートの実行に失敗した場合に、途中まで出力された画面を返却しないよう、バッファへ出力してから返却する
+
+const (
+	// out-of-band swap により、部分テンプレートと合わせて更新する要素
+	OOB_NAVBAR = "layout/_navbar_oob.html"
+	OOB_FLASH  = "layout/_flash_oob.html"
+)
+
+// htmx により画面の一部を更新するリクエストの場合に、画面全体の代わりに出力する部分テンプレート
+// target を指定した場合は、HX-Target が一致する場合のみ部分テンプレートを出力する
+type fragmentTemplate struct {
+	name   string
+	target string
+}
+
+// 画面全体のテンプレート名 → 部分テンプレート
+var fragmentTemplates = map[string]fragmentTemplate{
+	"item/purchase.html": {name: "item/_purchase.html", target: "item-detail"},
+}
+
+// テンプレートを出力する
+// 部分テンプレートを出力する場合は、oob に指定したテンプレートを合わせて出力する (画面全体の場合は、全ての要素が含まれるため出力しない)
+// フラッシュメッセージがある場合は、画面全体の場合はレイアウトに、部分テンプレートの場合は out-of-band swap により表示する
+//
+// 入力値のバリデーションエラー、エラー画面で 2xx 以外のステータスコードを返却する場合も、htmx が swap するよう layout/_header.html で設定している
+func (p *Provider) render(w http.ResponseWriter, r *http.Request, statusCode int, name string, data map[string]any, oob ...string) {
+	name = templateNameForRequest(r, name)
+
+	if data != nil {
+		if flashes := p.popFlashes(r.Context()); len(flashes) > 0 {
+			data["FlashMessages"] = flashes
+			if !slices.Contains(oob, OOB_FLASH) {
+				oob = append(oob, OOB_FLASH)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	err := p.tmpl.ExecuteTemplate(&buf, name, data)
+	if err == nil && isFragmentTemplate(name) {
+		for _, oobName := range oob {
+			if err = p.tmpl.ExecuteTemplate(&buf, oobName, data); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to execute template", "template", name, "Error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// 画面全体と部分テンプレートを同じURLで返却するため、キャッシュを区別させる
+	w.Header().Add("Vary", "HX-Request")
+	w.WriteHeader(statusCode)
+	if _, err := buf.WriteTo(w); err != nil {
+		slog.ErrorContext(r.Context(), "failed to write response", "Error", err)
+	}
+}
+
+// リクエストに応じて出力するテンプレート名を返却する
+func templateNameForRequest(r *http.Request, name string) string {
+	fragment, ok := fragmentTemplates[name]
+	if !ok || !isPartialRequest(r) {
+		return name
+	}
+	if fragment.target != "" && r.Header.Get("HX-Target") != fragment.target {
+		return name
+	}
+	return fragment.name
+}
+
+// htmx により画面の一部を更新するリクエストかどうか
+// hx-boost によるリクエスト、ブラウザの履歴の復元(キャッシュがない場合)は、画面全体を返却する
+func isPartialRequest(r *http.Request) bool {
+	return r.Header.Get("HX-Request") == "true" &&
+		r.Header.Get("HX-Boosted") != "true" &&
+		r.Header.Get("HX-History-Restore-Request") != "true"
+}
+
+func isFragmentTemplate(name string) bool {
+	return strings.HasPrefix(path.Base(name), "_")
+}
@@ -0,0 +1,114 @@
+package handler
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// return_to として許可するURLのリストを読み込む
+// kratos の selfservice.allowed_return_urls と同じ値を設定する想定
+func loadAllowedReturnURLs(rawURLs []string) ([]*url.URL, error) {
+	var allowedReturnURLs []*url.URL
+	for _, rawURL := range rawURLs {
+		u, err := url.Parse(rawURL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid allowed return url: %s", rawURL)
+		}
+		if u.Path == "" {
+			u.Path = "/"
+		}
+		allowedReturnURLs = append(allowedReturnURLs, u)
+	}
+	return allowedReturnURLs, nil
+}
+
+// リクエストの return_to クエリパラメータを検証して取得
+// 許可されていない場合は空文字を返却する
+func (p *Provider) getReturnTo(r *http.Request) string {
+	return p.normalizeReturnTo(r.URL.Query().Get("return_to"))
+}
+
+// return_to を検証し、アプリ内の相対パス(path + query)に正規化して返却する
+// 許可リストのURLとscheme, hostが一致し、pathが許可リストのURLのpath配下である場合のみ許可する
+// 相対パスは許可リストの先頭のURL(アプリのURL)を基準として解決する
+// 許可されない場合(外部ホスト、scheme-relative URL、不正なscheme等)は空文字を返却する
+func (p *Provider) normalizeReturnTo(returnTo string) string {
+	if returnTo == "" || len(p.allowedReturnURLs) == 0 {
+		return ""
+	}
+
+	// ブラウザによっては "\" を "/" として解釈するため、"/\evil.example.com" のような値を拒否する
+	// 制御文字も同様に拒否する
+	if strings.ContainsAny(returnTo, "\\\t\r\n") {
+		slog.Warn("rejected return_to", "returnTo", returnTo)
+		return ""
+	}
+
+	u, err := url.Parse(returnTo)
+	if err != nil {
+		slog.Warn("rejected return_to", "returnTo", returnTo, "Error", err)
+		return ""
+	}
+
+	// 相対パスはアプリのURLを基準として解決
+	// scheme-relative URL ("//evil.example.com") は Host が設定されるため、ここでは解決されない
+	if u.Scheme == "" && u.Host == "" {
+		if !strings.HasPrefix(u.Path, "/") {
+			slog.Warn("rejected return_to", "returnTo", returnTo)
+			return ""
+		}
+		u = p.allowedReturnURLs[0].ResolveReference(u)
+	}
+
+	if (u.Scheme != "http" && u.Scheme != "https") || u.User != nil {
+		slog.Warn("rejected return_to", "returnTo", returnTo)
+		return ""
+	}
+
+	// "/my/../auth" のようなパスを正規化してから判定する
+	cleanPath := path.Clean("/" + u.Path)
+	for _, allowed := range p.allowedReturnURLs {
+		if u.Scheme != allowed.Scheme || !strings.EqualFold(u.Host, allowed.Host) {
+			continue
+		}
+		if !isSubPath(cleanPath, allowed.Path) {
+			continue
+		}
+		normalized := url.URL{
+			Path:     cleanPath,
+			RawQuery: u.RawQuery,
+		}
+		return normalized.RequestURI()
+	}
+
+	slog.Warn("rejected return_to", "returnTo", returnTo)
+	return ""
+}
+
+// p が base と一致する、もしくは base 配下のパスであるかを返却する
+func isSubPath(p string, base string) bool {
+	if base == "/" || p == base {
+		return true
+	}
+	return strings.HasPrefix(p, strings.TrimSuffix(base, "/")+"/")
+}
+
+// return_to が指定されている場合は、クエリパラメータとして付与したURLを返却する
+func appendReturnTo(rawURL string, returnTo string) string {
+	if returnTo == "" {
+		return rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		slog.Error(err.Error())
+		return rawURL
+	}
+	query := u.Query()
+	query.Set("return_to", returnTo)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
@@ -0,0 +1,77 @@
+package handler
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+)
+
+var errSecretBoxOpen = errors.New("failed to open secret box")
+
+// AEAD (AES-256-GCM) による暗号化と改ざん検知を行う
+// 鍵のローテーションに対応するため、暗号化は先頭の鍵で行い、復号時は全ての鍵を順に試行する
+type secretBox struct {
+	aeads []cipher.AEAD
+}
+
+// secrets から鍵を生成する
+// 任意の長さの secret を扱えるよう、SHA-256 で 32 bytes の鍵を導出する
+func newSecretBox(secrets []string) (*secretBox, error) {
+	if len(secrets) == 0 {
+		return nil, errors.New("secret box requires at least one secret")
+	}
+
+	var box secretBox
+	for _, secret := range secrets {
+		if secret == "" {
+			return nil, errors.New("secret box secret must not be empty")
+		}
+		key := sha256.Sum256([]byte(secret))
+		block, err := aes.NewCipher(key[:])
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		box.aeads = append(box.aeads, aead)
+	}
+	return &box, nil
+}
+
+// plaintext を暗号化し、nonce を先頭に付与して base64url エンコードした文字列を返却する
+// additionalData は暗号化されないが改ざん検知の対象となる (用途の異なる値への流用防止に使用)
+func (b *secretBox) seal(plaintext []byte, additionalData []byte) (string, error) {
+	aead := b.aeads[0]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, additionalData)
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// seal で暗号化した文字列を復号する
+// いずれの鍵でも復号できない場合(改ざん、鍵の破棄など)はエラーを返却する
+func (b *secretBox) open(sealed string, additionalData []byte) ([]byte, error) {
+	sealedBytes, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, errSecretBoxOpen
+	}
+	for _, aead := range b.aeads {
+		if len(sealedBytes) < aead.NonceSize() {
+			continue
+		}
+		nonce, ciphertext := sealedBytes[:aead.NonceSize()], sealedBytes[aead.NonceSize():]
+		plaintext, err := aead.Open(nil, nonce, ciphertext, additionalData)
+		if err == nil {
+			return plaintext, nil
+		}
+	}
+	return nil, errSecretBoxOpen
+}
@@ -0,0 +1,118 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// セキュリティ関連のレスポンスヘッダ
+//
+// Content-Security-Policy はリクエストごとに nonce を生成し、テンプレートの .CspNonce としてインラインスクリプトに付与する
+// 導入時や変更時は Report-Only で送信し、/csp-report に送信された違反レポートを確認してから適用する
+
+// Content-Security-Policy の nonce のプレースホルダ
+const CSP_NONCE_PLACEHOLDER = "{nonce}"
+
+// CSP違反レポートの送信先
+const CSP_REPORT_PATH = "/csp-report"
+
+// CSP違反レポートの最大サイズ
+const cspReportMaxBytes = 64 * 1024
+
+type SecurityHeadersParams struct {
+	// Content-Security-Policy ("{nonce}" はリクエストごとの nonce に置換する)
+	// 空の場合は送信しない
+	ContentSecurityPolicy string
+	// true の場合は Content-Security-Policy-Report-Only として送信し、違反してもブロックしない
+	CSPReportOnly bool
+	// true の場合は、CSP違反レポートを CSP_REPORT_PATH へ送信する
+	CSPReport bool
+	// Strict-Transport-Security の max-age (0 の場合は送信しない。HTTPSで運用する場合のみ設定する)
+	HSTSMaxAge time.Duration
+	// X-Frame-Options (DENY, SAMEORIGIN)
+	FrameOptions string
+	// Referrer-Policy
+	ReferrerPolicy string
+	// Permissions-Policy
+	PermissionsPolicy string
+}
+
+type cspNonceContextKey struct{}
+
+func (p *Provider) securityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := p.securityHeadersParams
+		h := w.Header()
+
+		h.Set("X-Content-Type-Options", "nosniff")
+		if params.FrameOptions != "" {
+			h.Set("X-Frame-Options", params.FrameOptions)
+		}
+		if params.ReferrerPolicy != "" {
+			h.Set("Referrer-Policy", params.ReferrerPolicy)
+		}
+		if params.PermissionsPolicy != "" {
+			h.Set("Permissions-Policy", params.PermissionsPolicy)
+		}
+		if params.HSTSMaxAge > 0 {
+			h.Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d; includeSubDomains", int(params.HSTSMaxAge.Seconds())))
+		}
+
+		ctx := r.Context()
+		if params.ContentSecurityPolicy != "" {
+			nonce := newCspNonce()
+			policy := strings.ReplaceAll(params.ContentSecurityPolicy, CSP_NONCE_PLACEHOLDER, nonce)
+			if params.CSPReport {
+				h.Set("Reporting-Endpoints", fmt.Sprintf(`csp-endpoint="%s"`, CSP_REPORT_PATH))
+				policy = fmt.Sprintf("%s; report-uri %s; report-to csp-endpoint", strings.TrimSuffix(strings.TrimSpace(policy), ";"), CSP_REPORT_PATH)
+			}
+			if params.CSPReportOnly {
+				h.Set("Content-Security-Policy-Report-Only", policy)
+			} else {
+				h.Set("Content-Security-Policy", policy)
+			}
+			ctx = context.WithValue(ctx, cspNonceContextKey{}, nonce)
+		}
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// テンプレートへ渡す CSP の nonce を取得
+func cspNonceFromContext(ctx context.Context) string {
+	nonce, _ := ctx.Value(cspNonceContextKey{}).(string)
+	return nonce
+}
+
+func newCspNonce() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// Handler POST /csp-report
+// ブラウザから送信されたCSP違反レポートをログに出力する
+// report-uri (application/csp-report) と Reporting API (application/reports+json) のどちらの形式も、そのまま出力する
+func (p *Provider) handlePostCspReport(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, cspReportMaxBytes))
+	if err != nil {
+		slog.Warn("failed to read csp report", "Error", err)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	slog.Warn("csp violation",
+		"contentType", r.Header.Get("Content-Type"),
+		"userAgent", r.UserAgent(),
+		"report", string(body),
+	)
+	w.WriteHeader(http.StatusNoContent)
+}
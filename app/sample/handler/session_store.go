@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kratos_example/kratos"
+	"kratos_example/store"
+	"log/slog"
+	"time"
+)
+
+// セッションストア
+//
+// Kratos のセッションIDごとに、アプリの状態(ログインフック等)をサーバサイドのストアへ保存する
+// 値は JSON で保存し、有効期限は Kratos のセッションの有効期限を上限とする
+// (Kratos のセッションが失効した後に、値が残り続けることを防ぐ)
+
+var errSessionExpired = errors.New("session is expired")
+
+func sessionStoreKey(session *kratos.Session, name string) string {
+	return fmt.Sprintf("session:%s:%s", session.ID, name)
+}
+
+// セッションに紐づく値を取得し、v へ変換する
+// 値が存在しない場合は false を返却する
+func (p *Provider) loadSessionValue(ctx context.Context, session *kratos.Session, name string, v any) (bool, error) {
+	if session == nil {
+		return false, nil
+	}
+	b, err := p.d.Store.Get(ctx, sessionStoreKey(session, name))
+	if errors.Is(err, store.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		slog.Error(err.Error())
+		return false, err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		slog.Error(err.Error())
+		return false, err
+	}
+	return true, nil
+}
+
+// セッションに紐づけて値を保存する
+// ttl が 0 の場合、もしくはセッションの有効期限を超える場合は、セッションの有効期限まで保存する
+func (p *Provider) saveSessionValue(ctx context.Context, session *kratos.Session, name string, v any, ttl time.Duration) error {
+	if session == nil {
+		return errSessionExpired
+	}
+	sessionTTL := time.Until(session.ExpiresAt)
+	if sessionTTL <= 0 {
+		return errSessionExpired
+	}
+	if ttl <= 0 || ttl > sessionTTL {
+		ttl = sessionTTL
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		slog.Error(err.Error())
+		return err
+	}
+	if err := p.d.Store.Set(ctx, sessionStoreKey(session, name), b, ttl); err != nil {
+		slog.Error(err.Error())
+		return err
+	}
+	return nil
+}
+
+// セッションに紐づく値を削除する
+func (p *Provider) deleteSessionValue(ctx context.Context, session *kratos.Session, name string) error {
+	if session == nil {
+		return nil
+	}
+	if err := p.d.Store.Delete(ctx, sessionStoreKey(session, name)); err != nil {
+		slog.Error(err.Error())
+		return err
+	}
+	return nil
+}
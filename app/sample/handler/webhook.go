@@ -0,0 +1,164 @@
+package handler
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"kratos_example/kratos"
+	"log/slog"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Kratos の web_hook の受信
+//
+// Kratos の flow の完了後(after フック)に、web_hook により POST /webhooks/kratos/{event} へ通知させ、
+// イベントごとに登録したハンドラ(アプリ側のプロフィールの作成等)を実行する
+// リクエストの body は、kratos/webhooks/body.jsonnet により webhookPayload の形式で送信させる
+//
+// ブラウザからのリクエストではないため、セッション、CSRFトークンの検証は行わず、
+// Kratos の web_hook の auth (api_key) で送信される API キーにより認証する
+// Kratos の再試行等により、同じイベントが複数回送信される場合があるため、ハンドラは冪等にする
+
+// リクエストの body の最大サイズ
+const webhookMaxBytes = 64 << 10
+
+type webhookEvent string
+
+const (
+	WEBHOOK_EVENT_AFTER_REGISTRATION = webhookEvent("after_registration")
+	WEBHOOK_EVENT_AFTER_SETTINGS     = webhookEvent("after_settings")
+	WEBHOOK_EVENT_AFTER_VERIFICATION = webhookEvent("after_verification")
+	WEBHOOK_EVENT_AFTER_LOGIN        = webhookEvent("after_login")
+)
+
+var webhookEvents = []webhookEvent{
+	WEBHOOK_EVENT_AFTER_REGISTRATION,
+	WEBHOOK_EVENT_AFTER_SETTINGS,
+	WEBHOOK_EVENT_AFTER_VERIFICATION,
+	WEBHOOK_EVENT_AFTER_LOGIN,
+}
+
+type WebhookParams struct {
+	// API キーを送信するヘッダ (Kratos の web_hook の auth.config.name と同じ値を設定)
+	APIKeyHeader string
+	// 許可する API キー (Kratos の web_hook の auth.config.value と同じ値を設定)
+	// ローテーション時は、Kratos の設定を変更する前に新しい API キーを追加する
+	// 空の場合は、エンドポイントを登録しない
+	APIKeys []string
+}
+
+// web_hook の body (kratos/webhooks/body.jsonnet)
+type webhookPayload struct {
+	FlowID string `json:"flow_id"`
+	// browser, api
+	FlowType string          `json:"flow_type"`
+	Identity kratos.Identity `json:"identity"`
+	// after_login の場合のみ設定される
+	SessionID string `json:"session_id,omitempty"`
+}
+
+type webhookHandler func(ctx context.Context, payload webhookPayload) error
+
+// web_hook のハンドラの登録
+func (p *Provider) registerWebhookHandlers() {
+	p.registerWebhookHandler(WEBHOOK_EVENT_AFTER_REGISTRATION, p.provisionAppProfile)
+	p.registerWebhookHandler(WEBHOOK_EVENT_AFTER_SETTINGS, p.syncAppProfile)
+	p.registerWebhookHandler(WEBHOOK_EVENT_AFTER_VERIFICATION, p.markAppProfileVerified)
+	p.registerWebhookHandler(WEBHOOK_EVENT_AFTER_LOGIN, p.recordAppProfileLogin)
+}
+
+// イベントにハンドラを登録する
+// 同じイベントに複数のハンドラを登録した場合は、登録した順に実行し、エラーとなった時点で中断する
+func (p *Provider) registerWebhookHandler(event webhookEvent, handler webhookHandler) {
+	if !isWebhookEvent(event) {
+		panic(fmt.Sprintf("unknown webhook event: %s", event))
+	}
+	p.webhookHandlers[event] = append(p.webhookHandlers[event], handler)
+}
+
+func isWebhookEvent(event webhookEvent) bool {
+	for _, e := range webhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// メトリクスのラベル (パスの値によってラベルが増えないようにする)
+func webhookEventLabel(event webhookEvent) string {
+	if !isWebhookEvent(event) {
+		return "unknown"
+	}
+	return string(event)
+}
+
+// Handler POST /webhooks/kratos/{event}
+func (p *Provider) handlePostKratosWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	event := webhookEvent(r.PathValue("event"))
+	// 存在するイベントが推測されないよう、イベントの確認より先に認証する
+	if !p.validWebhookAPIKey(r) {
+		slog.WarnContext(ctx, "invalid webhook api key", "event", event)
+		p.metrics.webhooks.WithLabelValues(webhookEventLabel(event), METRICS_RESULT_UNAUTHORIZED).Inc()
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if !isWebhookEvent(event) {
+		p.metrics.webhooks.WithLabelValues(webhookEventLabel(event), METRICS_RESULT_FAILURE).Inc()
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var payload webhookPayload
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, webhookMaxBytes)).Decode(&payload); err != nil || payload.Identity.ID == "" {
+		slog.WarnContext(ctx, "invalid webhook payload", "event", event, "Error", err)
+		p.metrics.webhooks.WithLabelValues(string(event), METRICS_RESULT_FAILURE).Inc()
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(
+		attribute.String("webhook.event", string(event)),
+		attribute.String("kratos.flow.id", payload.FlowID),
+	)
+	setAccessLogIdentityID(ctx, payload.Identity.ID)
+
+	for _, handler := range p.webhookHandlers[event] {
+		if err := handler(ctx, payload); err != nil {
+			slog.ErrorContext(ctx, "failed to handle webhook",
+				"event", event,
+				"flowID", payload.FlowID,
+				"identityID", payload.Identity.ID,
+				"Error", err,
+			)
+			span.SetStatus(codes.Error, err.Error())
+			p.metrics.webhooks.WithLabelValues(string(event), METRICS_RESULT_FAILURE).Inc()
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	p.metrics.webhooks.WithLabelValues(string(event), METRICS_RESULT_SUCCESS).Inc()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// リクエストの API キーが、許可された API キーのいずれかと一致するか
+// 処理時間から一致した API キーが推測されないよう、一致した時点で終了せず、全ての API キーと固定時間で比較する
+func (p *Provider) validWebhookAPIKey(r *http.Request) bool {
+	apiKey := r.Header.Get(p.webhookParams.APIKeyHeader)
+	if apiKey == "" {
+		return false
+	}
+	valid := 0
+	for _, allowed := range p.webhookParams.APIKeys {
+		valid |= subtle.ConstantTimeCompare([]byte(apiKey), []byte(allowed))
+	}
+	return valid == 1
+}
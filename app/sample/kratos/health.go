@@ -0,0 +1,53 @@
+package kratos
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+const PATH_HEALTH_READY = "/health/ready"
+
+// ------------------------- Health -------------------------
+type HealthReadyInput struct {
+	// true の場合は Admin API、false の場合は Public API の状態を確認する
+	Admin bool
+}
+
+type HealthReadyOutput struct {
+	StatusCode int
+}
+
+// Kratos の /health/ready により、データベースへの接続等を含めてリクエストを処理できる状態か確認する
+// 200 以外の場合はエラーを返却する
+func (p *Provider) HealthReady(ctx context.Context, i HealthReadyInput) (HealthReadyOutput, error) {
+	ctx, span := p.startSpan(ctx, "HealthReady")
+	defer span.End()
+
+	var (
+		output       HealthReadyOutput
+		kratosOutput requestKratosOutput
+		err          error
+	)
+
+	kratosInput := requestKratosInput{
+		Method: http.MethodGet,
+		Path:   PATH_HEALTH_READY,
+	}
+	if i.Admin {
+		kratosOutput, err = p.requestKratosAdmin(ctx, kratosInput)
+	} else {
+		kratosOutput, err = p.requestKratosPublic(ctx, kratosInput)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "kratos health check error", "Error", err, "admin", i.Admin)
+		return output, err
+	}
+
+	output.StatusCode = kratosOutput.StatusCode
+	if kratosOutput.StatusCode != http.StatusOK {
+		return output, fmt.Errorf("kratos is not ready: status code: %d", kratosOutput.StatusCode)
+	}
+	return output, nil
+}
@@ -1,8 +1,10 @@
 package kratos
 
 import (
-	"fmt"
+	"context"
+	"encoding/json"
 	"log/slog"
+	"net/http"
 	"time"
 )
 
@@ -248,13 +250,9 @@ func getContinueWithVerificationFlowId(responseBody interface{}) string {
 func getErrorMessagesFromUi(ui uiContainer) []string {
 	slog.Info("getErrorMessagesFromUi")
 
-	slog.Info(fmt.Sprintf("%v", ui))
 	var messages []string
 	for _, v := range ui.Messages {
-		slog.Info(fmt.Sprintf("%v", v))
 		if v.Type == "error" {
-			slog.Info(fmt.Sprintf("%v", v.ID))
-			slog.Info(fmt.Sprintf("%v", v.Text))
 			// [TODO] 日本語化
 			// https://www.ory.sh/docs/kratos/concepts/ui-user-interface#machine-readable-format
 			if v.ID == 4000007 {
@@ -269,12 +267,8 @@ func getErrorMessagesFromUi(ui uiContainer) []string {
 }
 
 func getDuplicateIdentifierFromUi(ui uiContainer) string {
-	slog.Info(fmt.Sprintf("%v", ui))
 	for _, v := range ui.Messages {
-		slog.Info(fmt.Sprintf("%v", v))
 		if v.ID == 1010016 && v.Type == "info" {
-			slog.Info(fmt.Sprintf("%v", v.ID))
-			slog.Info(fmt.Sprintf("%v", v.Text))
 			return v.Context["duplicateIdentifier"].(string)
 		}
 	}
@@ -286,26 +280,83 @@ func getDuplicateIdentifierFromUi(ui uiContainer) string {
 // 	return getErrorMessagesFromGenericError(err.Error)
 // }
 
+const ERROR_ID_FLOW_EXPIRED = "self_service_flow_expired"
+
+// flow の有効期限切れかどうか
+// Kratos のバージョン、エンドポイントにより 410 以外のステータスコードで返却される場合があるため、エラーIDも確認する
+func isFlowExpired(kratosOutput requestKratosOutput) bool {
+	if kratosOutput.StatusCode == http.StatusGone {
+		return true
+	}
+	var errGeneric errorGeneric
+	if err := json.Unmarshal(kratosOutput.BodyBytes, &errGeneric); err != nil {
+		return false
+	}
+	return errGeneric.Error.ID == ERROR_ID_FLOW_EXPIRED
+}
+
+// flow の有効期限切れの場合に、出力に設定するエラーメッセージ、Cookie と ErrFlowExpired を返却する
+// 有効期限切れでない場合は、全て nil を返却する
+func flowExpiredOutput(ctx context.Context, kratosOutput requestKratosOutput, flowID string) ([]string, []string, error) {
+	if !isFlowExpired(kratosOutput) {
+		return nil, nil, nil
+	}
+	slog.InfoContext(ctx, "flow expired", "flowID", flowID)
+	return getErrorMessagesFromGenericError(genericError{ID: ERROR_ID_FLOW_EXPIRED}), kratosOutput.Header["Set-Cookie"], ErrFlowExpired
+}
+
+// Kratos のエラーID → 表示するメッセージ
+// https://www.ory.sh/docs/kratos/concepts/ui-user-interface#ui-error-codes
+var genericErrorMessages = map[string]string{
+	"security_csrf_violation":               "恐れ入りますが、画面を更新してもう一度お試しください",
+	"security_identity_mismatch":            "別のアカウントで操作が行われました。もう一度ログインしてからお試しください",
+	ERROR_ID_FLOW_EXPIRED:                   "有効期限が切れました。もう一度最初からお試しください",
+	"self_service_flow_return_to_forbidden": "指定された戻り先のURLは許可されていません",
+	"self_service_flow_disabled":            "この機能は現在ご利用いただけません",
+	"session_already_available":             "すでにログインしています",
+	"session_inactive":                      "ログインの有効期限が切れました。もう一度ログインしてください",
+	"session_refresh_required":              "セキュリティのため、もう一度ログインしてください",
+	"session_aal2_required":                 "二段階認証が必要です",
+	"browser_location_change_required":      "画面を移動してから、もう一度お試しください",
+}
+
+// Kratos のエラーレスポンスをログへ出力する
+// details, debug 等にリクエストの内容が含まれる場合があるため、エラーを特定するための項目のみを出力する
+func logGenericError(err genericError) {
+	slog.Info("kratos error response", "id", err.ID, "statusCode", err.Code, "status", err.Status, "reason", err.Reason)
+}
+
 func getErrorMessagesFromGenericError(err genericError) []string {
-	slog.Info("getErrorMessagesFromGenericError")
-	slog.Info(err.ID)
-	// [TODO] 日本語化
-	// https://www.ory.sh/docs/kratos/concepts/ui-user-interface#ui-error-codes
-	if err.ID == "security_csrf_violation" {
-		return []string{"恐れ入りますが、画面を更新してもう一度お試しください"}
+	if message, ok := genericErrorMessages[err.ID]; ok {
+		return []string{message}
 	}
 	return []string{err.Message}
 }
 
+// エラー画面に表示するメッセージを返却する
+// Kratos のメッセージ(英語)はそのまま表示せず、エラーIDがない場合はステータスコードにより表示する
+func getErrorMessagesFromFlowError(err genericError) []string {
+	if message, ok := genericErrorMessages[err.ID]; ok {
+		return []string{message}
+	}
+	switch {
+	case err.Code == http.StatusNotFound:
+		return []string{"お探しのページは見つかりませんでした"}
+	case err.Code >= 400 && err.Code < 500:
+		return []string{"リクエストを処理できませんでした。恐れ入りますが、もう一度最初からお試しください"}
+	default:
+		return []string{"認証サーバでエラーが発生しました。時間をおいて再度お試しください"}
+	}
+}
+
 func getErrorMessagesFromErrorGeneric(err errorGeneric) []string {
 	slog.Info("getErrorMessagesFromErrorGeneric")
 	return getErrorMessagesFromGenericError(err.Error)
 }
 
-// セッションがprivileged_session_max_age を過ぎているかどうかを返却する
-func (s *Session) NeedLoginWhenPrivilegedAccess() bool {
-	authenticateAt := s.AuthenticatedAt.In(pkgVars.locationJst)
-	if authenticateAt.Before(time.Now().Add(-time.Second * pkgVars.privilegedAccessLimitMinutes)) {
+// セッションがprivileged_session_max_age(privilegedAccessLimit) を過ぎているかどうかを返却する
+func (s *Session) NeedLoginWhenPrivilegedAccess(privilegedAccessLimit time.Duration) bool {
+	if s.AuthenticatedAt.Before(time.Now().Add(-privilegedAccessLimit)) {
 		return true
 	} else {
 		return false
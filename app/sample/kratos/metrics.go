@@ -0,0 +1,71 @@
+package kratos
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// メトリクス
+//
+// Kratos への HTTP リクエストのレイテンシと、Kratos が返却したエラーID を、Provider のメソッド(operation)ごとに記録する
+// operation は startSpan で、コンテキストに保存する
+
+type metrics struct {
+	requestDuration *prometheus.HistogramVec
+	responseErrors  *prometheus.CounterVec
+}
+
+// Provider ごとにメトリクスを生成する
+func newMetrics() *metrics {
+	return &metrics{
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "kratos_client",
+			Name:      "request_duration_seconds",
+			Help:      "Latency of HTTP requests to Kratos by provider method and status code.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"operation", "status_code"}),
+
+		responseErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "kratos_client",
+			Name:      "errors_total",
+			Help:      "Errors returned by Kratos by provider method and Kratos error ID.",
+		}, []string{"operation", "error_id"}),
+	}
+}
+
+// main で prometheus.Registry に登録する
+func (p *Provider) MetricsCollectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		p.metrics.requestDuration,
+		p.metrics.responseErrors,
+	}
+}
+
+type operationContextKey struct{}
+
+func contextWithOperation(ctx context.Context, operation string) context.Context {
+	return context.WithValue(ctx, operationContextKey{}, operation)
+}
+
+func operationFromContext(ctx context.Context) string {
+	if operation, ok := ctx.Value(operationContextKey{}).(string); ok {
+		return operation
+	}
+	return "unknown"
+}
+
+// Kratos へのリクエストを記録する
+// 接続できなかった場合は、statusCode を 0 とし、status_code を "error" とする
+func (m *metrics) observeRequest(ctx context.Context, seconds float64, statusCode int, errorID string) {
+	operation := operationFromContext(ctx)
+	status := "error"
+	if statusCode > 0 {
+		status = strconv.Itoa(statusCode)
+	}
+	m.requestDuration.WithLabelValues(operation, status).Observe(seconds)
+	if errorID != "" {
+		m.responseErrors.WithLabelValues(operation, errorID).Inc()
+	}
+}
@@ -20,6 +20,22 @@ type Session struct {
 	ID              string    `json:"id"`
 	Identity        Identity  `json:"identity,omitempty"`
 	AuthenticatedAt time.Time `json:"authenticated_at"`
+	ExpiresAt       time.Time `json:"expires_at"`
+	// 認証レベル (aal1, aal2 等)
+	AuthenticatorAssuranceLevel string                 `json:"authenticator_assurance_level"`
+	AuthenticationMethods       []AuthenticationMethod `json:"authentication_methods,omitempty"`
+	// トークン化されたセッション(JWT)
+	// session.whoami.tokenizer を設定し、tokenize_as を指定して取得した場合のみ設定される
+	Tokenized string `json:"tokenized,omitempty"`
+}
+
+// セッションの認証に使用した方式
+type AuthenticationMethod struct {
+	Method      string    `json:"method"`
+	AAL         string    `json:"aal"`
+	CompletedAt time.Time `json:"completed_at"`
+	// oidc の場合のプロバイダ (google 等)
+	Provider string `json:"provider,omitempty"`
 }
 
 // kratosからのレスポンスのうち、必要なもののみを定義
@@ -204,6 +220,10 @@ type kratosUpdateLoginFlowOidcRequest struct {
 	CsrfToken string `json:"csrf_token"`
 }
 
+type kratosUpdateLoginFlowRespnse struct {
+	Session Session `json:"session"`
+}
+
 // status code 400 の場合のレスポンスボディのフォーマット
 // ドキュメントではverification flowが返却される記載しかないが、GenericErrorが返却される場合もある
 // どちらの場合にも対応するため、必要なフィールドを全て定義している
@@ -267,3 +287,11 @@ type kratosUpdateSettingsFlowBadRequestErrorResponse struct {
 	Ui    *uiContainer  `json:"ui,omitempty"`
 	Error *genericError `json:"error,omitempty"`
 }
+
+// Flow error
+// selfservice.flows.error.ui_url へのリダイレクト時に、id で指定されたエラー
+type kratosGetFlowErrorResponse struct {
+	ID        string       `json:"id"`
+	Error     genericError `json:"error"`
+	CreatedAt time.Time    `json:"created_at"`
+}
@@ -1,19 +1,62 @@
 package kratos
 
+import (
+	"kratos_example/store"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+)
+
 type Provider struct {
-	d Dependencies
+	d             Dependencies
+	c             Config
+	whoamiGroup   singleflightGroup
+	tokenVerifier *TokenVerifier
+	// メトリクス、トレーシング (Provider ごとに生成する)
+	metrics *metrics
+	tracer  trace.Tracer
 }
 
 type Dependencies struct {
+	// Whoami の結果をキャッシュするストア (nil の場合はキャッシュしない)
+	Store store.Store
+}
+
+type Config struct {
+	KratosPublicEndpoint string
+	KratosAdminEndpoint  string
+	BirthdateFormat      string
+	// Kratos のセッションCookie名 (Whoami のキャッシュのキーに使用)
+	SessionCookieName string
+	// Whoami の結果をキャッシュする期間 (0 の場合はキャッシュしない)
+	WhoamiCacheTTL time.Duration
+	// セッションをJWTとして取得する場合の tokenizer のテンプレート名 (空の場合はトークン化しない)
+	TokenizeTemplate string
+	// トークン化したセッションを検証する公開鍵のJWKS (http(s):// もしくはファイルのパス)
+	TokenJWKSURL string
 }
 
 type NewInput struct {
 	Dependencies Dependencies
+	Config       Config
 }
 
 func New(i NewInput) (*Provider, error) {
 	p := Provider{
-		d: i.Dependencies,
+		d:       i.Dependencies,
+		c:       i.Config,
+		metrics: newMetrics(),
+		tracer:  otel.Tracer("kratos_example/kratos"),
+	}
+	if p.c.TokenizeTemplate != "" {
+		var err error
+		p.tokenVerifier, err = NewTokenVerifier(TokenVerifierInput{
+			JWKSURL: p.c.TokenJWKSURL,
+		})
+		if err != nil {
+			return nil, err
+		}
 	}
 	return &p, nil
 }
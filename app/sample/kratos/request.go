@@ -2,18 +2,29 @@ package kratos
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"kratos_example/logging"
 	"log/slog"
 	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
 )
 
+// Kratos へのリクエストのタイムアウト
+// Kratos が応答しない場合に、リクエストを処理する goroutine が滞留しないようにする
+const kratosRequestTimeout = 10 * time.Second
+
 type requestKratosInput struct {
-	Method     string
-	Path       string
-	BodyBytes  []byte
-	Cookie     string
-	RemoteAddr string
+	Method    string
+	Path      string
+	BodyBytes []byte
+	Cookie    string
+	ClientIP  string
 }
 
 type requestKratosOutput struct {
@@ -22,46 +33,74 @@ type requestKratosOutput struct {
 	StatusCode int
 }
 
-func (p *Provider) requestKratosPublic(i requestKratosInput) (requestKratosOutput, error) {
-	slog.Info(pkgVars.kratosPublicEndpoint)
-	return requestKratos(pkgVars.kratosPublicEndpoint, i)
+func (p *Provider) requestKratosPublic(ctx context.Context, i requestKratosInput) (requestKratosOutput, error) {
+	return p.requestKratos(ctx, p.c.KratosPublicEndpoint, i)
 }
 
-func (p *Provider) requestKratosAdmin(i requestKratosInput) (requestKratosOutput, error) {
-	return requestKratos(pkgVars.kratosAdminEndpoint, i)
+func (p *Provider) requestKratosAdmin(ctx context.Context, i requestKratosInput) (requestKratosOutput, error) {
+	return p.requestKratos(ctx, p.c.KratosAdminEndpoint, i)
 }
 
-func requestKratos(endpoint string, i requestKratosInput) (requestKratosOutput, error) {
-	slog.Info(fmt.Sprintf("%s%s", endpoint, i.Path))
-	req, err := http.NewRequest(
+func (p *Provider) requestKratos(ctx context.Context, endpoint string, i requestKratosInput) (requestKratosOutput, error) {
+	ctx, span := p.startRequestSpan(ctx, endpoint, i)
+	defer span.End()
+
+	req, err := http.NewRequestWithContext(
+		ctx,
 		i.Method,
 		fmt.Sprintf("%s%s", endpoint, i.Path),
 		bytes.NewBuffer(i.BodyBytes))
 	if err != nil {
-		slog.Error("NewRequestError", "Error", err)
+		slog.ErrorContext(ctx, "NewRequestError", "Error", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 		return requestKratosOutput{}, err
 	}
 	req.Header.Set("Cookie", i.Cookie)
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
-	req.Header.Set("True-Client-IP", i.RemoteAddr)
-	// req.Header.Set("X-Forwarded-For", i.RemoteAddr)
-	slog.Info(fmt.Sprintf("%v", req))
+	// クライアントのIPアドレスを Kratos へ転送 (レート制限、セッションのデバイス情報等に使用される)
+	// アプリ自身がプロキシとなるため、信頼できるプロキシを経由した場合も、解決済みのIPアドレスのみを送信する
+	if i.ClientIP != "" {
+		req.Header.Set("True-Client-IP", i.ClientIP)
+		req.Header.Set("X-Forwarded-For", i.ClientIP)
+	}
+	// Kratos のログと突き合わせられるよう、リクエストIDを転送する
+	if requestID := logging.RequestIDFromContext(ctx); requestID != "" {
+		req.Header.Set("X-Request-ID", requestID)
+	}
+	// トレースコンテキスト(traceparent)を転送する
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
 
-	client := new(http.Client)
+	start := time.Now()
+	client := &http.Client{Timeout: kratosRequestTimeout}
 	resp, err := client.Do(req)
 	if err != nil {
-		slog.Error("http error", "Error", err)
+		slog.ErrorContext(ctx, "http error", "Error", err, "method", i.Method, "path", i.Path)
+		p.metrics.observeRequest(ctx, time.Since(start).Seconds(), 0, "")
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 		return requestKratosOutput{}, err
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		slog.Error(err.Error())
+		slog.ErrorContext(ctx, err.Error())
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 		return requestKratosOutput{}, err
 	}
-	slog.Info(string(body))
+	errorID := endRequestSpan(span, i, resp.StatusCode, body)
+	p.metrics.observeRequest(ctx, time.Since(start).Seconds(), resp.StatusCode, errorID)
+	// リクエスト、レスポンスの本文には Cookie、パスワード、csrf_token 等が含まれるため出力しない
+	slog.DebugContext(ctx, "[Kratos]",
+		"method", i.Method,
+		"path", i.Path,
+		"status", resp.StatusCode,
+		"latency", time.Since(start),
+		"errorID", errorID,
+	)
 	return requestKratosOutput{
 		BodyBytes:  body,
 		Header:     resp.Header,
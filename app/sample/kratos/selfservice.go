@@ -1,12 +1,17 @@
 package kratos
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
@@ -29,13 +34,18 @@ const (
 	PATH_SELF_SERVICE_UPDATE_RECOVERY_FLOW     = "/self-service/recovery"
 	PATH_SELF_SERVICE_GET_RECOVERY_FLOW        = "/self-service/recovery/flows"
 	PATH_SELF_SERVICE_CALLBACK_OIDC            = "/self-service/methods/oidc/callback"
+	PATH_SELF_SERVICE_GET_FLOW_ERROR           = "/self-service/errors"
 	PATH_ADMIN_LIST_IDENTITIES                 = "/admin/identities"
 )
 
+// login, registration, recovery, settings flow の有効期限切れ (410 Gone もしくは self_service_flow_expired)
+// 作成し直した flow で再度送信する必要がある
+var ErrFlowExpired = errors.New("kratos: self-service flow expired")
+
 // ------------------------- Session -------------------------
 type WhoamiInput struct {
-	Cookie     string
-	RemoteAddr string
+	Cookie   string
+	ClientIP string
 }
 
 type WhoamiOutput struct {
@@ -44,34 +54,77 @@ type WhoamiOutput struct {
 	ErrorMessages []string
 }
 
-func (p *Provider) Whoami(i WhoamiInput) (WhoamiOutput, error) {
+// セッションの取得
+// セッションCookieごとに結果をキャッシュし、同時に送信されたリクエストの呼び出しは1回にまとめる
+func (p *Provider) Whoami(ctx context.Context, i WhoamiInput) (WhoamiOutput, error) {
+	ctx, span := p.startSpan(ctx, "Whoami")
+	defer span.End()
+
+	key := p.whoamiCacheKey(i.Cookie)
+	if !p.whoamiCacheEnabled() || key == "" {
+		return p.whoami(ctx, i)
+	}
+
+	if session, ok := p.getCachedWhoami(ctx, key); ok {
+		if p.tokenVerifier == nil {
+			span.SetAttributes(attribute.Bool("kratos.whoami.cache_hit", true))
+			return WhoamiOutput{Session: session}, nil
+		}
+		// トークン化している場合は、キャッシュしたJWTをローカルで検証し、有効期限切れの場合は Whoami を呼び出す
+		tokenSession, err := p.tokenVerifier.Verify(session.Tokenized)
+		if err == nil {
+			span.SetAttributes(attribute.Bool("kratos.whoami.cache_hit", true))
+			return WhoamiOutput{Session: tokenSession}, nil
+		}
+		slog.Info("cached session token is not valid", "Error", err)
+	}
+	return p.whoamiGroup.do(key, func(c *singleflightCall) (WhoamiOutput, error) {
+		// 待機中の他のリクエストと結果を共有するため、最初のリクエストがキャンセルされても最後まで実行する
+		flightCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), kratosRequestTimeout)
+		defer cancel()
+		output, err := p.whoami(flightCtx, i)
+		// 認証済みの場合のみキャッシュする
+		if err == nil && output.Session != nil {
+			p.cacheWhoami(flightCtx, key, output.Session, c.forgotten.Load)
+		}
+		return output, err
+	})
+}
+
+func (p *Provider) whoami(ctx context.Context, i WhoamiInput) (WhoamiOutput, error) {
 	var output WhoamiOutput
 
-	kratosOutput, err := p.requestKratosPublic(requestKratosInput{
-		Method:     http.MethodGet,
-		Path:       PATH_SESSIONS_WHOAMI,
-		Cookie:     i.Cookie,
-		RemoteAddr: i.RemoteAddr,
+	path := PATH_SESSIONS_WHOAMI
+	if p.c.TokenizeTemplate != "" {
+		path = fmt.Sprintf("%s?tokenize_as=%s", path, p.c.TokenizeTemplate)
+	}
+	kratosOutput, err := p.requestKratosPublic(ctx, requestKratosInput{
+		Method:   http.MethodGet,
+		Path:     path,
+		Cookie:   i.Cookie,
+		ClientIP: i.ClientIP,
 	})
 	if err != nil {
 		slog.Error("requestKratosPublic error", "Error", err)
 		return output, err
 	}
 
-	slog.Info(string(kratosOutput.BodyBytes))
-	slog.Info(fmt.Sprintf("%v", kratosOutput))
-
 	// error handling
+	// 401, 403 は未ログイン(セッションなし)として、エラーとはしない
+	// それ以外はセッションの有無を判定できないため、エラーを返却する
 	if kratosOutput.StatusCode != http.StatusOK {
 		var errGeneric errorGeneric
 		if err := json.Unmarshal(kratosOutput.BodyBytes, &errGeneric); err != nil {
 			slog.Error(err.Error())
 			return output, err
 		}
-		slog.Info(fmt.Sprintf("%v", errGeneric))
+		logGenericError(errGeneric.Error)
 		output.ErrorMessages = getErrorMessagesFromGenericError(errGeneric.Error)
 		output.Cookies = kratosOutput.Header["Set-Cookie"]
-		return output, err
+		if kratosOutput.StatusCode != http.StatusUnauthorized && kratosOutput.StatusCode != http.StatusForbidden {
+			return output, fmt.Errorf("whoami: unexpected status code: %d", kratosOutput.StatusCode)
+		}
+		return output, nil
 	}
 
 	var session Session
@@ -79,14 +132,20 @@ func (p *Provider) Whoami(i WhoamiInput) (WhoamiOutput, error) {
 		slog.Error(err.Error())
 		return output, err
 	}
-	output.Session = &session
+	// トークン化している場合は、キャッシュの有無によらずJWTを検証し、JWTから復元したセッションを使用する
+	if p.tokenVerifier != nil {
+		tokenSession, err := p.tokenVerifier.Verify(session.Tokenized)
+		if err != nil {
+			return output, fmt.Errorf("whoami: %w", err)
+		}
+		output.Session = tokenSession
+	} else {
+		output.Session = &session
+	}
 
 	// browser flowでは、kartosから受け取ったcookieをそのままブラウザへ返却する
 	output.Cookies = kratosOutput.Header["Set-Cookie"]
 
-	slog.Info(fmt.Sprintf("%v", output.Session))
-	slog.Info(fmt.Sprintf("%v", output.Session.Identity))
-
 	return output, nil
 }
 
@@ -99,9 +158,9 @@ const (
 )
 
 type GetRegistrationFlowInput struct {
-	Cookie     string
-	RemoteAddr string
-	FlowID     string
+	Cookie   string
+	ClientIP string
+	FlowID   string
 }
 
 type GetRegistrationFlowOutput struct {
@@ -115,17 +174,20 @@ type GetRegistrationFlowOutput struct {
 	ErrorMessages     []string
 }
 
-func (p *Provider) GetRegistrationFlow(i GetRegistrationFlowInput) (GetRegistrationFlowOutput, error) {
+func (p *Provider) GetRegistrationFlow(ctx context.Context, i GetRegistrationFlowInput) (GetRegistrationFlowOutput, error) {
+	ctx, span := p.startSpan(ctx, "GetRegistrationFlow")
+	defer span.End()
+
 	var (
 		err    error
 		output GetRegistrationFlowOutput
 	)
 
-	kratosOutput, err := p.requestKratosPublic(requestKratosInput{
-		Method:     http.MethodGet,
-		Path:       fmt.Sprintf("%s?id=%s", PATH_SELF_SERVICE_GET_REGISTRATION_FLOW, i.FlowID),
-		Cookie:     i.Cookie,
-		RemoteAddr: i.RemoteAddr,
+	kratosOutput, err := p.requestKratosPublic(ctx, requestKratosInput{
+		Method:   http.MethodGet,
+		Path:     fmt.Sprintf("%s?id=%s", PATH_SELF_SERVICE_GET_REGISTRATION_FLOW, i.FlowID),
+		Cookie:   i.Cookie,
+		ClientIP: i.ClientIP,
 	})
 	if err != nil {
 		slog.Error("requestKratosPublic error", "Error", err)
@@ -139,12 +201,17 @@ func (p *Provider) GetRegistrationFlow(i GetRegistrationFlowInput) (GetRegistrat
 
 	// error handling
 	if kratosOutput.StatusCode != http.StatusOK {
+		// 有効期限切れの場合は、flow を作成し直せるよう ErrFlowExpired を返却する
+		if messages, cookies, err := flowExpiredOutput(ctx, kratosOutput, i.FlowID); err != nil {
+			output.ErrorMessages, output.Cookies = messages, cookies
+			return output, err
+		}
 		var errGeneric errorGeneric
 		if err := json.Unmarshal(kratosOutput.BodyBytes, &errGeneric); err != nil {
 			slog.Error(err.Error())
 			return output, err
 		}
-		slog.Info(fmt.Sprintf("%v", errGeneric))
+		logGenericError(errGeneric.Error)
 		output.ErrorMessages = getErrorMessagesFromGenericError(errGeneric.Error)
 		output.Cookies = kratosOutput.Header["Set-Cookie"]
 		return output, err
@@ -161,7 +228,6 @@ func (p *Provider) GetRegistrationFlow(i GetRegistrationFlowInput) (GetRegistrat
 		output.RenderingType = RegistrationRenderingTypeOidc
 		var traits Traits
 		for _, node := range kratosRespBody.Ui.Nodes {
-			slog.Info(fmt.Sprintf("%v", node))
 			if node.Attributes.Name == "traits.email" {
 				traits.Email, _ = node.Attributes.Value.(string)
 			}
@@ -176,7 +242,7 @@ func (p *Provider) GetRegistrationFlow(i GetRegistrationFlowInput) (GetRegistrat
 			}
 			if node.Attributes.Name == "traits.birthdate" {
 				if birthdate, ok := node.Attributes.Value.(string); ok {
-					traits.Birthdate, _ = time.Parse(pkgVars.birthdateFormat, birthdate)
+					traits.Birthdate, _ = time.Parse(p.c.BirthdateFormat, birthdate)
 				}
 			}
 		}
@@ -193,15 +259,13 @@ func (p *Provider) GetRegistrationFlow(i GetRegistrationFlowInput) (GetRegistrat
 	// browser flowでは、kartosから受け取ったcookieをそのままブラウザへ返却する
 	output.Cookies = kratosOutput.Header["Set-Cookie"]
 
-	slog.Info(fmt.Sprintf("%v", output))
-
 	return output, nil
 }
 
 type CreateRegistrationFlowInput struct {
-	Cookie     string
-	RemoteAddr string
-	ReturnTo   string
+	Cookie   string
+	ClientIP string
+	ReturnTo string
 }
 
 type CreateRegistrationFlowOutput struct {
@@ -214,7 +278,10 @@ type CreateRegistrationFlowOutput struct {
 	ErrorMessages     []string
 }
 
-func (p *Provider) CreateRegistrationFlow(i CreateRegistrationFlowInput) (CreateRegistrationFlowOutput, error) {
+func (p *Provider) CreateRegistrationFlow(ctx context.Context, i CreateRegistrationFlowInput) (CreateRegistrationFlowOutput, error) {
+	ctx, span := p.startSpan(ctx, "CreateRegistrationFlow")
+	defer span.End()
+
 	var (
 		err    error
 		output CreateRegistrationFlowOutput
@@ -224,11 +291,11 @@ func (p *Provider) CreateRegistrationFlow(i CreateRegistrationFlowInput) (Create
 	if i.ReturnTo != "" {
 		path = fmt.Sprintf("%s?return_to=%s", path, i.ReturnTo)
 	}
-	kratosOutput, err := p.requestKratosPublic(requestKratosInput{
-		Method:     http.MethodGet,
-		Path:       path,
-		Cookie:     i.Cookie,
-		RemoteAddr: i.RemoteAddr,
+	kratosOutput, err := p.requestKratosPublic(ctx, requestKratosInput{
+		Method:   http.MethodGet,
+		Path:     path,
+		Cookie:   i.Cookie,
+		ClientIP: i.ClientIP,
 	})
 	if err != nil {
 		slog.Error("requestKratosPublic error", "Error", err)
@@ -248,7 +315,7 @@ func (p *Provider) CreateRegistrationFlow(i CreateRegistrationFlowInput) (Create
 			slog.Error(err.Error())
 			return output, err
 		}
-		slog.Info(fmt.Sprintf("%v", errGeneric))
+		logGenericError(errGeneric.Error)
 		output.ErrorMessages = getErrorMessagesFromGenericError(errGeneric.Error)
 		output.Cookies = kratosOutput.Header["Set-Cookie"]
 		return output, err
@@ -272,7 +339,7 @@ func (p *Provider) CreateRegistrationFlow(i CreateRegistrationFlowInput) (Create
 // Registration Flow の送信(完了)
 type UpdateRegistrationFlowInput struct {
 	Cookie          string
-	RemoteAddr      string
+	ClientIP        string
 	FlowID          string
 	Password        string
 	CsrfToken       string
@@ -289,7 +356,10 @@ type UpdateRegistrationFlowOutput struct {
 	ErrorMessages      []string
 }
 
-func (p *Provider) UpdateRegistrationFlow(i UpdateRegistrationFlowInput) (UpdateRegistrationFlowOutput, error) {
+func (p *Provider) UpdateRegistrationFlow(ctx context.Context, i UpdateRegistrationFlowInput) (UpdateRegistrationFlowOutput, error) {
+	ctx, span := p.startSpan(ctx, "UpdateRegistrationFlow")
+	defer span.End()
+
 	var (
 		output           UpdateRegistrationFlowOutput
 		kratosInputBytes []byte
@@ -341,13 +411,12 @@ func (p *Provider) UpdateRegistrationFlow(i UpdateRegistrationFlowInput) (Update
 		return output, fmt.Errorf("invalid method: %s", i.Method)
 	}
 
-	slog.Info(string(kratosInputBytes))
-	kratosOutput, err := p.requestKratosPublic(requestKratosInput{
-		Method:     http.MethodPost,
-		Path:       fmt.Sprintf("%s?flow=%s", PATH_SELF_SERVICE_UPDATE_REGISTRATION_FLOW, i.FlowID),
-		BodyBytes:  kratosInputBytes,
-		Cookie:     i.Cookie,
-		RemoteAddr: i.RemoteAddr,
+	kratosOutput, err := p.requestKratosPublic(ctx, requestKratosInput{
+		Method:    http.MethodPost,
+		Path:      fmt.Sprintf("%s?flow=%s", PATH_SELF_SERVICE_UPDATE_REGISTRATION_FLOW, i.FlowID),
+		BodyBytes: kratosInputBytes,
+		Cookie:    i.Cookie,
+		ClientIP:  i.ClientIP,
 	})
 	if err != nil {
 		slog.Error("requestKratosPublic error", "Error", err)
@@ -357,6 +426,11 @@ func (p *Provider) UpdateRegistrationFlow(i UpdateRegistrationFlowInput) (Update
 
 	// error handling
 	if kratosOutput.StatusCode != http.StatusOK {
+		// 有効期限切れの場合は、flow を作成し直せるよう ErrFlowExpired を返却する
+		if messages, cookies, err := flowExpiredOutput(ctx, kratosOutput, i.FlowID); err != nil {
+			output.ErrorMessages, output.Cookies = messages, cookies
+			return output, err
+		}
 		if kratosOutput.StatusCode == http.StatusBadRequest {
 			// status code 400 の場合のレスポンスボディのフォーマットは複数存在する
 			var flow kratosUpdateRegistrationFlowBadRequestErrorResponse
@@ -364,7 +438,6 @@ func (p *Provider) UpdateRegistrationFlow(i UpdateRegistrationFlowInput) (Update
 				slog.Error(err.Error())
 				return output, err
 			}
-			slog.Info(fmt.Sprintf("%v", flow))
 			if flow.Error != nil {
 				output.ErrorMessages = getErrorMessagesFromGenericError(*flow.Error)
 			} else if flow.Ui != nil {
@@ -379,7 +452,6 @@ func (p *Provider) UpdateRegistrationFlow(i UpdateRegistrationFlowInput) (Update
 				slog.Error(err.Error())
 				return output, err
 			}
-			slog.Info(fmt.Sprintf("%v", browserLocationChangeRequired))
 
 			// browser location changeが返却された場合は、リダイレクト先URLを設定
 			output.RedirectBrowserTo = browserLocationChangeRequired.RedirectBrowserTo
@@ -390,7 +462,7 @@ func (p *Provider) UpdateRegistrationFlow(i UpdateRegistrationFlowInput) (Update
 				slog.Error(err.Error())
 				return output, err
 			}
-			slog.Info(fmt.Sprintf("%v", errGeneric))
+			logGenericError(errGeneric.Error)
 			output.ErrorMessages = getErrorMessagesFromGenericError(errGeneric.Error)
 		}
 		output.Cookies = kratosOutput.Header["Set-Cookie"]
@@ -404,9 +476,7 @@ func (p *Provider) UpdateRegistrationFlow(i UpdateRegistrationFlowInput) (Update
 		return output, err
 	}
 
-	slog.Info(fmt.Sprintf("%v", flowPasswordResponse))
 	for _, c := range flowPasswordResponse.ContinueWith {
-		slog.Info(fmt.Sprintf("%v", c))
 		if c.Action == "show_verification_ui" {
 			output.VerificationFlowID = c.Flow.ID
 		}
@@ -422,9 +492,9 @@ func (p *Provider) UpdateRegistrationFlow(i UpdateRegistrationFlowInput) (Update
 
 // ------------------------- Verification Flow -------------------------
 type GetVerificationFlowInput struct {
-	Cookie     string
-	RemoteAddr string
-	FlowID     string
+	Cookie   string
+	ClientIP string
+	FlowID   string
 }
 
 type GetVerificationFlowOutput struct {
@@ -435,17 +505,20 @@ type GetVerificationFlowOutput struct {
 	ErrorMessages []string
 }
 
-func (p *Provider) GetVerificationFlow(i GetVerificationFlowInput) (GetVerificationFlowOutput, error) {
+func (p *Provider) GetVerificationFlow(ctx context.Context, i GetVerificationFlowInput) (GetVerificationFlowOutput, error) {
+	ctx, span := p.startSpan(ctx, "GetVerificationFlow")
+	defer span.End()
+
 	var (
 		err    error
 		output GetVerificationFlowOutput
 	)
 
-	kratosOutput, err := p.requestKratosPublic(requestKratosInput{
-		Method:     http.MethodGet,
-		Path:       fmt.Sprintf("%s?id=%s", PATH_SELF_SERVICE_GET_VERIFICATION_FLOW, i.FlowID),
-		Cookie:     i.Cookie,
-		RemoteAddr: i.RemoteAddr,
+	kratosOutput, err := p.requestKratosPublic(ctx, requestKratosInput{
+		Method:   http.MethodGet,
+		Path:     fmt.Sprintf("%s?id=%s", PATH_SELF_SERVICE_GET_VERIFICATION_FLOW, i.FlowID),
+		Cookie:   i.Cookie,
+		ClientIP: i.ClientIP,
 	})
 	if err != nil {
 		slog.Error("requestKratosPublic error", "Error", err)
@@ -464,7 +537,7 @@ func (p *Provider) GetVerificationFlow(i GetVerificationFlowInput) (GetVerificat
 			slog.Error(err.Error())
 			return output, err
 		}
-		slog.Info(fmt.Sprintf("%v", errGeneric))
+		logGenericError(errGeneric.Error)
 		output.ErrorMessages = getErrorMessagesFromGenericError(errGeneric.Error)
 		output.Cookies = kratosOutput.Header["Set-Cookie"]
 		return output, err
@@ -485,9 +558,9 @@ func (p *Provider) GetVerificationFlow(i GetVerificationFlowInput) (GetVerificat
 }
 
 type CreateVerificationFlowInput struct {
-	Cookie     string
-	RemoteAddr string
-	ReturnTo   string
+	Cookie   string
+	ClientIP string
+	ReturnTo string
 }
 
 type CreateVerificationFlowOutput struct {
@@ -497,7 +570,10 @@ type CreateVerificationFlowOutput struct {
 	ErrorMessages []string
 }
 
-func (p *Provider) CreateVerificationFlow(i CreateVerificationFlowInput) (CreateVerificationFlowOutput, error) {
+func (p *Provider) CreateVerificationFlow(ctx context.Context, i CreateVerificationFlowInput) (CreateVerificationFlowOutput, error) {
+	ctx, span := p.startSpan(ctx, "CreateVerificationFlow")
+	defer span.End()
+
 	var (
 		err    error
 		output CreateVerificationFlowOutput
@@ -507,11 +583,11 @@ func (p *Provider) CreateVerificationFlow(i CreateVerificationFlowInput) (Create
 	if i.ReturnTo != "" {
 		path = fmt.Sprintf("%s?return_to=%s", path, i.ReturnTo)
 	}
-	kratosOutput, err := p.requestKratosPublic(requestKratosInput{
-		Method:     http.MethodGet,
-		Path:       path,
-		Cookie:     i.Cookie,
-		RemoteAddr: i.RemoteAddr,
+	kratosOutput, err := p.requestKratosPublic(ctx, requestKratosInput{
+		Method:   http.MethodGet,
+		Path:     path,
+		Cookie:   i.Cookie,
+		ClientIP: i.ClientIP,
 	})
 	if err != nil {
 		slog.Error("requestKratosPublic error", "Error", err)
@@ -531,7 +607,7 @@ func (p *Provider) CreateVerificationFlow(i CreateVerificationFlowInput) (Create
 			slog.Error(err.Error())
 			return output, err
 		}
-		slog.Info(fmt.Sprintf("%v", errGeneric))
+		logGenericError(errGeneric.Error)
 		output.ErrorMessages = getErrorMessagesFromGenericError(errGeneric.Error)
 		output.Cookies = kratosOutput.Header["Set-Cookie"]
 		return output, err
@@ -548,12 +624,12 @@ func (p *Provider) CreateVerificationFlow(i CreateVerificationFlowInput) (Create
 
 // Verification Flow の送信(完了)
 type UpdateVerificationFlowInput struct {
-	Cookie     string
-	RemoteAddr string
-	FlowID     string
-	Code       string
-	Email      string
-	CsrfToken  string
+	Cookie    string
+	ClientIP  string
+	FlowID    string
+	Code      string
+	Email     string
+	CsrfToken string
 }
 
 type UpdateVerificationFlowOutput struct {
@@ -561,7 +637,10 @@ type UpdateVerificationFlowOutput struct {
 	ErrorMessages []string
 }
 
-func (p *Provider) UpdateVerificationFlow(i UpdateVerificationFlowInput) (UpdateVerificationFlowOutput, error) {
+func (p *Provider) UpdateVerificationFlow(ctx context.Context, i UpdateVerificationFlowInput) (UpdateVerificationFlowOutput, error) {
+	ctx, span := p.startSpan(ctx, "UpdateVerificationFlow")
+	defer span.End()
+
 	var (
 		output      UpdateVerificationFlowOutput
 		kratosInput kratosUpdateVerificationFlowRequest
@@ -593,12 +672,12 @@ func (p *Provider) UpdateVerificationFlow(i UpdateVerificationFlowInput) (Update
 	}
 
 	// Verification Flow の送信(完了)
-	kratosOutput, err := p.requestKratosPublic(requestKratosInput{
-		Method:     http.MethodPost,
-		Path:       fmt.Sprintf("%s?flow=%s", PATH_SELF_SERVICE_UPDATE_VERIFICATION_FLOW, i.FlowID),
-		BodyBytes:  kratosInputBytes,
-		Cookie:     i.Cookie,
-		RemoteAddr: i.RemoteAddr,
+	kratosOutput, err := p.requestKratosPublic(ctx, requestKratosInput{
+		Method:    http.MethodPost,
+		Path:      fmt.Sprintf("%s?flow=%s", PATH_SELF_SERVICE_UPDATE_VERIFICATION_FLOW, i.FlowID),
+		BodyBytes: kratosInputBytes,
+		Cookie:    i.Cookie,
+		ClientIP:  i.ClientIP,
 	})
 	if err != nil {
 		slog.Error("requestKratosPublic error", "Error", err)
@@ -614,7 +693,6 @@ func (p *Provider) UpdateVerificationFlow(i UpdateVerificationFlowInput) (Update
 				slog.Error(err.Error())
 				return output, err
 			}
-			slog.Info(fmt.Sprintf("%v", flow))
 			if flow.Error != nil {
 				output.ErrorMessages = getErrorMessagesFromGenericError(*flow.Error)
 			} else if flow.Ui != nil {
@@ -629,7 +707,7 @@ func (p *Provider) UpdateVerificationFlow(i UpdateVerificationFlowInput) (Update
 				slog.Error(err.Error())
 				return output, err
 			}
-			slog.Info(fmt.Sprintf("%v", errGeneric))
+			logGenericError(errGeneric.Error)
 			output.ErrorMessages = getErrorMessagesFromGenericError(errGeneric.Error)
 		}
 		output.Cookies = kratosOutput.Header["Set-Cookie"]
@@ -643,9 +721,9 @@ func (p *Provider) UpdateVerificationFlow(i UpdateVerificationFlowInput) (Update
 
 // ------------------------- Login Flow -------------------------
 type GetLoginFlowInput struct {
-	Cookie     string
-	RemoteAddr string
-	FlowID     string
+	Cookie   string
+	ClientIP string
+	FlowID   string
 }
 
 type GetLoginFlowOutput struct {
@@ -657,17 +735,20 @@ type GetLoginFlowOutput struct {
 	DuplicateIdentifier string
 }
 
-func (p *Provider) GetLoginFlow(i GetLoginFlowInput) (GetLoginFlowOutput, error) {
+func (p *Provider) GetLoginFlow(ctx context.Context, i GetLoginFlowInput) (GetLoginFlowOutput, error) {
+	ctx, span := p.startSpan(ctx, "GetLoginFlow")
+	defer span.End()
+
 	var (
 		err    error
 		output GetLoginFlowOutput
 	)
 
-	kratosOutput, err := p.requestKratosPublic(requestKratosInput{
-		Method:     http.MethodGet,
-		Path:       fmt.Sprintf("%s?id=%s", PATH_SELF_SERVICE_GET_LOGIN_FLOW, i.FlowID),
-		Cookie:     i.Cookie,
-		RemoteAddr: i.RemoteAddr,
+	kratosOutput, err := p.requestKratosPublic(ctx, requestKratosInput{
+		Method:   http.MethodGet,
+		Path:     fmt.Sprintf("%s?id=%s", PATH_SELF_SERVICE_GET_LOGIN_FLOW, i.FlowID),
+		Cookie:   i.Cookie,
+		ClientIP: i.ClientIP,
 	})
 	if err != nil {
 		slog.Error("requestKratosPublic error", "Error", err)
@@ -679,10 +760,13 @@ func (p *Provider) GetLoginFlow(i GetLoginFlowInput) (GetLoginFlowOutput, error)
 		return output, err
 	}
 
-	slog.Info(string(kratosOutput.BodyBytes))
-
 	// error handling
 	if kratosOutput.StatusCode != http.StatusOK {
+		// 有効期限切れの場合は、flow を作成し直せるよう ErrFlowExpired を返却する
+		if messages, cookies, err := flowExpiredOutput(ctx, kratosOutput, i.FlowID); err != nil {
+			output.ErrorMessages, output.Cookies = messages, cookies
+			return output, err
+		}
 		if kratosOutput.StatusCode == http.StatusBadRequest {
 			// status code 400 の場合のレスポンスボディのフォーマットは複数存在する
 			var flow kratosUpdateLoginFlowBadRequestErrorResponse
@@ -690,7 +774,6 @@ func (p *Provider) GetLoginFlow(i GetLoginFlowInput) (GetLoginFlowOutput, error)
 				slog.Error(err.Error())
 				return output, err
 			}
-			slog.Info(fmt.Sprintf("%v", flow))
 			if flow.Error != nil {
 				output.ErrorMessages = getErrorMessagesFromGenericError(*flow.Error)
 			} else if flow.Ui != nil {
@@ -705,7 +788,7 @@ func (p *Provider) GetLoginFlow(i GetLoginFlowInput) (GetLoginFlowOutput, error)
 				slog.Error(err.Error())
 				return output, err
 			}
-			slog.Info(fmt.Sprintf("%v", errGeneric))
+			logGenericError(errGeneric.Error)
 			output.ErrorMessages = getErrorMessagesFromGenericError(errGeneric.Error)
 		}
 		output.Cookies = kratosOutput.Header["Set-Cookie"]
@@ -728,11 +811,11 @@ func (p *Provider) GetLoginFlow(i GetLoginFlowInput) (GetLoginFlowOutput, error)
 }
 
 type CreateLoginFlowInput struct {
-	Cookie     string
-	RemoteAddr string
-	FlowID     string
-	Refresh    bool
-	ReturnTo   string
+	Cookie   string
+	ClientIP string
+	FlowID   string
+	Refresh  bool
+	ReturnTo string
 }
 
 type CreateLoginFlowOutput struct {
@@ -743,7 +826,10 @@ type CreateLoginFlowOutput struct {
 	ErrorMessages    []string
 }
 
-func (p *Provider) CreateLoginFlow(i CreateLoginFlowInput) (CreateLoginFlowOutput, error) {
+func (p *Provider) CreateLoginFlow(ctx context.Context, i CreateLoginFlowInput) (CreateLoginFlowOutput, error) {
+	ctx, span := p.startSpan(ctx, "CreateLoginFlow")
+	defer span.End()
+
 	var (
 		err    error
 		output CreateLoginFlowOutput
@@ -756,11 +842,11 @@ func (p *Provider) CreateLoginFlow(i CreateLoginFlowInput) (CreateLoginFlowOutpu
 	if i.Refresh {
 		path = fmt.Sprintf("%s?refresh=true", path)
 	}
-	kratosOutput, err := p.requestKratosPublic(requestKratosInput{
-		Method:     http.MethodGet,
-		Path:       path,
-		Cookie:     i.Cookie,
-		RemoteAddr: i.RemoteAddr,
+	kratosOutput, err := p.requestKratosPublic(ctx, requestKratosInput{
+		Method:   http.MethodGet,
+		Path:     path,
+		Cookie:   i.Cookie,
+		ClientIP: i.ClientIP,
 	})
 	if err != nil {
 		slog.Error("requestKratosPublic error", "Error", err)
@@ -780,7 +866,7 @@ func (p *Provider) CreateLoginFlow(i CreateLoginFlowInput) (CreateLoginFlowOutpu
 			slog.Error(err.Error())
 			return output, err
 		}
-		slog.Info(fmt.Sprintf("%v", errGeneric))
+		logGenericError(errGeneric.Error)
 		output.ErrorMessages = getErrorMessagesFromGenericError(errGeneric.Error)
 		output.Cookies = kratosOutput.Header["Set-Cookie"]
 		return output, err
@@ -802,7 +888,7 @@ func (p *Provider) CreateLoginFlow(i CreateLoginFlowInput) (CreateLoginFlowOutpu
 
 type UpdateLoginFlowInput struct {
 	Cookie     string
-	RemoteAddr string
+	ClientIP   string
 	FlowID     string
 	CsrfToken  string
 	Identifier string
@@ -811,12 +897,19 @@ type UpdateLoginFlowInput struct {
 
 type UpdateLoginFlowOutput struct {
 	Cookies           []string
+	Session           *Session
 	RedirectBrowserTo string
 	ErrorMessages     []string
 }
 
 // Login Flow の送信(完了)
-func (p *Provider) UpdateLoginFlow(i UpdateLoginFlowInput) (UpdateLoginFlowOutput, error) {
+func (p *Provider) UpdateLoginFlow(ctx context.Context, i UpdateLoginFlowInput) (UpdateLoginFlowOutput, error) {
+	ctx, span := p.startSpan(ctx, "UpdateLoginFlow")
+	defer span.End()
+
+	// セッションの状態(認証時刻、プロフィール等)が変わるため、処理後にキャッシュを削除
+	defer p.invalidateWhoamiCache(ctx, i.Cookie)
+
 	var (
 		output           UpdateLoginFlowOutput
 		kratosInputBytes []byte
@@ -835,12 +928,12 @@ func (p *Provider) UpdateLoginFlow(i UpdateLoginFlowInput) (UpdateLoginFlowOutpu
 		return output, err
 	}
 
-	kratosOutput, err := p.requestKratosPublic(requestKratosInput{
-		Method:     http.MethodPost,
-		Path:       fmt.Sprintf("%s?flow=%s", PATH_SELF_SERVICE_UPDATE_LOGIN_FLOW, i.FlowID),
-		BodyBytes:  kratosInputBytes,
-		Cookie:     i.Cookie,
-		RemoteAddr: i.RemoteAddr,
+	kratosOutput, err := p.requestKratosPublic(ctx, requestKratosInput{
+		Method:    http.MethodPost,
+		Path:      fmt.Sprintf("%s?flow=%s", PATH_SELF_SERVICE_UPDATE_LOGIN_FLOW, i.FlowID),
+		BodyBytes: kratosInputBytes,
+		Cookie:    i.Cookie,
+		ClientIP:  i.ClientIP,
 	})
 	if err != nil {
 		slog.Error("requestKratosPublic error", "Error", err)
@@ -849,6 +942,11 @@ func (p *Provider) UpdateLoginFlow(i UpdateLoginFlowInput) (UpdateLoginFlowOutpu
 
 	// error handling
 	if kratosOutput.StatusCode != http.StatusOK {
+		// 有効期限切れの場合は、flow を作成し直せるよう ErrFlowExpired を返却する
+		if messages, cookies, err := flowExpiredOutput(ctx, kratosOutput, i.FlowID); err != nil {
+			output.ErrorMessages, output.Cookies = messages, cookies
+			return output, err
+		}
 		if kratosOutput.StatusCode == http.StatusBadRequest {
 			// status code 400 の場合のレスポンスボディのフォーマットは複数存在する
 			var flow kratosUpdateLoginFlowBadRequestErrorResponse
@@ -856,7 +954,6 @@ func (p *Provider) UpdateLoginFlow(i UpdateLoginFlowInput) (UpdateLoginFlowOutpu
 				slog.Error(err.Error())
 				return output, err
 			}
-			slog.Info(fmt.Sprintf("%v", flow))
 			if flow.Error != nil {
 				output.ErrorMessages = getErrorMessagesFromGenericError(*flow.Error)
 			} else if flow.Ui != nil {
@@ -871,7 +968,6 @@ func (p *Provider) UpdateLoginFlow(i UpdateLoginFlowInput) (UpdateLoginFlowOutpu
 				slog.Error(err.Error())
 				return output, err
 			}
-			slog.Info(fmt.Sprintf("%v", browserLocationChangeRequired))
 
 			// browser location changeが返却された場合は、リダイレクト先URLを設定
 			output.RedirectBrowserTo = browserLocationChangeRequired.RedirectBrowserTo
@@ -882,7 +978,7 @@ func (p *Provider) UpdateLoginFlow(i UpdateLoginFlowInput) (UpdateLoginFlowOutpu
 				slog.Error(err.Error())
 				return output, err
 			}
-			slog.Info(fmt.Sprintf("%v", errGeneric))
+			logGenericError(errGeneric.Error)
 			output.ErrorMessages = getErrorMessagesFromGenericError(errGeneric.Error)
 		}
 		output.Cookies = kratosOutput.Header["Set-Cookie"]
@@ -890,6 +986,14 @@ func (p *Provider) UpdateLoginFlow(i UpdateLoginFlowInput) (UpdateLoginFlowOutpu
 		return output, err
 	}
 
+	// ログインしたユーザのセッション
+	var kratosRespBody kratosUpdateLoginFlowRespnse
+	if err := json.Unmarshal(kratosOutput.BodyBytes, &kratosRespBody); err != nil {
+		slog.Error(err.Error())
+		return output, err
+	}
+	output.Session = &kratosRespBody.Session
+
 	// browser flowでは、kartosから受け取ったcookieをそのままブラウザへ返却する
 	output.Cookies = kratosOutput.Header["Set-Cookie"]
 
@@ -897,11 +1001,11 @@ func (p *Provider) UpdateLoginFlow(i UpdateLoginFlowInput) (UpdateLoginFlowOutpu
 }
 
 type UpdateOidcLoginFlowInput struct {
-	Cookie     string
-	RemoteAddr string
-	FlowID     string
-	CsrfToken  string
-	Provider   string
+	Cookie    string
+	ClientIP  string
+	FlowID    string
+	CsrfToken string
+	Provider  string
 }
 
 type UpdateOidcLoginFlowOutput struct {
@@ -910,7 +1014,10 @@ type UpdateOidcLoginFlowOutput struct {
 	ErrorMessages     []string
 }
 
-func (p *Provider) UpdateOidcLoginFlow(i UpdateOidcLoginFlowInput) (UpdateOidcLoginFlowOutput, error) {
+func (p *Provider) UpdateOidcLoginFlow(ctx context.Context, i UpdateOidcLoginFlowInput) (UpdateOidcLoginFlowOutput, error) {
+	ctx, span := p.startSpan(ctx, "UpdateOidcLoginFlow")
+	defer span.End()
+
 	var (
 		output           UpdateOidcLoginFlowOutput
 		kratosInputBytes []byte
@@ -928,12 +1035,12 @@ func (p *Provider) UpdateOidcLoginFlow(i UpdateOidcLoginFlowInput) (UpdateOidcLo
 		return output, err
 	}
 
-	kratosOutput, err := p.requestKratosPublic(requestKratosInput{
-		Method:     http.MethodPost,
-		Path:       fmt.Sprintf("%s?flow=%s", PATH_SELF_SERVICE_UPDATE_LOGIN_FLOW, i.FlowID),
-		BodyBytes:  kratosInputBytes,
-		Cookie:     i.Cookie,
-		RemoteAddr: i.RemoteAddr,
+	kratosOutput, err := p.requestKratosPublic(ctx, requestKratosInput{
+		Method:    http.MethodPost,
+		Path:      fmt.Sprintf("%s?flow=%s", PATH_SELF_SERVICE_UPDATE_LOGIN_FLOW, i.FlowID),
+		BodyBytes: kratosInputBytes,
+		Cookie:    i.Cookie,
+		ClientIP:  i.ClientIP,
 	})
 	if err != nil {
 		slog.Error("requestKratosPublic error", "Error", err)
@@ -942,6 +1049,11 @@ func (p *Provider) UpdateOidcLoginFlow(i UpdateOidcLoginFlowInput) (UpdateOidcLo
 
 	// error handling
 	if kratosOutput.StatusCode != http.StatusOK {
+		// 有効期限切れの場合は、flow を作成し直せるよう ErrFlowExpired を返却する
+		if messages, cookies, err := flowExpiredOutput(ctx, kratosOutput, i.FlowID); err != nil {
+			output.ErrorMessages, output.Cookies = messages, cookies
+			return output, err
+		}
 		if kratosOutput.StatusCode == http.StatusBadRequest {
 			// status code 400 の場合のレスポンスボディのフォーマットは複数存在する
 			var flow kratosUpdateLoginFlowBadRequestErrorResponse
@@ -949,7 +1061,6 @@ func (p *Provider) UpdateOidcLoginFlow(i UpdateOidcLoginFlowInput) (UpdateOidcLo
 				slog.Error(err.Error())
 				return output, err
 			}
-			slog.Info(fmt.Sprintf("%v", flow))
 			if flow.Error != nil {
 				output.ErrorMessages = getErrorMessagesFromGenericError(*flow.Error)
 			} else if flow.Ui != nil {
@@ -964,7 +1075,6 @@ func (p *Provider) UpdateOidcLoginFlow(i UpdateOidcLoginFlowInput) (UpdateOidcLo
 				slog.Error(err.Error())
 				return output, err
 			}
-			slog.Info(fmt.Sprintf("%v", browserLocationChangeRequired))
 
 			// browser location changeが返却された場合は、リダイレクト先URLを設定
 			output.RedirectBrowserTo = browserLocationChangeRequired.RedirectBrowserTo
@@ -975,7 +1085,7 @@ func (p *Provider) UpdateOidcLoginFlow(i UpdateOidcLoginFlowInput) (UpdateOidcLo
 				slog.Error(err.Error())
 				return output, err
 			}
-			slog.Info(fmt.Sprintf("%v", errGeneric))
+			logGenericError(errGeneric.Error)
 			output.ErrorMessages = getErrorMessagesFromGenericError(errGeneric.Error)
 		}
 		output.Cookies = kratosOutput.Header["Set-Cookie"]
@@ -991,8 +1101,8 @@ func (p *Provider) UpdateOidcLoginFlow(i UpdateOidcLoginFlowInput) (UpdateOidcLo
 
 // ------------------------- Logout Flow -------------------------
 type LogoutFlowInput struct {
-	Cookie     string
-	RemoteAddr string
+	Cookie   string
+	ClientIP string
 }
 
 type LogoutFlowOutput struct {
@@ -1000,18 +1110,24 @@ type LogoutFlowOutput struct {
 	ErrorMessages []string
 }
 
-func (p *Provider) Logout(i LogoutFlowInput) (LogoutFlowOutput, error) {
+func (p *Provider) Logout(ctx context.Context, i LogoutFlowInput) (LogoutFlowOutput, error) {
+	ctx, span := p.startSpan(ctx, "Logout")
+	defer span.End()
+
+	// セッションの状態(認証時刻、プロフィール等)が変わるため、処理後にキャッシュを削除
+	defer p.invalidateWhoamiCache(ctx, i.Cookie)
+
 	var (
 		output LogoutFlowOutput
 		err    error
 	)
 
 	// create flow
-	kratosOutputCreateFlow, err := p.requestKratosPublic(requestKratosInput{
-		Method:     http.MethodGet,
-		Path:       PATH_SELF_SERVICE_GET_LOGOUT_FLOW,
-		Cookie:     i.Cookie,
-		RemoteAddr: i.RemoteAddr,
+	kratosOutputCreateFlow, err := p.requestKratosPublic(ctx, requestKratosInput{
+		Method:   http.MethodGet,
+		Path:     PATH_SELF_SERVICE_GET_LOGOUT_FLOW,
+		Cookie:   i.Cookie,
+		ClientIP: i.ClientIP,
 	})
 	if err != nil {
 		slog.Error("requestKratosPublic error", "Error", err)
@@ -1030,18 +1146,18 @@ func (p *Provider) Logout(i LogoutFlowInput) (LogoutFlowOutput, error) {
 			slog.Error(err.Error())
 			return output, err
 		}
-		slog.Info(fmt.Sprintf("%v", errGeneric))
+		logGenericError(errGeneric.Error)
 		output.ErrorMessages = getErrorMessagesFromGenericError(errGeneric.Error)
 		output.Cookies = kratosOutputCreateFlow.Header["Set-Cookie"]
 		return output, err
 	}
 
 	// update flow
-	kratosOutputUpdateFlow, err := p.requestKratosPublic(requestKratosInput{
-		Method:     http.MethodGet,
-		Path:       fmt.Sprintf("%s?flow=%s&token=%s", PATH_SELF_SERVICE_UPDATE_LOGOUT_FLOW, kratosRespBodyCreateFlow.ID, kratosRespBodyCreateFlow.LogoutToken),
-		Cookie:     i.Cookie,
-		RemoteAddr: i.RemoteAddr,
+	kratosOutputUpdateFlow, err := p.requestKratosPublic(ctx, requestKratosInput{
+		Method:   http.MethodGet,
+		Path:     fmt.Sprintf("%s?flow=%s&token=%s", PATH_SELF_SERVICE_UPDATE_LOGOUT_FLOW, kratosRespBodyCreateFlow.ID, kratosRespBodyCreateFlow.LogoutToken),
+		Cookie:   i.Cookie,
+		ClientIP: i.ClientIP,
 	})
 	if err != nil {
 		slog.Error("requestKratosPublic error", "Error", err)
@@ -1060,7 +1176,7 @@ func (p *Provider) Logout(i LogoutFlowInput) (LogoutFlowOutput, error) {
 			slog.Error(err.Error())
 			return output, err
 		}
-		slog.Info(fmt.Sprintf("%v", errGeneric))
+		logGenericError(errGeneric.Error)
 		output.ErrorMessages = getErrorMessagesFromGenericError(errGeneric.Error)
 		output.Cookies = kratosOutputUpdateFlow.Header["Set-Cookie"]
 		return output, err
@@ -1072,9 +1188,9 @@ func (p *Provider) Logout(i LogoutFlowInput) (LogoutFlowOutput, error) {
 
 // ------------------------- Recovery Flow -------------------------
 type GetRecoveryFlowInput struct {
-	Cookie     string
-	RemoteAddr string
-	FlowID     string
+	Cookie   string
+	ClientIP string
+	FlowID   string
 }
 
 type GetRecoveryFlowOutput struct {
@@ -1084,17 +1200,20 @@ type GetRecoveryFlowOutput struct {
 	ErrorMessages []string
 }
 
-func (p *Provider) GetRecoveryFlow(i GetRecoveryFlowInput) (GetRecoveryFlowOutput, error) {
+func (p *Provider) GetRecoveryFlow(ctx context.Context, i GetRecoveryFlowInput) (GetRecoveryFlowOutput, error) {
+	ctx, span := p.startSpan(ctx, "GetRecoveryFlow")
+	defer span.End()
+
 	var (
 		err    error
 		output GetRecoveryFlowOutput
 	)
 
-	kratosOutput, err := p.requestKratosPublic(requestKratosInput{
-		Method:     http.MethodGet,
-		Path:       fmt.Sprintf("%s?id=%s", PATH_SELF_SERVICE_GET_RECOVERY_FLOW, i.FlowID),
-		Cookie:     i.Cookie,
-		RemoteAddr: i.RemoteAddr,
+	kratosOutput, err := p.requestKratosPublic(ctx, requestKratosInput{
+		Method:   http.MethodGet,
+		Path:     fmt.Sprintf("%s?id=%s", PATH_SELF_SERVICE_GET_RECOVERY_FLOW, i.FlowID),
+		Cookie:   i.Cookie,
+		ClientIP: i.ClientIP,
 	})
 	if err != nil {
 		slog.Error("requestKratosPublic error", "Error", err)
@@ -1109,12 +1228,17 @@ func (p *Provider) GetRecoveryFlow(i GetRecoveryFlowInput) (GetRecoveryFlowOutpu
 
 	// error handling
 	if kratosOutput.StatusCode != http.StatusOK {
+		// 有効期限切れの場合は、flow を作成し直せるよう ErrFlowExpired を返却する
+		if messages, cookies, err := flowExpiredOutput(ctx, kratosOutput, i.FlowID); err != nil {
+			output.ErrorMessages, output.Cookies = messages, cookies
+			return output, err
+		}
 		var errGeneric errorGeneric
 		if err := json.Unmarshal(kratosOutput.BodyBytes, &errGeneric); err != nil {
 			slog.Error(err.Error())
 			return output, err
 		}
-		slog.Info(fmt.Sprintf("%v", errGeneric))
+		logGenericError(errGeneric.Error)
 		output.ErrorMessages = getErrorMessagesFromGenericError(errGeneric.Error)
 		output.Cookies = kratosOutput.Header["Set-Cookie"]
 		return output, err
@@ -1130,9 +1254,9 @@ func (p *Provider) GetRecoveryFlow(i GetRecoveryFlowInput) (GetRecoveryFlowOutpu
 }
 
 type CreateRecoveryFlowInput struct {
-	Cookie     string
-	RemoteAddr string
-	FlowID     string
+	Cookie   string
+	ClientIP string
+	FlowID   string
 }
 
 type CreateRecoveryFlowOutput struct {
@@ -1142,17 +1266,20 @@ type CreateRecoveryFlowOutput struct {
 	ErrorMessages []string
 }
 
-func (p *Provider) CreateRecoveryFlow(i CreateRecoveryFlowInput) (CreateRecoveryFlowOutput, error) {
+func (p *Provider) CreateRecoveryFlow(ctx context.Context, i CreateRecoveryFlowInput) (CreateRecoveryFlowOutput, error) {
+	ctx, span := p.startSpan(ctx, "CreateRecoveryFlow")
+	defer span.End()
+
 	var (
 		err    error
 		output CreateRecoveryFlowOutput
 	)
 
-	kratosOutput, err := p.requestKratosPublic(requestKratosInput{
-		Method:     http.MethodGet,
-		Path:       PATH_SELF_SERVICE_CREATE_RECOVERY_FLOW,
-		Cookie:     i.Cookie,
-		RemoteAddr: i.RemoteAddr,
+	kratosOutput, err := p.requestKratosPublic(ctx, requestKratosInput{
+		Method:   http.MethodGet,
+		Path:     PATH_SELF_SERVICE_CREATE_RECOVERY_FLOW,
+		Cookie:   i.Cookie,
+		ClientIP: i.ClientIP,
 	})
 	if err != nil {
 		slog.Error("requestKratosPublic error", "Error", err)
@@ -1172,7 +1299,7 @@ func (p *Provider) CreateRecoveryFlow(i CreateRecoveryFlowInput) (CreateRecovery
 			slog.Error(err.Error())
 			return output, err
 		}
-		slog.Info(fmt.Sprintf("%v", errGeneric))
+		logGenericError(errGeneric.Error)
 		output.ErrorMessages = getErrorMessagesFromGenericError(errGeneric.Error)
 		output.Cookies = kratosOutput.Header["Set-Cookie"]
 		return output, err
@@ -1188,12 +1315,12 @@ func (p *Provider) CreateRecoveryFlow(i CreateRecoveryFlowInput) (CreateRecovery
 }
 
 type UpdateRecoveryFlowInput struct {
-	Cookie     string
-	RemoteAddr string
-	FlowID     string
-	CsrfToken  string
-	Email      string
-	Code       string
+	Cookie    string
+	ClientIP  string
+	FlowID    string
+	CsrfToken string
+	Email     string
+	Code      string
 }
 
 type UpdateRecoveryFlowOutput struct {
@@ -1203,7 +1330,10 @@ type UpdateRecoveryFlowOutput struct {
 }
 
 // Recovery Flow の送信(完了)
-func (p *Provider) UpdateRecoveryFlow(i UpdateRecoveryFlowInput) (UpdateRecoveryFlowOutput, error) {
+func (p *Provider) UpdateRecoveryFlow(ctx context.Context, i UpdateRecoveryFlowInput) (UpdateRecoveryFlowOutput, error) {
+	ctx, span := p.startSpan(ctx, "UpdateRecoveryFlow")
+	defer span.End()
+
 	var (
 		output      UpdateRecoveryFlowOutput
 		kratosInput kratosUpdateRecoveryFlowRequest
@@ -1235,12 +1365,12 @@ func (p *Provider) UpdateRecoveryFlow(i UpdateRecoveryFlowInput) (UpdateRecovery
 	}
 
 	// Verification Flow の送信(完了)
-	kratosOutput, err := p.requestKratosPublic(requestKratosInput{
-		Method:     http.MethodPost,
-		Path:       fmt.Sprintf("%s?flow=%s", PATH_SELF_SERVICE_GET_RECOVERY_FLOW, i.FlowID),
-		BodyBytes:  kratosInputBytes,
-		Cookie:     i.Cookie,
-		RemoteAddr: i.RemoteAddr,
+	kratosOutput, err := p.requestKratosPublic(ctx, requestKratosInput{
+		Method:    http.MethodPost,
+		Path:      fmt.Sprintf("%s?flow=%s", PATH_SELF_SERVICE_GET_RECOVERY_FLOW, i.FlowID),
+		BodyBytes: kratosInputBytes,
+		Cookie:    i.Cookie,
+		ClientIP:  i.ClientIP,
 	})
 	if err != nil {
 		slog.Error("requestKratosPublic error", "Error", err)
@@ -1249,6 +1379,11 @@ func (p *Provider) UpdateRecoveryFlow(i UpdateRecoveryFlowInput) (UpdateRecovery
 
 	// error handling
 	if kratosOutput.StatusCode != http.StatusOK {
+		// 有効期限切れの場合は、flow を作成し直せるよう ErrFlowExpired を返却する
+		if messages, cookies, err := flowExpiredOutput(ctx, kratosOutput, i.FlowID); err != nil {
+			output.ErrorMessages, output.Cookies = messages, cookies
+			return output, err
+		}
 		if kratosOutput.StatusCode == http.StatusBadRequest {
 			// status code 400 の場合のレスポンスボディのフォーマットは複数存在する
 			var flow kratosUpdateSettingsFlowBadRequestErrorResponse
@@ -1256,7 +1391,6 @@ func (p *Provider) UpdateRecoveryFlow(i UpdateRecoveryFlowInput) (UpdateRecovery
 				slog.Error(err.Error())
 				return output, err
 			}
-			slog.Info(fmt.Sprintf("%v", flow))
 			if flow.Error != nil {
 				output.ErrorMessages = getErrorMessagesFromGenericError(*flow.Error)
 			} else if flow.Ui != nil {
@@ -1271,7 +1405,6 @@ func (p *Provider) UpdateRecoveryFlow(i UpdateRecoveryFlowInput) (UpdateRecovery
 				slog.Error(err.Error())
 				return output, err
 			}
-			slog.Info(fmt.Sprintf("%v", browserLocationChangeRequired))
 
 			// browser location changeが返却された場合は、リダイレクト先URLを設定
 			output.RedirectBrowserTo = browserLocationChangeRequired.RedirectBrowserTo
@@ -1282,7 +1415,7 @@ func (p *Provider) UpdateRecoveryFlow(i UpdateRecoveryFlowInput) (UpdateRecovery
 				slog.Error(err.Error())
 				return output, err
 			}
-			slog.Info(fmt.Sprintf("%v", errGeneric))
+			logGenericError(errGeneric.Error)
 			output.ErrorMessages = getErrorMessagesFromGenericError(errGeneric.Error)
 		}
 		output.Cookies = kratosOutput.Header["Set-Cookie"]
@@ -1298,9 +1431,9 @@ func (p *Provider) UpdateRecoveryFlow(i UpdateRecoveryFlowInput) (UpdateRecovery
 
 // ------------------------- Settings Flow -------------------------
 type GetSettingsFlowInput struct {
-	Cookie     string
-	RemoteAddr string
-	FlowID     string
+	Cookie   string
+	ClientIP string
+	FlowID   string
 }
 
 type GetSettingsFlowOutput struct {
@@ -1310,17 +1443,20 @@ type GetSettingsFlowOutput struct {
 	ErrorMessages []string
 }
 
-func (p *Provider) GetSettingsFlow(i GetSettingsFlowInput) (GetSettingsFlowOutput, error) {
+func (p *Provider) GetSettingsFlow(ctx context.Context, i GetSettingsFlowInput) (GetSettingsFlowOutput, error) {
+	ctx, span := p.startSpan(ctx, "GetSettingsFlow")
+	defer span.End()
+
 	var (
 		err    error
 		output GetSettingsFlowOutput
 	)
 
-	kratosOutput, err := p.requestKratosPublic(requestKratosInput{
-		Method:     http.MethodGet,
-		Path:       fmt.Sprintf("%s?id=%s", PATH_SELF_SERVICE_GET_SETTINGS_FLOW, i.FlowID),
-		Cookie:     i.Cookie,
-		RemoteAddr: i.RemoteAddr,
+	kratosOutput, err := p.requestKratosPublic(ctx, requestKratosInput{
+		Method:   http.MethodGet,
+		Path:     fmt.Sprintf("%s?id=%s", PATH_SELF_SERVICE_GET_SETTINGS_FLOW, i.FlowID),
+		Cookie:   i.Cookie,
+		ClientIP: i.ClientIP,
 	})
 	if err != nil {
 		slog.Error("requestKratosPublic error", "Error", err)
@@ -1334,12 +1470,17 @@ func (p *Provider) GetSettingsFlow(i GetSettingsFlowInput) (GetSettingsFlowOutpu
 
 	// error handling
 	if kratosOutput.StatusCode != http.StatusOK {
+		// 有効期限切れの場合は、flow を作成し直せるよう ErrFlowExpired を返却する
+		if messages, cookies, err := flowExpiredOutput(ctx, kratosOutput, i.FlowID); err != nil {
+			output.ErrorMessages, output.Cookies = messages, cookies
+			return output, err
+		}
 		var errGeneric errorGeneric
 		if err := json.Unmarshal(kratosOutput.BodyBytes, &errGeneric); err != nil {
 			slog.Error(err.Error())
 			return output, err
 		}
-		slog.Info(fmt.Sprintf("%v", errGeneric))
+		logGenericError(errGeneric.Error)
 		output.ErrorMessages = getErrorMessagesFromGenericError(errGeneric.Error)
 		output.Cookies = kratosOutput.Header["Set-Cookie"]
 		return output, err
@@ -1355,9 +1496,9 @@ func (p *Provider) GetSettingsFlow(i GetSettingsFlowInput) (GetSettingsFlowOutpu
 }
 
 type CreateSettingsFlowInput struct {
-	Cookie     string
-	RemoteAddr string
-	FlowID     string
+	Cookie   string
+	ClientIP string
+	FlowID   string
 }
 
 type CreateSettingsFlowOutput struct {
@@ -1367,17 +1508,20 @@ type CreateSettingsFlowOutput struct {
 	ErrorMessages []string
 }
 
-func (p *Provider) CreateSettingsFlow(i CreateSettingsFlowInput) (CreateSettingsFlowOutput, error) {
+func (p *Provider) CreateSettingsFlow(ctx context.Context, i CreateSettingsFlowInput) (CreateSettingsFlowOutput, error) {
+	ctx, span := p.startSpan(ctx, "CreateSettingsFlow")
+	defer span.End()
+
 	var (
 		err    error
 		output CreateSettingsFlowOutput
 	)
 
-	kratosOutput, err := p.requestKratosPublic(requestKratosInput{
-		Method:     http.MethodGet,
-		Path:       PATH_SELF_SERVICE_CREATE_SETTINGS_FLOW,
-		Cookie:     i.Cookie,
-		RemoteAddr: i.RemoteAddr,
+	kratosOutput, err := p.requestKratosPublic(ctx, requestKratosInput{
+		Method:   http.MethodGet,
+		Path:     PATH_SELF_SERVICE_CREATE_SETTINGS_FLOW,
+		Cookie:   i.Cookie,
+		ClientIP: i.ClientIP,
 	})
 	if err != nil {
 		slog.Error("requestKratosPublic error", "Error", err)
@@ -1397,7 +1541,7 @@ func (p *Provider) CreateSettingsFlow(i CreateSettingsFlowInput) (CreateSettings
 			slog.Error(err.Error())
 			return output, err
 		}
-		slog.Info(fmt.Sprintf("%v", errGeneric))
+		logGenericError(errGeneric.Error)
 		output.ErrorMessages = getErrorMessagesFromGenericError(errGeneric.Error)
 		output.Cookies = kratosOutput.Header["Set-Cookie"]
 		return output, err
@@ -1413,13 +1557,13 @@ func (p *Provider) CreateSettingsFlow(i CreateSettingsFlowInput) (CreateSettings
 }
 
 type UpdateSettingsFlowInput struct {
-	Cookie     string
-	RemoteAddr string
-	FlowID     string
-	CsrfToken  string
-	Method     string
-	Password   string
-	Traits     Traits
+	Cookie    string
+	ClientIP  string
+	FlowID    string
+	CsrfToken string
+	Method    string
+	Password  string
+	Traits    Traits
 }
 
 type UpdateSettingsFlowOutput struct {
@@ -1429,7 +1573,13 @@ type UpdateSettingsFlowOutput struct {
 }
 
 // Settings Flow (password) の送信(完了)
-func (p *Provider) UpdateSettingsFlow(i UpdateSettingsFlowInput) (UpdateSettingsFlowOutput, error) {
+func (p *Provider) UpdateSettingsFlow(ctx context.Context, i UpdateSettingsFlowInput) (UpdateSettingsFlowOutput, error) {
+	ctx, span := p.startSpan(ctx, "UpdateSettingsFlow")
+	defer span.End()
+
+	// セッションの状態(認証時刻、プロフィール等)が変わるため、処理後にキャッシュを削除
+	defer p.invalidateWhoamiCache(ctx, i.Cookie)
+
 	var (
 		output      UpdateSettingsFlowOutput
 		kratosInput kratosUpdateSettingsFlowRequest
@@ -1460,12 +1610,12 @@ func (p *Provider) UpdateSettingsFlow(i UpdateSettingsFlowInput) (UpdateSettings
 		return output, err
 	}
 
-	kratosOutput, err := p.requestKratosPublic(requestKratosInput{
-		Method:     http.MethodPost,
-		Path:       fmt.Sprintf("%s[?flow=%s", PATH_SELF_SERVICE_UPDATE_SETTINGS_FLOW, i.FlowID),
-		BodyBytes:  kratosInputBytes,
-		Cookie:     i.Cookie,
-		RemoteAddr: i.RemoteAddr,
+	kratosOutput, err := p.requestKratosPublic(ctx, requestKratosInput{
+		Method:    http.MethodPost,
+		Path:      fmt.Sprintf("%s?flow=%s", PATH_SELF_SERVICE_UPDATE_SETTINGS_FLOW, i.FlowID),
+		BodyBytes: kratosInputBytes,
+		Cookie:    i.Cookie,
+		ClientIP:  i.ClientIP,
 	})
 	if err != nil {
 		slog.Error("requestKratosPublic error", "Error", err)
@@ -1474,6 +1624,11 @@ func (p *Provider) UpdateSettingsFlow(i UpdateSettingsFlowInput) (UpdateSettings
 
 	// error handling
 	if kratosOutput.StatusCode != http.StatusOK {
+		// 有効期限切れの場合は、flow を作成し直せるよう ErrFlowExpired を返却する
+		if messages, cookies, err := flowExpiredOutput(ctx, kratosOutput, i.FlowID); err != nil {
+			output.ErrorMessages, output.Cookies = messages, cookies
+			return output, err
+		}
 		if kratosOutput.StatusCode == http.StatusBadRequest {
 			// status code 400 の場合のレスポンスボディのフォーマットは複数存在する
 			var flow kratosUpdateSettingsFlowBadRequestErrorResponse
@@ -1481,7 +1636,6 @@ func (p *Provider) UpdateSettingsFlow(i UpdateSettingsFlowInput) (UpdateSettings
 				slog.Error(err.Error())
 				return output, err
 			}
-			slog.Info(fmt.Sprintf("%v", flow))
 			if flow.Error != nil {
 				output.ErrorMessages = getErrorMessagesFromGenericError(*flow.Error)
 			} else if flow.Ui != nil {
@@ -1496,7 +1650,6 @@ func (p *Provider) UpdateSettingsFlow(i UpdateSettingsFlowInput) (UpdateSettings
 				slog.Error(err.Error())
 				return output, err
 			}
-			slog.Info(fmt.Sprintf("%v", browserLocationChangeRequired))
 
 			// browser location changeが返却された場合は、リダイレクト先URLを設定
 			output.RedirectBrowserTo = browserLocationChangeRequired.RedirectBrowserTo
@@ -1507,7 +1660,7 @@ func (p *Provider) UpdateSettingsFlow(i UpdateSettingsFlowInput) (UpdateSettings
 				slog.Error(err.Error())
 				return output, err
 			}
-			slog.Info(fmt.Sprintf("%v", errGeneric))
+			logGenericError(errGeneric.Error)
 			output.ErrorMessages = getErrorMessagesFromGenericError(errGeneric.Error)
 		}
 		output.Cookies = kratosOutput.Header["Set-Cookie"]
@@ -1533,13 +1686,16 @@ type AdminGetIdentityOutput struct {
 	ErrorMessages []string `json:"error_messages"`
 }
 
-func (p *Provider) AdminGetIdentity(i AdminGetIdentityInput) (AdminGetIdentityOutput, error) {
+func (p *Provider) AdminGetIdentity(ctx context.Context, i AdminGetIdentityInput) (AdminGetIdentityOutput, error) {
+	ctx, span := p.startSpan(ctx, "AdminGetIdentity")
+	defer span.End()
+
 	var (
 		output AdminGetIdentityOutput
 		err    error
 	)
 
-	kratosOutput, err := p.requestKratosAdmin(requestKratosInput{
+	kratosOutput, err := p.requestKratosAdmin(ctx, requestKratosInput{
 		Method: http.MethodGet,
 		Path:   fmt.Sprintf("/admin/identities/%s?include_credential=%s", i.ID, i.IncludeCredential),
 		// Cookie: i.Cookie,
@@ -1556,7 +1712,7 @@ func (p *Provider) AdminGetIdentity(i AdminGetIdentityInput) (AdminGetIdentityOu
 			slog.Error(err.Error())
 			return output, err
 		}
-		slog.Info(fmt.Sprintf("%v", errGeneric))
+		logGenericError(errGeneric.Error)
 		output.ErrorMessages = getErrorMessagesFromGenericError(errGeneric.Error)
 	}
 
@@ -1584,15 +1740,16 @@ type AdminListIdentitiesOutput struct {
 	ErrorMessages []string   `json:"error_messages"`
 }
 
-func (p *Provider) AdminListIdentities(i AdminListIdentitiesInput) (AdminListIdentitiesOutput, error) {
+func (p *Provider) AdminListIdentities(ctx context.Context, i AdminListIdentitiesInput) (AdminListIdentitiesOutput, error) {
+	ctx, span := p.startSpan(ctx, "AdminListIdentities")
+	defer span.End()
+
 	var (
 		output AdminListIdentitiesOutput
 		err    error
 	)
 
-	slog.Debug("AdminListIdentities", "input", i)
-
-	kratosOutput, err := p.requestKratosAdmin(requestKratosInput{
+	kratosOutput, err := p.requestKratosAdmin(ctx, requestKratosInput{
 		Method: http.MethodGet,
 		Path:   fmt.Sprintf("%s?credential_identifier=%s", PATH_ADMIN_LIST_IDENTITIES, i.CredentialIdentifier),
 		// Cookie: i.Cookie,
@@ -1604,21 +1761,16 @@ func (p *Provider) AdminListIdentities(i AdminListIdentitiesInput) (AdminListIde
 
 	// error handling
 	if kratosOutput.StatusCode != http.StatusOK {
-		slog.Debug("AdminListIdentities failed", "kratosOutput", kratosOutput)
-		slog.Debug(string(kratosOutput.BodyBytes))
 		var errGeneric errorGeneric
 		if err := json.Unmarshal(kratosOutput.BodyBytes, &errGeneric); err != nil {
 			slog.Error(err.Error())
 			return output, err
 		}
-		slog.Info(fmt.Sprintf("%v", errGeneric))
+		logGenericError(errGeneric.Error)
 		output.ErrorMessages = getErrorMessagesFromGenericError(errGeneric.Error)
 		return output, err
 	}
 
-	slog.Debug("AdminListIdentities succeeded", "kratosOutput", kratosOutput)
-	slog.Debug(string(kratosOutput.BodyBytes))
-
 	var identities []Identity
 	if err := json.Unmarshal(kratosOutput.BodyBytes, &identities); err != nil {
 		slog.Error(err.Error())
@@ -1631,3 +1783,73 @@ func (p *Provider) AdminListIdentities(i AdminListIdentitiesInput) (AdminListIde
 
 	return output, nil
 }
+
+// ------------------------- Flow Error -------------------------
+var ErrFlowErrorNotFound = errors.New("kratos: flow error not found")
+
+type GetFlowErrorInput struct {
+	Cookie   string
+	ClientIP string
+	ErrorID  string
+}
+
+type GetFlowErrorOutput struct {
+	// Kratos のエラーのステータスコード (エラーの取得自体のステータスコードではない)
+	StatusCode int
+	// Kratos のエラーID (security_csrf_violation 等、ない場合は空)
+	ErrorID       string
+	Reason        string
+	ErrorMessages []string
+}
+
+// selfservice.flows.error.ui_url へリダイレクトされた際のエラーを取得する
+// エラーが存在しない(有効期限切れを含む)場合は ErrFlowErrorNotFound を返却する
+func (p *Provider) GetFlowError(ctx context.Context, i GetFlowErrorInput) (GetFlowErrorOutput, error) {
+	ctx, span := p.startSpan(ctx, "GetFlowError")
+	defer span.End()
+
+	var output GetFlowErrorOutput
+
+	kratosOutput, err := p.requestKratosPublic(ctx, requestKratosInput{
+		Method:   http.MethodGet,
+		Path:     fmt.Sprintf("%s?id=%s", PATH_SELF_SERVICE_GET_FLOW_ERROR, url.QueryEscape(i.ErrorID)),
+		Cookie:   i.Cookie,
+		ClientIP: i.ClientIP,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "requestKratosPublic error", "Error", err)
+		return output, err
+	}
+
+	// error handling
+	if kratosOutput.StatusCode != http.StatusOK {
+		var errGeneric errorGeneric
+		if err := json.Unmarshal(kratosOutput.BodyBytes, &errGeneric); err != nil {
+			slog.ErrorContext(ctx, err.Error())
+			return output, err
+		}
+		slog.InfoContext(ctx, "GetFlowError failed", "statusCode", kratosOutput.StatusCode, "error", errGeneric.Error)
+		if kratosOutput.StatusCode == http.StatusNotFound {
+			return output, ErrFlowErrorNotFound
+		}
+		return output, fmt.Errorf("kratos: failed to get flow error: status code: %d", kratosOutput.StatusCode)
+	}
+
+	var kratosRespBody kratosGetFlowErrorResponse
+	if err := json.Unmarshal(kratosOutput.BodyBytes, &kratosRespBody); err != nil {
+		slog.ErrorContext(ctx, err.Error())
+		return output, err
+	}
+
+	flowError := kratosRespBody.Error
+	output.StatusCode = int(flowError.Code)
+	if output.StatusCode == 0 {
+		output.StatusCode = http.StatusInternalServerError
+	}
+	output.ErrorID = flowError.ID
+	span.SetAttributes(attribute.String("kratos.error.id", flowError.ID))
+	output.Reason = flowError.Reason
+	output.ErrorMessages = getErrorMessagesFromFlowError(flowError)
+
+	return output, nil
+}
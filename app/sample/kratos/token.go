@@ -0,0 +1,365 @@
+package kratos
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// トークン化されたセッション(JWT)の検証
+//
+// Kratos の session.whoami.tokenizer で発行されたJWTを、JWKSの公開鍵でローカルに検証し、セッションを復元する
+// アプリ以外の下流のサービスでも、Kratos を呼び出さずにリクエストを認可できるよう、TokenVerifier を公開している
+// JWTのクレームは kratos/tokenizer/app.jsonnet で定義した session クレームを前提とする
+
+var (
+	ErrTokenInvalid = errors.New("kratos: invalid session token")
+	ErrTokenExpired = errors.New("kratos: session token is expired")
+)
+
+// nbf, iat の検証時に許容する時刻のずれ
+const tokenClockSkew = 30 * time.Second
+
+// JWKSを再取得する最短の間隔 (未知の kid による過剰な取得を防ぐ)
+const jwksRefreshInterval = time.Minute
+
+type TokenVerifierInput struct {
+	// 公開鍵のJWKS
+	// http(s):// の場合は取得し、それ以外(file:// もしくはパス)の場合はファイルから読み込む
+	JWKSURL string
+	// 指定した場合は、iss クレームが一致することを検証する
+	Issuer string
+}
+
+type TokenVerifier struct {
+	i TokenVerifierInput
+
+	mu          sync.RWMutex
+	keys        map[string]crypto.PublicKey
+	lastFetched time.Time
+}
+
+// JWKSを読み込み、TokenVerifier を生成する
+func NewTokenVerifier(i TokenVerifierInput) (*TokenVerifier, error) {
+	if i.JWKSURL == "" {
+		return nil, errors.New("kratos: token verifier requires jwks url")
+	}
+	v := TokenVerifier{i: i}
+	if err := v.refreshKeys(); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type tokenClaims struct {
+	Issuer    string  `json:"iss"`
+	Subject   string  `json:"sub"`
+	ExpiresAt int64   `json:"exp"`
+	NotBefore int64   `json:"nbf"`
+	IssuedAt  int64   `json:"iat"`
+	Session   Session `json:"session"`
+}
+
+// JWTの署名と有効期限を検証し、クレームからセッションを復元する
+// 有効期限切れの場合は ErrTokenExpired、それ以外の検証エラーの場合は ErrTokenInvalid を返却する
+func (v *TokenVerifier) Verify(token string) (*Session, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrTokenInvalid
+	}
+
+	var header tokenHeader
+	if err := decodeTokenSegment(parts[0], &header); err != nil {
+		return nil, ErrTokenInvalid
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyTokenSignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		slog.Warn("session token signature verification failed", "kid", header.Kid, "alg", header.Alg, "Error", err)
+		return nil, ErrTokenInvalid
+	}
+
+	var claims tokenClaims
+	if err := decodeTokenSegment(parts[1], &claims); err != nil {
+		return nil, ErrTokenInvalid
+	}
+	now := time.Now()
+	if claims.ExpiresAt == 0 || !now.Before(time.Unix(claims.ExpiresAt, 0)) {
+		return nil, ErrTokenExpired
+	}
+	if claims.NotBefore != 0 && now.Add(tokenClockSkew).Before(time.Unix(claims.NotBefore, 0)) {
+		return nil, ErrTokenInvalid
+	}
+	if v.i.Issuer != "" && claims.Issuer != v.i.Issuer {
+		return nil, ErrTokenInvalid
+	}
+	// sub は Kratos が設定する identity ID のため、session クレームと一致しない場合は不正とする
+	if claims.Session.ID == "" || claims.Session.Identity.ID != claims.Subject {
+		return nil, ErrTokenInvalid
+	}
+
+	session := claims.Session
+	session.Tokenized = token
+	return &session, nil
+}
+
+// 検証済みのJWTの有効期限(exp)を取得する
+// 取得できない場合はゼロ値を返却する
+func tokenExpiresAt(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+	var claims tokenClaims
+	if err := decodeTokenSegment(parts[1], &claims); err != nil || claims.ExpiresAt == 0 {
+		return time.Time{}
+	}
+	return time.Unix(claims.ExpiresAt, 0)
+}
+
+func decodeTokenSegment(segment string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func verifyTokenSignature(alg string, key crypto.PublicKey, signingInput []byte, signature []byte) error {
+	switch alg {
+	case "ES256", "ES384", "ES512":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("key type mismatch")
+		}
+		var (
+			digest  []byte
+			bitSize int
+		)
+		switch alg {
+		case "ES256":
+			sum := sha256.Sum256(signingInput)
+			digest, bitSize = sum[:], 256
+		case "ES384":
+			sum := sha512.Sum384(signingInput)
+			digest, bitSize = sum[:], 384
+		case "ES512":
+			sum := sha512.Sum512(signingInput)
+			digest, bitSize = sum[:], 521
+		}
+		if pub.Curve.Params().BitSize != bitSize {
+			return errors.New("curve mismatch")
+		}
+		// JWS の ECDSA 署名は r || s の固定長
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != size*2 {
+			return errors.New("invalid signature length")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("key type mismatch")
+		}
+		sum := sha256.Sum256(signingInput)
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], signature)
+	case "EdDSA":
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return errors.New("key type mismatch")
+		}
+		if !ed25519.Verify(pub, signingInput, signature) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	default:
+		// "none" を含め、対応していないアルゴリズムは拒否する
+		return fmt.Errorf("unsupported alg: %s", alg)
+	}
+}
+
+// kid に対応する公開鍵を取得する
+// 見つからない場合は、鍵のローテーションに対応するためJWKSを再取得する
+func (v *TokenVerifier) key(kid string) (crypto.PublicKey, error) {
+	if key, ok := v.lookupKey(kid); ok {
+		return key, nil
+	}
+
+	v.mu.RLock()
+	canRefresh := time.Since(v.lastFetched) >= jwksRefreshInterval
+	v.mu.RUnlock()
+	if canRefresh {
+		if err := v.refreshKeys(); err != nil {
+			slog.Error(err.Error())
+		}
+		if key, ok := v.lookupKey(kid); ok {
+			return key, nil
+		}
+	}
+	slog.Warn("unknown session token key", "kid", kid)
+	return nil, ErrTokenInvalid
+}
+
+func (v *TokenVerifier) lookupKey(kid string) (crypto.PublicKey, bool) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	// kid が指定されていない場合は、鍵が1つのみの場合に限りその鍵を使用する
+	if kid == "" && len(v.keys) == 1 {
+		for _, key := range v.keys {
+			return key, true
+		}
+	}
+	key, ok := v.keys[kid]
+	return key, ok
+}
+
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+func (v *TokenVerifier) refreshKeys() error {
+	b, err := readJWKS(v.i.JWKSURL)
+	if err != nil {
+		return err
+	}
+	var set jwks
+	if err := json.Unmarshal(b, &set); err != nil {
+		return err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			slog.Error("invalid jwk", "kid", k.Kid, "Error", err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return errors.New("kratos: jwks has no valid signing keys")
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.keys = keys
+	v.lastFetched = time.Now()
+	return nil
+}
+
+func readJWKS(jwksURL string) ([]byte, error) {
+	if strings.HasPrefix(jwksURL, "http://") || strings.HasPrefix(jwksURL, "https://") {
+		client := http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Get(jwksURL)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("kratos: failed to fetch jwks: %s", resp.Status)
+		}
+		return io.ReadAll(resp.Body)
+	}
+	return os.ReadFile(strings.TrimPrefix(jwksURL, "file://"))
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported crv: %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return pub, nil
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported crv: %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported kty: %s", k.Kty)
+	}
+}
@@ -0,0 +1,116 @@
+package kratos
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// トレーシング
+//
+// Provider のメソッドごとのスパンと、その子として Kratos への HTTP リクエストのスパンを作成する
+// HTTP リクエストのスパンには、flow の種類・ID、ステータスコード、Kratos のエラーID を属性として記録する
+
+const (
+	ATTRIBUTE_FLOW_TYPE = attribute.Key("kratos.flow.type")
+	ATTRIBUTE_FLOW_ID   = attribute.Key("kratos.flow.id")
+	ATTRIBUTE_ERROR_ID  = attribute.Key("kratos.error.id")
+)
+
+// Provider のメソッドのスパンを開始する
+// メソッド名は、メトリクスのラベルとしても使用する
+func (p *Provider) startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	ctx = contextWithOperation(ctx, name)
+	return p.tracer.Start(ctx, "kratos."+name, trace.WithSpanKind(trace.SpanKindInternal))
+}
+
+// Kratos への HTTP リクエストのスパンを開始する
+func (p *Provider) startRequestSpan(ctx context.Context, endpoint string, i requestKratosInput) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{
+		semconv.HTTPRequestMethodKey.String(i.Method),
+		semconv.URLPath(pathWithoutQuery(i.Path)),
+	}
+	if u, err := url.Parse(endpoint); err == nil {
+		attrs = append(attrs, semconv.ServerAddress(u.Hostname()))
+	}
+	if flowType := flowTypeFromPath(i.Path); flowType != "" {
+		attrs = append(attrs, ATTRIBUTE_FLOW_TYPE.String(flowType))
+	}
+	if flowID := flowIDFromPath(i.Path); flowID != "" {
+		attrs = append(attrs, ATTRIBUTE_FLOW_ID.String(flowID))
+	}
+	return p.tracer.Start(ctx, i.Method+" "+pathWithoutQuery(i.Path),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...),
+	)
+}
+
+// Kratos のレスポンスをスパンに記録し、Kratos のエラーID(ない場合は空文字)を返却する
+// flow の作成時は、レスポンスの ID を flow ID として記録する
+func endRequestSpan(span trace.Span, i requestKratosInput, statusCode int, body []byte) string {
+	span.SetAttributes(semconv.HTTPResponseStatusCode(statusCode))
+
+	var respBody struct {
+		ID    string `json:"id"`
+		Error struct {
+			ID string `json:"id"`
+		} `json:"error"`
+	}
+	_ = json.Unmarshal(body, &respBody)
+	if respBody.ID != "" && flowTypeFromPath(i.Path) != "" && flowIDFromPath(i.Path) == "" {
+		span.SetAttributes(ATTRIBUTE_FLOW_ID.String(respBody.ID))
+	}
+	if respBody.Error.ID != "" {
+		span.SetAttributes(ATTRIBUTE_ERROR_ID.String(respBody.Error.ID))
+	}
+	if statusCode >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(statusCode))
+	}
+	return respBody.Error.ID
+}
+
+// "/self-service/login/flows?id=xxx" -> "login"
+func flowTypeFromPath(path string) string {
+	rest, ok := strings.CutPrefix(pathWithoutQuery(path), "/self-service/")
+	if !ok {
+		return ""
+	}
+	flowType, _, _ := strings.Cut(rest, "/")
+	switch flowType {
+	case "registration", "verification", "login", "logout", "settings", "recovery":
+		return flowType
+	default:
+		return ""
+	}
+}
+
+// "/self-service/login/flows?id=xxx", "/self-service/login?flow=xxx" -> "xxx"
+func flowIDFromPath(path string) string {
+	if flowTypeFromPath(path) == "" {
+		return ""
+	}
+	_, rawQuery, ok := strings.Cut(path, "?")
+	if !ok {
+		return ""
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return ""
+	}
+	if flowID := query.Get("flow"); flowID != "" {
+		return flowID
+	}
+	return query.Get("id")
+}
+
+func pathWithoutQuery(path string) string {
+	p, _, _ := strings.Cut(path, "?")
+	return p
+}
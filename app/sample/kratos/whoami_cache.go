@@ -0,0 +1,173 @@
+package kratos
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"kratos_example/store"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Whoami のキャッシュ
+//
+// 静的ファイルや htmx による部分更新を含め、全てのリクエストで Whoami を呼び出しているため、
+// 結果を短時間キャッシュし、Kratos へのリクエストを削減する
+// セッションをトークン化している場合は、JWTの有効期限までキャッシュし、取得時にJWTをローカルで検証する
+// (Kratos を呼び出さずに、JWTの有効期限内はセッションを復元できる)
+// キャッシュのキーにはセッションCookieのハッシュ値を使用し、Cookieの値そのものは保存しない
+// ログアウト、ログイン(認証時刻の更新)、設定の更新時にはキャッシュを削除する
+
+// whoamiCacheKey の prefix
+const whoamiCacheKeyPrefix = "whoami:"
+
+// セッションCookieのハッシュ値からキャッシュのキーを生成する
+// セッションCookieが含まれない場合は空文字を返却する
+func (p *Provider) whoamiCacheKey(cookie string) string {
+	if cookie == "" || p.c.SessionCookieName == "" {
+		return ""
+	}
+	header := http.Header{"Cookie": []string{cookie}}
+	sessionCookie, err := (&http.Request{Header: header}).Cookie(p.c.SessionCookieName)
+	if err != nil || sessionCookie.Value == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(sessionCookie.Value))
+	return whoamiCacheKeyPrefix + hex.EncodeToString(sum[:])
+}
+
+// キャッシュからセッションを取得する
+func (p *Provider) getCachedWhoami(ctx context.Context, key string) (*Session, bool) {
+	b, err := p.d.Store.Get(ctx, key)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, false
+	}
+	if err != nil {
+		slog.Error(err.Error())
+		return nil, false
+	}
+	var session Session
+	if err := json.Unmarshal(b, &session); err != nil {
+		slog.Error(err.Error())
+		return nil, false
+	}
+	return &session, true
+}
+
+// セッションをキャッシュする
+// キャッシュの有効期限は WhoamiCacheTTL とし、セッションの有効期限を超えないようにする
+// トークン化している場合は、JWTの有効期限までキャッシュする
+// (Kratos 側でのセッションの無効化(管理者による削除等)は、最大でJWTの ttl の間反映されないため、ttl は短く設定する)
+// invalidated は、取得中にキャッシュが削除された(セッションの状態が変わった)かを返却する
+// 削除前に取得した古いセッションをキャッシュしないよう、保存の前後で確認し、保存後に削除されていた場合は保存したキャッシュを削除する
+func (p *Provider) cacheWhoami(ctx context.Context, key string, session *Session, invalidated func() bool) {
+	if invalidated() {
+		return
+	}
+	ttl := p.c.WhoamiCacheTTL
+	if p.tokenVerifier != nil && session.Tokenized != "" {
+		ttl = time.Until(tokenExpiresAt(session.Tokenized))
+	}
+	if untilExpires := time.Until(session.ExpiresAt); untilExpires < ttl {
+		ttl = untilExpires
+	}
+	if ttl <= 0 {
+		return
+	}
+	b, err := json.Marshal(session)
+	if err != nil {
+		slog.Error(err.Error())
+		return
+	}
+	if err := p.d.Store.Set(ctx, key, b, ttl); err != nil {
+		slog.Error(err.Error())
+		return
+	}
+	if invalidated() {
+		if err := p.d.Store.Delete(context.WithoutCancel(ctx), key); err != nil {
+			slog.Error(err.Error())
+		}
+	}
+}
+
+// セッションのキャッシュを削除する
+// セッションの状態が変わる操作(ログアウト、ログイン、設定の更新)の後に呼び出す
+func (p *Provider) invalidateWhoamiCache(ctx context.Context, cookie string) {
+	if !p.whoamiCacheEnabled() {
+		return
+	}
+	key := p.whoamiCacheKey(cookie)
+	if key == "" {
+		return
+	}
+	// 削除前に開始した Whoami の結果をキャッシュせず、以降の呼び出しでも共有しないようにする
+	p.whoamiGroup.forget(key)
+	// リクエストがキャンセルされた場合も、キャッシュは削除する
+	if err := p.d.Store.Delete(context.WithoutCancel(ctx), key); err != nil {
+		slog.Error(err.Error())
+	}
+}
+
+func (p *Provider) whoamiCacheEnabled() bool {
+	return p.d.Store != nil && p.c.WhoamiCacheTTL > 0
+}
+
+// 同じキーに対する同時実行中の処理を1回にまとめる (golang.org/x/sync/singleflight の最小限の実装)
+// 同じセッションCookieで同時に送信されたリクエストが、それぞれ Whoami を呼び出すことを防ぐ
+type singleflightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*singleflightCall
+}
+
+type singleflightCall struct {
+	wg     sync.WaitGroup
+	output WhoamiOutput
+	err    error
+	// 実行中に forget されたか
+	forgotten atomic.Bool
+}
+
+// fn には実行中の処理を渡し、forget されたかを確認できるようにする
+func (g *singleflightGroup) do(key string, fn func(c *singleflightCall) (WhoamiOutput, error)) (WhoamiOutput, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*singleflightCall)
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.output, c.err
+	}
+	c := new(singleflightCall)
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	c.output, c.err = fn(c)
+	c.wg.Done()
+
+	g.mu.Lock()
+	// forget された後に、同じキーで開始された処理は削除しない
+	if g.calls[key] == c {
+		delete(g.calls, key)
+	}
+	g.mu.Unlock()
+
+	return c.output, c.err
+}
+
+// 実行中の処理に forget されたことを設定し、以降の呼び出しでは新たに実行する
+// (実行中の処理を待っている呼び出しには、その結果を返却する)
+func (g *singleflightGroup) forget(key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if c, ok := g.calls[key]; ok {
+		c.forgotten.Store(true)
+		delete(g.calls, key)
+	}
+}
@@ -0,0 +1,20 @@
+package logging
+
+import "context"
+
+// リクエストIDをコンテキストで受け渡す
+// handler, kratos 等の複数のパッケージで使用するため、本パッケージで定義する
+
+type requestIDContextKey struct{}
+
+// リクエストIDを保存したコンテキストを返却する
+func ContextWithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, requestID)
+}
+
+// コンテキストからリクエストIDを取得する
+// 設定されていない場合は空文字を返却する
+func RequestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDContextKey{}).(string)
+	return requestID
+}
@@ -0,0 +1,84 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// slog.Handler をラップし、以下を行う
+//   - コンテキストにリクエストIDがある場合は、requestID 属性を付与する
+//   - コンテキストにスパンがある場合は、traceID, spanID 属性を付与する (トレースとログを突き合わせるため)
+//   - メッセージ、属性に含まれる機密情報(Cookie, CSRFトークン, パスワード, コード等)を伏せる
+//
+// 全てのログが対象となるよう、slog.SetDefault で設定する
+type Handler struct {
+	inner slog.Handler
+}
+
+func NewHandler(inner slog.Handler) *Handler {
+	return &Handler{inner: inner}
+}
+
+func (h *Handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
+
+func (h *Handler) Handle(ctx context.Context, record slog.Record) error {
+	redacted := slog.NewRecord(record.Time, record.Level, RedactString(record.Message), record.PC)
+	record.Attrs(func(attr slog.Attr) bool {
+		redacted.AddAttrs(redactAttr(attr))
+		return true
+	})
+	if requestID := RequestIDFromContext(ctx); requestID != "" {
+		redacted.AddAttrs(slog.String("requestID", requestID))
+	}
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.IsValid() {
+		redacted.AddAttrs(
+			slog.String("traceID", spanContext.TraceID().String()),
+			slog.String("spanID", spanContext.SpanID().String()),
+		)
+	}
+	return h.inner.Handle(ctx, redacted)
+}
+
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redactedAttrs := make([]slog.Attr, 0, len(attrs))
+	for _, attr := range attrs {
+		redactedAttrs = append(redactedAttrs, redactAttr(attr))
+	}
+	return &Handler{inner: h.inner.WithAttrs(redactedAttrs)}
+}
+
+func (h *Handler) WithGroup(name string) slog.Handler {
+	return &Handler{inner: h.inner.WithGroup(name)}
+}
+
+func redactAttr(attr slog.Attr) slog.Attr {
+	if isSensitiveKey(attr.Key) {
+		return slog.String(attr.Key, REDACTED)
+	}
+
+	value := attr.Value.Resolve()
+	switch value.Kind() {
+	case slog.KindString:
+		return slog.String(attr.Key, RedactString(value.String()))
+	case slog.KindGroup:
+		groupAttrs := value.Group()
+		redactedAttrs := make([]any, 0, len(groupAttrs))
+		for _, groupAttr := range groupAttrs {
+			redactedAttrs = append(redactedAttrs, redactAttr(groupAttr))
+		}
+		return slog.Group(attr.Key, redactedAttrs...)
+	case slog.KindAny:
+		// 構造体等はフィールド名を含めて文字列化し、フィールド名から機密情報を判定する
+		if err, ok := value.Any().(error); ok {
+			return slog.String(attr.Key, RedactString(err.Error()))
+		}
+		return slog.String(attr.Key, RedactString(fmt.Sprintf("%+v", value.Any())))
+	default:
+		return slog.Attr{Key: attr.Key, Value: value}
+	}
+}
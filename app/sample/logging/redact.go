@@ -0,0 +1,145 @@
+package logging
+
+import (
+	"regexp"
+	"strings"
+)
+
+// 機密情報を置き換える文字列
+const REDACTED = "[REDACTED]"
+
+// 値を伏せる属性のキー、フィールド名(大文字・小文字、"_", "-" の違いは無視する)
+var sensitiveKeys = map[string]struct{}{
+	"cookie":               {},
+	"cookies":              {},
+	"setcookie":            {},
+	"authorization":        {},
+	"password":             {},
+	"passwordconfirmation": {},
+	"csrftoken":            {},
+	"appcsrftoken":         {},
+	"code":                 {},
+	"passkeylogin":         {},
+	"passkeyregister":      {},
+	"logouttoken":          {},
+	"tokenized":            {},
+	"sessiontoken":         {},
+	"secret":               {},
+	"secrets":              {},
+}
+
+func normalizeKey(key string) string {
+	return strings.NewReplacer("_", "", "-", "", ".", "").Replace(strings.ToLower(key))
+}
+
+func isSensitiveKey(key string) bool {
+	_, ok := sensitiveKeys[normalizeKey(key)]
+	return ok
+}
+
+var (
+	// JSON のフィールド ("password": "xxx")
+	jsonFieldPattern = regexp.MustCompile(`"([A-Za-z_\-.]+)"\s*:\s*("(?:[^"\\]|\\.)*"|[^\s,}\]]+)`)
+	// fmt の %+v による構造体のフィールド (Password:xxx)、クエリパラメータ・フォーム (password=xxx) のキー
+	// "status code: 500" のような文章と区別するため、区切り文字の後に空白を含まないものを対象とする
+	fieldKeyPattern = regexp.MustCompile(`([A-Za-z_\-.]+)[:=]`)
+	// 値の後に続く、次のフィールド ( Email:xxx)
+	nextFieldPattern = regexp.MustCompile(`^[ \t]+[A-Za-z_\-.]+[:=]\S`)
+	// 入れ子を含まない JSON のオブジェクト、%+v による構造体
+	objectPattern = regexp.MustCompile(`\{[^{}]*\}`)
+	// Kratos の ui.nodes の属性の名前 ("name":"csrf_token", Name:csrf_token)
+	nodeNamePattern = regexp.MustCompile(`(?:"name"\s*:\s*"|\bName:)([A-Za-z_\-.]+)`)
+	// Kratos の ui.nodes の属性の値 ("value":"xxx")
+	jsonNodeValuePattern = regexp.MustCompile(`"value"\s*:\s*("(?:[^"\\]|\\.)*"|[^\s,}\]]+)`)
+	// Cookie ヘッダの値 (kratos_session=xxx; csrf_token_xxx=xxx)
+	cookiePattern = regexp.MustCompile(`(?i)\b((?:ory_)?kratos_session|csrf_token_\w+|app_csrf_token)=[^;\s\]"&]+`)
+	// JWT (トークン化されたセッション等)
+	jwtPattern = regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`)
+)
+
+// 文字列に含まれる機密情報を伏せる
+// ログには機密情報を含めないことを前提とし、誤って出力した場合に備えるためのもの
+func RedactString(s string) string {
+	s = redactNodeValues(s)
+	s = jsonFieldPattern.ReplaceAllStringFunc(s, func(match string) string {
+		sub := jsonFieldPattern.FindStringSubmatch(match)
+		if !isSensitiveKey(sub[1]) {
+			return match
+		}
+		return `"` + sub[1] + `":"` + REDACTED + `"`
+	})
+	s = cookiePattern.ReplaceAllString(s, "$1="+REDACTED)
+	s = redactFields(s)
+	return jwtPattern.ReplaceAllString(s, REDACTED)
+}
+
+// Kratos の ui.nodes のように、汎用のキー(value)に値を持つ属性は、名前(name)が機密情報の場合に値を伏せる
+// {"name":"csrf_token","type":"hidden","value":"xxx"}, {Name:csrf_token Type:hidden Value:xxx}
+func redactNodeValues(s string) string {
+	return objectPattern.ReplaceAllStringFunc(s, func(object string) string {
+		sub := nodeNamePattern.FindStringSubmatch(object)
+		if sub == nil || !isSensitiveKey(sub[1]) {
+			return object
+		}
+		object = jsonNodeValuePattern.ReplaceAllString(object, `"value":"`+REDACTED+`"`)
+		if i := strings.Index(object, "Value:"); i >= 0 {
+			start := i + len("Value:")
+			end := start + fieldValueEnd(object[start:])
+			object = object[:start] + REDACTED + object[end:]
+		}
+		return object
+	})
+}
+
+// %+v、クエリパラメータ・フォームのフィールドのうち、キーが機密情報のものの値を伏せる
+func redactFields(s string) string {
+	var b strings.Builder
+	for {
+		loc := fieldKeyPattern.FindStringSubmatchIndex(s)
+		if loc == nil {
+			b.WriteString(s)
+			return b.String()
+		}
+		key := s[loc[2]:loc[3]]
+		rest := s[loc[1]:]
+		b.WriteString(s[:loc[1]])
+		if !isSensitiveKey(key) || rest == "" || rest[0] == ' ' || rest[0] == '\t' || strings.HasPrefix(rest, REDACTED) {
+			s = rest
+			continue
+		}
+		b.WriteString(REDACTED)
+		s = rest[fieldValueEnd(rest):]
+	}
+}
+
+// フィールドの値の終わりの位置を返却する
+// 値に空白を含む場合に一部が残らないよう、次のフィールド、区切り文字、閉じ括弧までを値とする
+// "[" で始まる値(スライス)は、対応する "]" までを値とする
+func fieldValueEnd(v string) int {
+	if strings.HasPrefix(v, "[") {
+		depth := 0
+		for i := 0; i < len(v); i++ {
+			switch v[i] {
+			case '[':
+				depth++
+			case ']':
+				depth--
+				if depth == 0 {
+					return i + 1
+				}
+			}
+		}
+		return len(v)
+	}
+	for i := 0; i < len(v); i++ {
+		switch v[i] {
+		case '&', ';', '}', ']', '"', '\n':
+			return i
+		case ' ', '\t':
+			if nextFieldPattern.MatchString(v[i:]) {
+				return i
+			}
+		}
+	}
+	return len(v)
+}
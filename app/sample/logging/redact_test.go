@@ -0,0 +1,79 @@
+package logging
+
+import "testing"
+
+func TestRedactString(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "json field",
+			in:   `{"password":"P@ss word!","identifier":"a@example.com"}`,
+			want: `{"password":"[REDACTED]","identifier":"a@example.com"}`,
+		},
+		{
+			name: "json ui node",
+			in:   `{"attributes":{"name":"csrf_token","type":"hidden","value":"abc+/=","required":true}}`,
+			want: `{"attributes":{"name":"csrf_token","type":"hidden","value":"[REDACTED]","required":true}}`,
+		},
+		{
+			name: "json ui node not sensitive",
+			in:   `{"attributes":{"name":"traits.email","type":"email","value":"a@example.com"}}`,
+			want: `{"attributes":{"name":"traits.email","type":"email","value":"a@example.com"}}`,
+		},
+		{
+			name: "struct ui node",
+			in:   `{Attributes:{Name:csrf_token Type:hidden Value:abc def Required:false}}`,
+			want: `{Attributes:{Name:csrf_token Type:hidden Value:[REDACTED] Required:false}}`,
+		},
+		{
+			name: "struct ui node not sensitive",
+			in:   `{Attributes:{Name:method Type:submit Value:password}}`,
+			want: `{Attributes:{Name:method Type:submit Value:password}}`,
+		},
+		{
+			name: "value with spaces",
+			in:   `password:P@ss word!`,
+			want: `password:[REDACTED]`,
+		},
+		{
+			name: "value with spaces followed by field",
+			in:   `{Password:P@ss word! Email:a@example.com}`,
+			want: `{Password:[REDACTED] Email:a@example.com}`,
+		},
+		{
+			name: "cookie slice",
+			in:   `cookie:[kratos_session=xxx; csrf_token_abc=yyy] path:/`,
+			want: `cookie:[REDACTED] path:/`,
+		},
+		{
+			name: "cookie header",
+			in:   `kratos_session=xxx; other=1`,
+			want: `kratos_session=[REDACTED]; other=1`,
+		},
+		{
+			name: "form",
+			in:   `identifier=a%40example.com&password=secret&method=password`,
+			want: `identifier=a%40example.com&password=[REDACTED]&method=password`,
+		},
+		{
+			name: "sentence",
+			in:   `unexpected status code: 500`,
+			want: `unexpected status code: 500`,
+		},
+		{
+			name: "jwt",
+			in:   `token eyJhbGciOiJFUzI1NiJ9.eyJzdWIiOiJ4In0.c2ln`,
+			want: `token [REDACTED]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RedactString(tt.in); got != tt.want {
+				t.Errorf("RedactString(%q)\n got: %q\nwant: %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
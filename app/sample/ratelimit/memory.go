@@ -0,0 +1,72 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// 使用されなくなったバケットを削除する間隔
+const memoryLimiterSweepInterval = time.Minute
+
+// プロセス内のメモリでバケットを管理する
+// 複数プロセスで運用する場合は、プロセスごとに制限されるため RedisLimiter を使用する
+type MemoryLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*memoryBucket
+	lastSwept time.Time
+}
+
+type memoryBucket struct {
+	tokens    float64
+	updatedAt time.Time
+	// バケットが満杯となり、削除可能となる時刻
+	expiresAt time.Time
+}
+
+func NewMemoryLimiter() *MemoryLimiter {
+	return &MemoryLimiter{
+		buckets:   make(map[string]*memoryBucket),
+		lastSwept: time.Now(),
+	}
+}
+
+func (l *MemoryLimiter) Allow(ctx context.Context, key string, rule Rule) (Result, error) {
+	if !rule.Enabled() {
+		return Result{Allowed: true}, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &memoryBucket{tokens: rule.capacity(), updatedAt: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(rule.capacity(), b.tokens+float64(now.Sub(b.updatedAt))*rule.ratePerNanosecond())
+	b.updatedAt = now
+	b.expiresAt = now.Add(rule.fillDuration())
+
+	if b.tokens < 1 {
+		return Result{Allowed: false, RetryAfter: rule.retryAfter(b.tokens)}, nil
+	}
+	b.tokens--
+	return Result{Allowed: true, Remaining: int(b.tokens)}, nil
+}
+
+// 満杯となったバケット(一定期間使用されていないバケット)を削除する
+func (l *MemoryLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSwept) < memoryLimiterSweepInterval {
+		return
+	}
+	for key, b := range l.buckets {
+		if b.expiresAt.Before(now) {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSwept = now
+}
@@ -0,0 +1,61 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// トークンバケットによるレート制限
+//
+// バケットは Burst 個のトークンを上限として保持し、Interval ごとに Limit 個のトークンが補充される
+// リクエストごとにトークンを1つ消費し、トークンがない場合は制限する
+
+type Rule struct {
+	// Interval ごとに補充するトークン数
+	Limit int
+	// トークンを補充する間隔
+	Interval time.Duration
+	// バケットの容量 (連続して許可するリクエスト数)
+	// 0 の場合は Limit と同じとする
+	Burst int
+}
+
+// Rule が設定されているか (Limit, Interval が 0 の場合は制限しない)
+func (r Rule) Enabled() bool {
+	return r.Limit > 0 && r.Interval > 0
+}
+
+func (r Rule) capacity() float64 {
+	if r.Burst > 0 {
+		return float64(r.Burst)
+	}
+	return float64(r.Limit)
+}
+
+// 1ナノ秒あたりに補充するトークン数
+func (r Rule) ratePerNanosecond() float64 {
+	return float64(r.Limit) / float64(r.Interval)
+}
+
+// トークンが1つ補充されるまでの時間
+func (r Rule) retryAfter(tokens float64) time.Duration {
+	return time.Duration((1 - tokens) / r.ratePerNanosecond())
+}
+
+// 空のバケットが満杯になるまでの時間 (これより長く使用されないバケットは削除できる)
+func (r Rule) fillDuration() time.Duration {
+	return time.Duration(r.capacity() / r.ratePerNanosecond())
+}
+
+type Result struct {
+	Allowed bool
+	// 残りのトークン数
+	Remaining int
+	// 制限された場合に、次のリクエストが許可されるまでの時間
+	RetryAfter time.Duration
+}
+
+type Limiter interface {
+	// key のバケットからトークンを1つ消費する
+	Allow(ctx context.Context, key string, rule Rule) (Result, error)
+}
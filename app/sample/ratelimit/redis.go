@@ -0,0 +1,84 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"kratos_example/store"
+	"strconv"
+	"time"
+)
+
+// バケットの更新を Redis 上でアトミックに行うスクリプト
+// KEYS[1]: バケットのキー
+// ARGV[1]: 容量, ARGV[2]: 1msあたりの補充数, ARGV[3]: 現在時刻(ms), ARGV[4]: キーの有効期限(ms)
+// 戻り値: {許可された場合は1, 残りのトークン数(文字列)}
+const redisTokenBucketScript = `
+local capacity = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local ttl = tonumber(ARGV[4])
+
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1])
+local ts = tonumber(bucket[2])
+if tokens == nil or ts == nil then
+  tokens = capacity
+  ts = now
+end
+
+tokens = math.min(capacity, tokens + math.max(0, now - ts) * rate)
+local allowed = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(now))
+redis.call('PEXPIRE', KEYS[1], ttl)
+return {allowed, tostring(tokens)}
+`
+
+// Redis プロトコル互換のサーバでバケットを管理する
+// 複数プロセス間で制限を共有する場合に使用する
+type RedisLimiter struct {
+	s *store.RedisStore
+}
+
+func NewRedisLimiter(s *store.RedisStore) *RedisLimiter {
+	return &RedisLimiter{s: s}
+}
+
+func (l *RedisLimiter) Allow(ctx context.Context, key string, rule Rule) (Result, error) {
+	if !rule.Enabled() {
+		return Result{Allowed: true}, nil
+	}
+
+	ratePerMillisecond := rule.ratePerNanosecond() * float64(time.Millisecond)
+	ttl := rule.fillDuration() + time.Second
+	reply, err := l.s.Do(ctx,
+		"EVAL", redisTokenBucketScript, "1", l.s.Key("ratelimit:"+key),
+		strconv.FormatFloat(rule.capacity(), 'f', -1, 64),
+		strconv.FormatFloat(ratePerMillisecond, 'f', -1, 64),
+		strconv.FormatInt(time.Now().UnixMilli(), 10),
+		strconv.FormatInt(ttl.Milliseconds(), 10),
+	)
+	if err != nil {
+		return Result{}, err
+	}
+
+	values, ok := reply.([]any)
+	if !ok || len(values) != 2 {
+		return Result{}, fmt.Errorf("ratelimit: unexpected reply: %v", reply)
+	}
+	allowed, _ := values[0].(int64)
+	tokensBytes, _ := values[1].([]byte)
+	tokens, err := strconv.ParseFloat(string(tokensBytes), 64)
+	if err != nil {
+		return Result{}, fmt.Errorf("ratelimit: unexpected reply: %v", reply)
+	}
+
+	if allowed != 1 {
+		return Result{Allowed: false, RetryAfter: rule.retryAfter(tokens)}, nil
+	}
+	return Result{Allowed: true, Remaining: int(tokens)}, nil
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLS の証明書を、ファイルが更新された場合に読み込み直す
+// (cert-manager、certbot 等による証明書の更新を、再起動せずに反映する)
+// 更新の確認は TLS のハンドシェイク時に、前回の確認から interval を経過している場合のみ行う
+type certificateReloader struct {
+	certFile string
+	keyFile  string
+	interval time.Duration
+
+	mu          sync.Mutex
+	certificate *tls.Certificate
+	modTime     time.Time
+	checkedAt   time.Time
+}
+
+func newCertificateReloader(certFile string, keyFile string, interval time.Duration) (*certificateReloader, error) {
+	r := certificateReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		interval: interval,
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (r *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.interval > 0 && time.Since(r.checkedAt) >= r.interval {
+		r.checkedAt = time.Now()
+		if modTime := r.latestModTime(); modTime.After(r.modTime) {
+			// 読み込みに失敗した場合(証明書と鍵の更新の途中等)は、現在の証明書を使用し続ける
+			if err := r.load(); err != nil {
+				slog.Error("failed to reload tls certificate", "Error", err)
+			} else {
+				slog.Info("tls certificate reloaded", "certFile", r.certFile)
+			}
+		}
+	}
+	return r.certificate, nil
+}
+
+func (r *certificateReloader) load() error {
+	modTime := r.latestModTime()
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.certificate = &certificate
+	r.modTime = modTime
+	r.checkedAt = time.Now()
+	return nil
+}
+
+// 証明書、鍵のファイルのうち、新しい方の更新日時
+func (r *certificateReloader) latestModTime() time.Time {
+	var latest time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// HTTP サーバ
+//
+// タイムアウトを設定した http.Server で待ち受ける
+// TLS の証明書は、ファイルが更新された場合に再起動せずに読み込み直す
+// TLS を使用しない場合は、h2c (平文の HTTP/2) を有効にできる (ロードバランサとの間を HTTP/2 で接続する場合等)
+
+type NewInput struct {
+	Addr    string
+	Handler http.Handler
+	// リクエストヘッダの読み込みのタイムアウト (Slowloris 対策)
+	ReadHeaderTimeout time.Duration
+	// リクエスト全体(ボディを含む)の読み込みのタイムアウト
+	ReadTimeout time.Duration
+	// レスポンスの書き込みのタイムアウト (Kratos の応答を待つ時間を含む)
+	WriteTimeout time.Duration
+	// Keep-Alive の接続を維持する時間
+	IdleTimeout time.Duration
+	// TLS (CertFile, KeyFile が空の場合は TLS を使用しない)
+	TLS TLSInput
+	// true の場合は h2c を有効にする (TLS を使用しない場合のみ)
+	H2C bool
+}
+
+type TLSInput struct {
+	CertFile string
+	KeyFile  string
+	// 証明書ファイルの更新を確認する間隔 (0 の場合は起動時のみ読み込む)
+	ReloadInterval time.Duration
+}
+
+type Server struct {
+	srv         *http.Server
+	tlsEnabled  bool
+	certificate *certificateReloader
+}
+
+func New(i NewInput) (*Server, error) {
+	s := Server{
+		srv: &http.Server{
+			Addr:              i.Addr,
+			Handler:           i.Handler,
+			ReadHeaderTimeout: i.ReadHeaderTimeout,
+			ReadTimeout:       i.ReadTimeout,
+			WriteTimeout:      i.WriteTimeout,
+			IdleTimeout:       i.IdleTimeout,
+		},
+	}
+
+	if i.TLS.CertFile != "" || i.TLS.KeyFile != "" {
+		certificate, err := newCertificateReloader(i.TLS.CertFile, i.TLS.KeyFile, i.TLS.ReloadInterval)
+		if err != nil {
+			return nil, err
+		}
+		s.tlsEnabled = true
+		s.certificate = certificate
+		s.srv.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certificate.GetCertificate,
+		}
+		return &s, nil
+	}
+
+	if i.H2C {
+		s.srv.Handler = h2c.NewHandler(i.Handler, &http2.Server{
+			IdleTimeout: i.IdleTimeout,
+		})
+	}
+	return &s, nil
+}
+
+// 待ち受けを開始する
+// Shutdown により終了した場合は nil を返却する
+func (s *Server) ListenAndServe() error {
+	var err error
+	if s.tlsEnabled {
+		// 証明書は TLSConfig.GetCertificate から取得する
+		err = s.srv.ListenAndServeTLS("", "")
+	} else {
+		err = s.srv.ListenAndServe()
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// 新しい接続の受け付けを停止し、処理中のリクエストの完了を待って終了する
+// ctx がキャンセルされた場合は、処理中のリクエストを待たずに終了する
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.srv.Shutdown(ctx)
+}
+
+func (s *Server) TLSEnabled() bool {
+	return s.tlsEnabled
+}
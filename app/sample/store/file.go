@@ -0,0 +1,166 @@
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 有効期限(unix nano)を保存するヘッダのサイズ
+const fileStoreHeaderSize = 8
+
+// 有効期限切れのファイルを削除する間隔
+const fileStoreSweepInterval = time.Minute
+
+// 一時ファイルの prefix
+const fileStoreTempPrefix = ".tmp-"
+
+// ディレクトリ配下にファイルとして保存するストア
+// key ごとに1ファイルとし、先頭8bytesに有効期限、続けて値を保存する
+// 同じディレクトリを共有することで、同一ホスト上の複数プロセスから利用できる
+type FileStore struct {
+	dir string
+
+	mu        sync.Mutex
+	lastSwept time.Time
+	sweeping  bool
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if dir == "" {
+		return nil, errors.New("store: file store requires directory")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir, lastSwept: time.Now()}, nil
+}
+
+func (s *FileStore) Get(ctx context.Context, key string) ([]byte, error) {
+	path := s.path(key)
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < fileStoreHeaderSize {
+		// 書き込み途中などで壊れたファイルは存在しないものとして扱う
+		os.Remove(path)
+		return nil, ErrNotFound
+	}
+
+	expiresAt := time.Unix(0, int64(binary.BigEndian.Uint64(b[:fileStoreHeaderSize])))
+	if !expiresAt.After(time.Now()) {
+		os.Remove(path)
+		return nil, ErrNotFound
+	}
+	return b[fileStoreHeaderSize:], nil
+}
+
+func (s *FileStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	s.startSweep(time.Now())
+
+	b := make([]byte, fileStoreHeaderSize, fileStoreHeaderSize+len(value))
+	binary.BigEndian.PutUint64(b, uint64(time.Now().Add(ttl).UnixNano()))
+	b = append(b, value...)
+
+	// 読み込み中のプロセスが書き込み途中のファイルを読まないよう、一時ファイルに書き込んでから置き換える
+	tmp, err := os.CreateTemp(s.dir, fileStoreTempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(key))
+}
+
+func (s *FileStore) Delete(ctx context.Context, key string) error {
+	err := os.Remove(s.path(key))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// 一定間隔ごとに、有効期限切れのファイルの削除を開始する
+// 取得されないまま期限切れとなった値(放棄されたセッションの whoami のキャッシュ等)でディレクトリが圧迫されることを防ぐ
+// ファイル数が多い場合に Set が遅くならないよう、削除はバックグラウンドで行う
+func (s *FileStore) startSweep(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sweeping || now.Sub(s.lastSwept) < fileStoreSweepInterval {
+		return
+	}
+	s.sweeping = true
+	s.lastSwept = now
+	go func() {
+		if err := s.sweep(now); err != nil {
+			slog.Error("failed to sweep file store", "dir", s.dir, "Error", err)
+		}
+		s.mu.Lock()
+		s.sweeping = false
+		s.mu.Unlock()
+	}()
+}
+
+// 有効期限切れのファイルと、書き込み途中で残った古い一時ファイルを削除する
+func (s *FileStore) sweep(now time.Time) error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		path := filepath.Join(s.dir, entry.Name())
+		if strings.HasPrefix(entry.Name(), fileStoreTempPrefix) {
+			if info, err := entry.Info(); err == nil && now.Sub(info.ModTime()) > fileStoreSweepInterval {
+				os.Remove(path)
+			}
+			continue
+		}
+		if expired, err := fileStoreExpired(path, now); err == nil && expired {
+			os.Remove(path)
+		}
+	}
+	return nil
+}
+
+// ファイルの先頭の有効期限のみを読み込み、期限切れ(もしくは壊れたファイル)かを判定する
+func fileStoreExpired(path string, now time.Time) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	header := make([]byte, fileStoreHeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return true, nil
+	}
+	expiresAt := time.Unix(0, int64(binary.BigEndian.Uint64(header)))
+	return !expiresAt.After(now), nil
+}
+
+// key をファイル名として使用できるよう、ハッシュ値に変換する
+func (s *FileStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:]))
+}
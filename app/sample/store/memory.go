@@ -0,0 +1,81 @@
+package store
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// 有効期限切れの値を削除する間隔
+const memoryStoreSweepInterval = time.Minute
+
+// プロセス内のメモリに保存するストア
+// プロセスの再起動で値は失われ、複数プロセス間で共有されないため、開発用もしくは単一プロセスでの運用を想定
+type MemoryStore struct {
+	mu        sync.Mutex
+	items     map[string]memoryStoreItem
+	lastSwept time.Time
+}
+
+type memoryStoreItem struct {
+	value     []byte
+	expiresAt time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		items:     make(map[string]memoryStoreItem),
+		lastSwept: time.Now(),
+	}
+}
+
+func (s *MemoryStore) Get(ctx context.Context, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, ok := s.items[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if !item.expiresAt.After(time.Now()) {
+		delete(s.items, key)
+		return nil, ErrNotFound
+	}
+	// 呼び出し元での変更が保存済みの値に影響しないようコピーを返却する
+	return append([]byte(nil), item.value...), nil
+}
+
+func (s *MemoryStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.sweep(now)
+	s.items[key] = memoryStoreItem{
+		value:     append([]byte(nil), value...),
+		expiresAt: now.Add(ttl),
+	}
+	return nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.items, key)
+	return nil
+}
+
+// 一定間隔ごとに、有効期限切れの値を削除する
+// 取得されないまま期限切れとなった値でメモリが圧迫されることを防ぐ
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSwept) < memoryStoreSweepInterval {
+		return
+	}
+	for key, item := range s.items {
+		if !item.expiresAt.After(now) {
+			delete(s.items, key)
+		}
+	}
+	s.lastSwept = now
+}
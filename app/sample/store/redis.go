@@ -0,0 +1,267 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// 接続、コマンド実行のデフォルトのタイムアウト (context に期限がない場合に使用)
+const redisDefaultTimeout = 3 * time.Second
+
+// プールに保持する接続数のデフォルト
+const redisDefaultMaxIdleConns = 8
+
+type RedisInput struct {
+	// host:port
+	Addr     string
+	Username string
+	Password string
+	DB       int
+	// key に付与する prefix (他のアプリとサーバを共有する場合に使用)
+	KeyPrefix    string
+	MaxIdleConns int
+}
+
+// Redis プロトコル(RESP)互換のサーバに保存するストア
+// Redis, Valkey, KeyDB 等で使用可能
+// 必要なコマンドのみを扱う最小限のクライアントを実装しているため、外部ライブラリには依存しない
+type RedisStore struct {
+	i     RedisInput
+	conns chan *redisConn
+}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// Redis からのエラーレスポンス
+type RedisError string
+
+func (e RedisError) Error() string {
+	return "store: redis: " + string(e)
+}
+
+func NewRedisStore(i RedisInput) (*RedisStore, error) {
+	if i.Addr == "" {
+		return nil, errors.New("store: redis store requires address")
+	}
+	if i.MaxIdleConns <= 0 {
+		i.MaxIdleConns = redisDefaultMaxIdleConns
+	}
+	return &RedisStore{
+		i:     i,
+		conns: make(chan *redisConn, i.MaxIdleConns),
+	}, nil
+}
+
+func (s *RedisStore) Get(ctx context.Context, key string) ([]byte, error) {
+	reply, err := s.Do(ctx, "GET", s.i.KeyPrefix+key)
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, ErrNotFound
+	}
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("store: redis: unexpected reply: %v", reply)
+	}
+	return value, nil
+}
+
+func (s *RedisStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	// 有効期限は 1ms 単位のため、1ms 未満は 1ms に切り上げる
+	ttlMillis := ttl.Milliseconds()
+	if ttlMillis <= 0 {
+		ttlMillis = 1
+	}
+	_, err := s.Do(ctx, "SET", s.i.KeyPrefix+key, string(value), "PX", strconv.FormatInt(ttlMillis, 10))
+	return err
+}
+
+func (s *RedisStore) Delete(ctx context.Context, key string) error {
+	_, err := s.Do(ctx, "DEL", s.i.KeyPrefix+key)
+	return err
+}
+
+// 接続を全て閉じる
+func (s *RedisStore) Close() error {
+	for {
+		select {
+		case c := <-s.conns:
+			c.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// コマンドを実行し、レスポンスを返却する
+// レスポンスは RESP の型に応じて、string(simple string), int64(integer), []byte(bulk string), []any(array), nil(null) となる
+// key を引数に取るコマンドを直接実行する場合、KeyPrefix は付与されないため呼び出し元で付与すること
+func (s *RedisStore) Do(ctx context.Context, args ...string) (any, error) {
+	c, err := s.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := c.do(ctx, args)
+	if err != nil {
+		var redisErr RedisError
+		if errors.As(err, &redisErr) {
+			// エラーレスポンスの場合は接続を再利用できる
+			s.putConn(c)
+		} else {
+			c.conn.Close()
+		}
+		return nil, err
+	}
+	s.putConn(c)
+	return reply, nil
+}
+
+// Key に KeyPrefix を付与する
+func (s *RedisStore) Key(key string) string {
+	return s.i.KeyPrefix + key
+}
+
+func (s *RedisStore) getConn(ctx context.Context) (*redisConn, error) {
+	select {
+	case c := <-s.conns:
+		return c, nil
+	default:
+	}
+
+	dialer := net.Dialer{Timeout: redisDefaultTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", s.i.Addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+
+	if s.i.Password != "" {
+		args := []string{"AUTH", s.i.Password}
+		if s.i.Username != "" {
+			args = []string{"AUTH", s.i.Username, s.i.Password}
+		}
+		if _, err := c.do(ctx, args); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if s.i.DB != 0 {
+		if _, err := c.do(ctx, []string{"SELECT", strconv.Itoa(s.i.DB)}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// 接続をプールへ戻す
+// プールに空きがない場合は接続を閉じる
+func (s *RedisStore) putConn(c *redisConn) {
+	select {
+	case s.conns <- c:
+	default:
+		c.conn.Close()
+	}
+}
+
+func (c *redisConn) do(ctx context.Context, args []string) (any, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(redisDefaultTimeout)
+	}
+	if err := c.conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	// コマンドは bulk string の array として送信する
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	if _, err := c.conn.Write(buf); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+func (c *redisConn) readReply() (any, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("store: redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, RedisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		values := make([]any, n)
+		for i := range values {
+			// 要素がエラーの場合も、残りの要素を読み切るまで処理を続ける
+			value, err := c.readReply()
+			var redisErr RedisError
+			if err != nil && !errors.As(err, &redisErr) {
+				return nil, err
+			}
+			values[i] = value
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("store: redis: unexpected reply: %q", line)
+	}
+}
+
+func (c *redisConn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("store: redis: invalid line: %q", line)
+	}
+	return line[:len(line)-2], nil
+}
@@ -0,0 +1,337 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// テスト用の RESP サーバ
+// コマンドごとに、replies に登録したレスポンスを返却する (未登録のコマンドは GET, SET, DEL を最小限に実装する)
+type fakeRedisServer struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	accepted int
+	commands [][]string
+	values   map[string]string
+	replies  map[string]string
+	// 次のコマンドで、レスポンスを返さずに接続を閉じる
+	closeNext bool
+}
+
+func newFakeRedisServer(t *testing.T) *fakeRedisServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeRedisServer{
+		listener: listener,
+		values:   make(map[string]string),
+		replies:  make(map[string]string),
+	}
+	t.Cleanup(func() { listener.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *fakeRedisServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.accepted++
+		s.mu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeRedisServer) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readFakeCommand(r)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.commands = append(s.commands, args)
+		if s.closeNext {
+			s.closeNext = false
+			s.mu.Unlock()
+			return
+		}
+		reply := s.reply(args)
+		s.mu.Unlock()
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeRedisServer) reply(args []string) string {
+	if reply, ok := s.replies[args[0]]; ok {
+		return reply
+	}
+	switch args[0] {
+	case "GET":
+		value, ok := s.values[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+	case "SET":
+		s.values[args[1]] = args[2]
+		return "+OK\r\n"
+	case "DEL":
+		_, ok := s.values[args[1]]
+		delete(s.values, args[1])
+		if ok {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	default:
+		return "-ERR unknown command '" + args[0] + "'\r\n"
+	}
+}
+
+func readFakeCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("unexpected command: %q", line)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		args[i] = string(b[:size])
+	}
+	return args, nil
+}
+
+func (s *fakeRedisServer) acceptedConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.accepted
+}
+
+func (s *fakeRedisServer) receivedCommands() [][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]string(nil), s.commands...)
+}
+
+func TestRedisStoreGetSetDelete(t *testing.T) {
+	server := newFakeRedisServer(t)
+	s, err := NewRedisStore(RedisInput{Addr: server.listener.Addr().String(), KeyPrefix: "app:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+
+	// 値に改行を含む場合も、bulk string として長さで読み込む
+	value := []byte("line1\r\nline2\x00")
+	if err := s.Set(ctx, "k", value, 1500*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Get(ctx, "k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(value) {
+		t.Errorf("Get() = %q, want %q", got, value)
+	}
+	if err := s.Delete(ctx, "k"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(ctx, "k"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() after Delete error = %v, want ErrNotFound", err)
+	}
+
+	commands := server.receivedCommands()
+	set := strings.Join(commands[0], " ")
+	if want := "SET app:k " + string(value) + " PX 1500"; set != want {
+		t.Errorf("SET command = %q, want %q", set, want)
+	}
+	if got := server.acceptedConns(); got != 1 {
+		t.Errorf("accepted connections = %d, want 1 (connection reuse)", got)
+	}
+}
+
+func TestRedisStoreReplies(t *testing.T) {
+	server := newFakeRedisServer(t)
+	server.replies["SIMPLE"] = "+PONG\r\n"
+	server.replies["INT"] = ":-42\r\n"
+	server.replies["NILBULK"] = "$-1\r\n"
+	server.replies["EMPTYBULK"] = "$0\r\n\r\n"
+	server.replies["NILARRAY"] = "*-1\r\n"
+	server.replies["ARRAY"] = "*4\r\n:1\r\n$-1\r\n$3\r\nfoo\r\n*1\r\n+OK\r\n"
+	s, err := NewRedisStore(RedisInput{Addr: server.listener.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{command: "SIMPLE", want: "PONG"},
+		{command: "INT", want: "-42"},
+		{command: "NILBULK", want: "<nil>"},
+		{command: "EMPTYBULK", want: "[]"},
+		{command: "NILARRAY", want: "<nil>"},
+		{command: "ARRAY", want: "[1 <nil> [102 111 111] [OK]]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			reply, err := s.Do(ctx, tt.command)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fmt.Sprint(reply); got != tt.want {
+				t.Errorf("Do(%s) = %s, want %s", tt.command, got, tt.want)
+			}
+		})
+	}
+	if got := server.acceptedConns(); got != 1 {
+		t.Errorf("accepted connections = %d, want 1 (connection reuse)", got)
+	}
+}
+
+func TestRedisStoreErrorReply(t *testing.T) {
+	server := newFakeRedisServer(t)
+	server.replies["BROKEN"] = "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+	s, err := NewRedisStore(RedisInput{Addr: server.listener.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+
+	_, err = s.Do(ctx, "BROKEN")
+	var redisErr RedisError
+	if !errors.As(err, &redisErr) || !strings.HasPrefix(string(redisErr), "WRONGTYPE") {
+		t.Fatalf("Do() error = %v, want RedisError WRONGTYPE", err)
+	}
+	// エラーレスポンスの後も、同じ接続を再利用する
+	if _, err := s.Get(ctx, "k"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() error = %v, want ErrNotFound", err)
+	}
+	if got := server.acceptedConns(); got != 1 {
+		t.Errorf("accepted connections = %d, want 1", got)
+	}
+}
+
+func TestRedisStoreReconnectAfterConnectionError(t *testing.T) {
+	server := newFakeRedisServer(t)
+	s, err := NewRedisStore(RedisInput{Addr: server.listener.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+
+	if err := s.Set(ctx, "k", []byte("v"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	server.mu.Lock()
+	server.closeNext = true
+	server.mu.Unlock()
+	if _, err := s.Get(ctx, "k"); err == nil {
+		t.Fatal("Get() error = nil, want connection error")
+	}
+	// 切断された接続はプールへ戻さず、次のコマンドで接続し直す
+	got, err := s.Get(ctx, "k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "v" {
+		t.Errorf("Get() = %q, want %q", got, "v")
+	}
+	if got := server.acceptedConns(); got != 2 {
+		t.Errorf("accepted connections = %d, want 2", got)
+	}
+}
+
+func TestRedisStoreAuthAndSelect(t *testing.T) {
+	server := newFakeRedisServer(t)
+	server.replies["AUTH"] = "+OK\r\n"
+	server.replies["SELECT"] = "+OK\r\n"
+	s, err := NewRedisStore(RedisInput{
+		Addr:     server.listener.Addr().String(),
+		Username: "app",
+		Password: "secret",
+		DB:       2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if _, err := s.Get(ctx, "k"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Get() error = %v, want ErrNotFound", err)
+		}
+	}
+	var got []string
+	for _, command := range server.receivedCommands() {
+		got = append(got, strings.Join(command, " "))
+	}
+	// AUTH, SELECT は接続ごとに1回のみ送信する
+	want := []string{"AUTH app secret", "SELECT 2", "GET k", "GET k"}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("commands = %q, want %q", got, want)
+	}
+}
+
+func TestRedisStoreAuthError(t *testing.T) {
+	server := newFakeRedisServer(t)
+	server.replies["AUTH"] = "-WRONGPASS invalid username-password pair\r\n"
+	s, err := NewRedisStore(RedisInput{Addr: server.listener.Addr().String(), Password: "wrong"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	_, err = s.Get(context.Background(), "k")
+	var redisErr RedisError
+	if !errors.As(err, &redisErr) {
+		t.Fatalf("Get() error = %v, want RedisError", err)
+	}
+	// 認証に失敗した接続はプールへ戻さない
+	if got := len(s.conns); got != 0 {
+		t.Errorf("pooled connections = %d, want 0", got)
+	}
+}
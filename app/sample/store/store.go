@@ -0,0 +1,56 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// サーバサイドでアプリの状態(フラッシュメッセージ、ログインフック、カート、whoamiのキャッシュ等)を保存するストア
+// 値は []byte で保存し、シリアライズは利用側で行う
+// ttl を過ぎた値は取得できない (削除のタイミングは実装による)
+
+var ErrNotFound = errors.New("store: not found")
+
+type Store interface {
+	// 値を取得する
+	// 存在しない場合、有効期限切れの場合は ErrNotFound を返却する
+	Get(ctx context.Context, key string) ([]byte, error)
+	// 値を保存する
+	// 同じ key の値が存在する場合は上書きする
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// 値を削除する
+	// 存在しない場合にエラーとはしない
+	Delete(ctx context.Context, key string) error
+}
+
+type storeType string
+
+const (
+	STORE_TYPE_MEMORY = storeType("memory")
+	STORE_TYPE_FILE   = storeType("file")
+	STORE_TYPE_REDIS  = storeType("redis")
+)
+
+type NewInput struct {
+	Type storeType
+	// STORE_TYPE_FILE の場合に、値を保存するディレクトリ
+	FileDir string
+	// STORE_TYPE_REDIS の場合の接続先 (Redis プロトコル互換のサーバであれば使用可能)
+	Redis RedisInput
+}
+
+// Type に応じたストアを生成する
+func New(i NewInput) (Store, error) {
+	switch i.Type {
+	case STORE_TYPE_MEMORY:
+		return NewMemoryStore(), nil
+	case STORE_TYPE_FILE:
+		return NewFileStore(i.FileDir)
+	case STORE_TYPE_REDIS:
+		return NewRedisStore(i.Redis)
+	default:
+		return nil, fmt.Errorf("store: unknown type: %s", i.Type)
+	}
+}
@@ -0,0 +1,109 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// OpenTelemetry によるトレーシング
+//
+// Init で TracerProvider、Propagator(W3C Trace Context, Baggage) をグローバルに設定する
+// 各パッケージは otel.Tracer でスパンを作成し、Kratos へのリクエストには traceparent ヘッダを付与する
+// EXPORTER_TYPE_NONE の場合もコンテキストの伝搬は行う (スパンは記録しない)
+
+type exporterType string
+
+const (
+	EXPORTER_TYPE_NONE = exporterType("none")
+	// 標準出力へ出力する (ローカルでのデバッグ用)
+	EXPORTER_TYPE_STDOUT = exporterType("stdout")
+	// OTLP/HTTP で Collector 等へ送信する
+	EXPORTER_TYPE_OTLP = exporterType("otlp")
+)
+
+type InitInput struct {
+	ServiceName    string
+	ServiceVersion string
+	Exporter       exporterType
+	// EXPORTER_TYPE_OTLP の場合の送信先 ("otel-collector:4318" 等)
+	// 空の場合は環境変数 OTEL_EXPORTER_OTLP_ENDPOINT 等の設定を使用する
+	OTLPEndpoint string
+	// true の場合は HTTP で送信する
+	OTLPInsecure bool
+	// サンプリングする割合 (0 < SampleRatio <= 1, 0 の場合は 1 とする)
+	// 上流(リバースプロキシ等)でサンプリングされたリクエストは、割合に関わらずサンプリングする
+	SampleRatio float64
+}
+
+// トレーシングを初期化し、終了時に呼び出す関数(未送信のスパンを送信する)を返却する
+func Init(ctx context.Context, i InitInput) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	if i.Exporter == EXPORTER_TYPE_NONE || i.Exporter == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := newExporter(ctx, i)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+		resource.WithAttributes(
+			semconv.ServiceName(i.ServiceName),
+			semconv.ServiceVersion(i.ServiceVersion),
+		),
+	)
+	if err != nil && !errors.Is(err, resource.ErrPartialResource) {
+		return nil, err
+	}
+
+	ratio := i.SampleRatio
+	if ratio <= 0 || ratio > 1 {
+		ratio = 1
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(tp)
+
+	return tp.Shutdown, nil
+}
+
+func newExporter(ctx context.Context, i InitInput) (sdktrace.SpanExporter, error) {
+	switch i.Exporter {
+	case EXPORTER_TYPE_STDOUT:
+		return stdouttrace.New(
+			stdouttrace.WithWriter(os.Stdout),
+			stdouttrace.WithPrettyPrint(),
+		)
+	case EXPORTER_TYPE_OTLP:
+		var opts []otlptracehttp.Option
+		if i.OTLPEndpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(i.OTLPEndpoint))
+		}
+		if i.OTLPInsecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("telemetry: unknown exporter: %s", i.Exporter)
+	}
+}
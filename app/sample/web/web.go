@@ -0,0 +1,26 @@
+package web
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// テンプレート、静的ファイル
+//
+// 本番用のバイナリは、作業ディレクトリに依存せず動作するよう、ビルド時にファイルを埋め込む
+// 開発時は handler.Config.DevAssetsDir により、このディレクトリのファイルを直接読み込む
+
+const (
+	TEMPLATES_DIR = "templates"
+	STATIC_DIR    = "static"
+)
+
+// 部分テンプレート("_" で始まるファイル)も含めるため、all: を指定する
+//
+//go:embed all:templates all:static
+var files embed.FS
+
+// 埋め込んだファイルを返却する (TEMPLATES_DIR, STATIC_DIR 配下)
+func FS() fs.FS {
+	return files
+}